@@ -0,0 +1,108 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+// Copyright 2023 Cloudbase Solutions SRL
+//
+// Licensed under the AGPLv3, see LICENCE file for details
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/cloudbase/garm-provider-lxd/provider"
+)
+
+// defaultConfigFile is the config file used by maintenance commands, if none is given.
+const defaultConfigFile = "/etc/garm/garm-provider-lxd.toml"
+
+type commandFunc func(ctx context.Context, configFile string, w io.Writer) error
+
+// command is a maintenance command, run by an operator rather than by GARM.
+type command struct {
+	description string
+	// setup registers the flags of the command, and returns the function that runs it.
+	setup func(flags *flag.FlagSet) commandFunc
+}
+
+var commands = map[string]command{
+	"prefetch-images": {
+		description: "Copy the images in the image_cache section of the config into the local image store.",
+		setup: func(_ *flag.FlagSet) commandFunc {
+			return provider.PrefetchImages
+		},
+	},
+	"publish-image": {
+		description: "Build the images in the image_builds section of the config. Pass -alias to build only one of them.",
+		setup: func(flags *flag.FlagSet) commandFunc {
+			alias := flags.String("alias", "", "alias of the image to build")
+			return func(ctx context.Context, configFile string, w io.Writer) error {
+				var aliases []string
+				if *alias != "" {
+					aliases = []string{*alias}
+				}
+				return provider.PublishImages(ctx, configFile, aliases, w)
+			}
+		},
+	},
+	"replenish-warm-pools": {
+		description: "Create the missing warm instances of the pools in the warm_pools section of the config.",
+		setup: func(_ *flag.FlagSet) commandFunc {
+			return provider.ReplenishWarmPools
+		},
+	},
+	"gc-images": {
+		description: "Delete unused images. Pass -dry-run to only report them.",
+		setup: func(flags *flag.FlagSet) commandFunc {
+			dryRun := flags.Bool("dry-run", false, "only report the images that would be deleted")
+			return func(ctx context.Context, configFile string, w io.Writer) error {
+				return provider.CollectImages(ctx, configFile, *dryRun, w)
+			}
+		},
+	},
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s <command> [-config <file>]\n\nCommands:\n", os.Args[0])
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-20s %s\n", name, commands[name].description)
+	}
+	fmt.Fprintf(w, "\nWithout a command, the provider runs the command GARM sets in GARM_COMMAND.\n")
+}
+
+// runCommand runs the maintenance command in args. The first argument is the name of
+// the command, and the rest are its flags.
+func runCommand(ctx context.Context, args []string) error {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		usage(os.Stderr)
+		return fmt.Errorf("unknown command %s", args[0])
+	}
+
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	configFile := flags.String("config", defaultConfigFile, "path to the provider config file")
+	run := cmd.setup(flags)
+	if err := flags.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if *configFile == "" {
+		return fmt.Errorf("missing config file")
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+	return run(ctx, *configFile, os.Stdout)
+}
@@ -6,9 +6,15 @@
 package config
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
 	"net/url"
 	"os"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/pkg/errors"
@@ -23,23 +29,47 @@ func (l LXDImageType) String() string {
 
 const (
 	SimpleStreams          LXDRemoteProtocol = "simplestreams"
+	LXDProtocol            LXDRemoteProtocol = "lxd"
+	OCIProtocol            LXDRemoteProtocol = "oci"
 	LXDImageVirtualMachine LXDImageType      = "virtual-machine"
 	LXDImageContainer      LXDImageType      = "container"
+
+	// CopyInstancePrefix and CopySnapshotPrefix are used in the image of a pool to
+	// clone runners from a golden instance (instance:<name>) or from a snapshot of
+	// one (snapshot:<name>/<snapshot>). They can not be used as remote names.
+	CopyInstancePrefix = "instance"
+	CopySnapshotPrefix = "snapshot"
 )
 
 // LXDImageRemote holds information about a remote server from which LXD can fetch
-// OS images. Typically this will be a simplestreams server.
+// OS images. This can be a simplestreams server, another LXD server or an OCI
+// registry.
 type LXDImageRemote struct {
 	Address            string            `toml:"addr" json:"addr"`
 	Public             bool              `toml:"public" json:"public"`
 	Protocol           LXDRemoteProtocol `toml:"protocol" json:"protocol"`
 	InsecureSkipVerify bool              `toml:"skip_verify" json:"skip-verify"`
+
+	// ClientCertificate and ClientKey are used to authenticate to remotes that use the
+	// lxd protocol, in order to access private images.
+	ClientCertificate string `toml:"client_certificate" json:"client-certificate"`
+	ClientKey         string `toml:"client_key" json:"client-key"`
+	// TLSServerCert is the certificate of the remote. It is needed if the remote uses
+	// a self signed certificate.
+	TLSServerCert string `toml:"server_certificate" json:"server-certificate"`
+	// CACert is the CA certificate that signed the certificate of the remote. It is
+	// needed if the remote uses a certificate issued by an internal CA.
+	CACert string `toml:"ca_cert" json:"ca-cert"`
+	// ResolveAliases makes the provider resolve image aliases to fingerprints on the
+	// remote, instead of leaving it to LXD. The fingerprint is recorded on the instance.
+	ResolveAliases bool `toml:"resolve_aliases" json:"resolve-aliases"`
 }
 
 func (l *LXDImageRemote) Validate() error {
-	if l.Protocol != SimpleStreams {
-		// Only supports simplestreams for now.
-		return fmt.Errorf("invalid remote protocol %s. Supported protocols: %s", l.Protocol, SimpleStreams)
+	switch l.Protocol {
+	case SimpleStreams, LXDProtocol, OCIProtocol:
+	default:
+		return fmt.Errorf("invalid remote protocol %s. Supported protocols: %s, %s, %s", l.Protocol, SimpleStreams, LXDProtocol, OCIProtocol)
 	}
 	if l.Address == "" {
 		return fmt.Errorf("missing address")
@@ -50,10 +80,341 @@ func (l *LXDImageRemote) Validate() error {
 		return errors.Wrap(err, "validating address")
 	}
 
-	if url.Scheme != "http" && url.Scheme != "https" {
+	if l.Protocol == LXDProtocol {
+		if url.Scheme != "https" {
+			return fmt.Errorf("address must be https")
+		}
+	} else if url.Scheme != "http" && url.Scheme != "https" {
 		return fmt.Errorf("address must be http or https")
 	}
 
+	if l.Protocol != LXDProtocol && (l.ClientCertificate != "" || l.ClientKey != "") {
+		return fmt.Errorf("client_certificate and client_key are only supported by the %s protocol", LXDProtocol)
+	}
+
+	if l.Protocol == OCIProtocol && l.ResolveAliases {
+		return fmt.Errorf("resolve_aliases is not supported by the %s protocol", OCIProtocol)
+	}
+
+	hasTLSSettings := l.TLSServerCert != "" || l.CACert != "" || l.InsecureSkipVerify
+	if l.Protocol == OCIProtocol && hasTLSSettings {
+		return fmt.Errorf("server_certificate, ca_cert and skip_verify are not supported by the %s protocol", OCIProtocol)
+	}
+	if hasTLSSettings && url.Scheme != "https" {
+		return fmt.Errorf("server_certificate, ca_cert and skip_verify require an https address")
+	}
+	if l.TLSServerCert != "" && l.CACert != "" {
+		return fmt.Errorf("server_certificate and ca_cert are mutually exclusive")
+	}
+	if l.InsecureSkipVerify && (l.TLSServerCert != "" || l.CACert != "") {
+		return fmt.Errorf("skip_verify can not be used together with server_certificate or ca_cert")
+	}
+
+	if (l.ClientCertificate == "") != (l.ClientKey == "") {
+		return fmt.Errorf("client_certificate and client_key must be set together")
+	}
+	if l.ClientCertificate != "" {
+		if _, err := tls.LoadX509KeyPair(l.ClientCertificate, l.ClientKey); err != nil {
+			return fmt.Errorf("failed to load client certificate %s: %w", l.ClientCertificate, err)
+		}
+	}
+
+	for _, file := range []string{l.TLSServerCert, l.CACert} {
+		if file == "" {
+			continue
+		}
+		if err := validateCertificateFile(file); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateCertificateFile checks that file holds a PEM encoded certificate. Only the
+// first certificate in the file is used by LXD.
+func validateCertificateFile(file string) error {
+	contents, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to access %s: %w", file, err)
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return fmt.Errorf("%s does not contain a PEM encoded certificate", file)
+	}
+	if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+		return fmt.Errorf("failed to parse certificate %s: %w", file, err)
+	}
+	return nil
+}
+
+type ReadinessCondition string
+
+const (
+	// ReadinessIPv4 waits for the instance to get a global IPv4 address.
+	ReadinessIPv4 ReadinessCondition = "ipv4"
+	// ReadinessIPv6 waits for the instance to get a global IPv6 address.
+	ReadinessIPv6 ReadinessCondition = "ipv6"
+	// ReadinessAnyIP waits for the instance to get any global IP address.
+	ReadinessAnyIP ReadinessCondition = "any-ip"
+	// ReadinessAgent waits for the LXD agent inside a virtual machine to come online.
+	// Containers don't need an agent, so they are ready as soon as they are running.
+	ReadinessAgent ReadinessCondition = "agent"
+	// ReadinessCloudInit waits for cloud-init to finish inside the instance. The status
+	// is fetched by running "cloud-init status" inside the instance.
+	ReadinessCloudInit ReadinessCondition = "cloud-init"
+
+	// DefaultReadinessTimeout is the default number of seconds we wait for a new
+	// instance to become ready.
+	DefaultReadinessTimeout uint = 120
+)
+
+// Readiness defines when a newly created instance is considered ready.
+type Readiness struct {
+	// Condition is the condition the instance needs to satisfy. Defaults to ipv4.
+	Condition ReadinessCondition `toml:"condition" json:"condition,omitempty" jsonschema:"enum=ipv4,enum=ipv6,enum=any-ip,enum=agent,enum=cloud-init,description=The condition a new instance needs to satisfy to be considered ready."`
+	// Timeout is the number of seconds we wait for the instance to become ready.
+	Timeout uint `toml:"timeout" json:"timeout,omitempty" jsonschema:"description=The number of seconds to wait for a new instance to become ready."`
+}
+
+func (r *Readiness) Validate() error {
+	switch r.Condition {
+	case "", ReadinessIPv4, ReadinessIPv6, ReadinessAnyIP, ReadinessAgent, ReadinessCloudInit:
+	default:
+		return fmt.Errorf("invalid readiness condition %s", r.Condition)
+	}
+	return nil
+}
+
+// DefaultImageCacheRefreshInterval is the default number of hours after which cached
+// images are refreshed by the prefetch-images command.
+const DefaultImageCacheRefreshInterval uint = 24
+
+// DefaultImageMaxAge is the default number of hours an unused image is kept, before the
+// gc-images command deletes it.
+const DefaultImageMaxAge uint = 168
+
+// CachedImage is an image that is kept in the local image store of the LXD server.
+type CachedImage struct {
+	// Image is the image to cache, in the remote:alias format used by pools.
+	Image string `toml:"image" json:"image"`
+	// InstanceType is the type of the image. Defaults to the instance_type of the provider.
+	InstanceType LXDImageType `toml:"instance_type" json:"instance-type"`
+	// Architectures are the architectures to cache the image for (amd64, arm64, etc).
+	// Defaults to the native architecture of the LXD server.
+	Architectures []string `toml:"architectures" json:"architectures"`
+}
+
+// ImageCache defines which remote images are copied into the local image store, so
+// runners can be created without contacting the remote.
+type ImageCache struct {
+	// Images are copied into the local image store by the prefetch-images command.
+	Images []CachedImage `toml:"images" json:"images"`
+	// Auto makes the provider cache remote images the first time they are used.
+	Auto bool `toml:"auto" json:"auto"`
+	// RefreshInterval is the number of hours after which the prefetch-images command
+	// refreshes a cached image from its remote.
+	RefreshInterval uint `toml:"refresh_interval" json:"refresh-interval"`
+	// MaxAge is the number of hours an unused image is kept, before the gc-images
+	// command deletes it.
+	MaxAge uint `toml:"max_age" json:"max-age"`
+}
+
+// Enabled returns true if remote images may be served from the cache.
+func (c *ImageCache) Enabled() bool {
+	return c.Auto || len(c.Images) > 0
+}
+
+// GetRefreshInterval returns the refresh interval, with the default applied.
+func (c *ImageCache) GetRefreshInterval() time.Duration {
+	if c.RefreshInterval == 0 {
+		return time.Duration(DefaultImageCacheRefreshInterval) * time.Hour
+	}
+	return time.Duration(c.RefreshInterval) * time.Hour
+}
+
+// GetMaxAge returns the max age of unused images, with the default applied.
+func (c *ImageCache) GetMaxAge() time.Duration {
+	if c.MaxAge == 0 {
+		return time.Duration(DefaultImageMaxAge) * time.Hour
+	}
+	return time.Duration(c.MaxAge) * time.Hour
+}
+
+func (c *ImageCache) Validate(remotes map[string]LXDImageRemote) error {
+	for _, img := range c.Images {
+		remoteName, alias, found := strings.Cut(img.Image, ":")
+		if !found || alias == "" {
+			return fmt.Errorf("cached image %q must be in the remote:alias format", img.Image)
+		}
+		if strings.Contains(alias, "@") {
+			return fmt.Errorf("cached image %q can not be pinned to a fingerprint", img.Image)
+		}
+		remote, ok := remotes[remoteName]
+		if !ok {
+			return fmt.Errorf("cached image %q uses unknown remote %s", img.Image, remoteName)
+		}
+		if remote.Protocol == OCIProtocol {
+			return fmt.Errorf("cached image %q uses a remote with the %s protocol, which can not be cached", img.Image, OCIProtocol)
+		}
+		switch img.InstanceType {
+		case "", LXDImageContainer, LXDImageVirtualMachine:
+		default:
+			return fmt.Errorf("invalid instance_type %s for cached image %q", img.InstanceType, img.Image)
+		}
+	}
+	return nil
+}
+
+// DefaultImageBuildTimeout is the default number of seconds the publish-image command
+// waits for the builder instance to boot, and for the provisioning script to finish.
+const DefaultImageBuildTimeout uint = 1800
+
+// ImageBuild describes a runner image that is built by the publish-image command. The
+// image is published with the alias that is the key in the image_builds map.
+type ImageBuild struct {
+	// BaseImage is the image the builder instance is launched from, in the same
+	// format used by pools.
+	BaseImage string `toml:"base_image" json:"base-image"`
+	// InstanceType is the type of the image. Defaults to the instance_type of the provider.
+	InstanceType LXDImageType `toml:"instance_type" json:"instance-type"`
+	// Architecture is the architecture of the image (amd64, arm64, etc). Defaults to
+	// the native architecture of the LXD server.
+	Architecture string `toml:"architecture" json:"architecture"`
+	// Profiles are applied to the builder instance. Defaults to the default profile.
+	Profiles []string `toml:"profiles" json:"profiles"`
+	// Script is the path to the provisioning script, which is run as root inside the
+	// builder instance.
+	Script string `toml:"script" json:"script"`
+	// OS, Release and Description are set as properties of the image.
+	OS          string `toml:"os" json:"os"`
+	Release     string `toml:"release" json:"release"`
+	Description string `toml:"description" json:"description"`
+	// Timeout is the number of seconds we wait for the builder to boot, and for the
+	// provisioning script to finish.
+	Timeout uint `toml:"timeout" json:"timeout"`
+}
+
+// GetTimeout returns the build timeout, with the default applied.
+func (b *ImageBuild) GetTimeout() time.Duration {
+	if b.Timeout == 0 {
+		return time.Duration(DefaultImageBuildTimeout) * time.Second
+	}
+	return time.Duration(b.Timeout) * time.Second
+}
+
+func (b *ImageBuild) Validate() error {
+	if b.BaseImage == "" {
+		return fmt.Errorf("missing base_image")
+	}
+	switch b.InstanceType {
+	case "", LXDImageContainer, LXDImageVirtualMachine:
+	default:
+		return fmt.Errorf("invalid instance_type %s", b.InstanceType)
+	}
+	if b.Script == "" {
+		return fmt.Errorf("missing script")
+	}
+	if _, err := os.Stat(b.Script); err != nil {
+		return fmt.Errorf("failed to access script %s: %w", b.Script, err)
+	}
+	if b.OS == "" || b.Release == "" {
+		return fmt.Errorf("os and release are mandatory")
+	}
+	return nil
+}
+
+// PlacementStrategy decides which endpoint a new instance is created on, when
+// multiple endpoints are configured.
+type PlacementStrategy string
+
+const (
+	// PlacementRoundRobin creates each new instance on the endpoint that follows
+	// the endpoint of the most recently created instance.
+	PlacementRoundRobin PlacementStrategy = "round-robin"
+	// PlacementLeastInstances creates new instances on the endpoint that runs the
+	// fewest instances.
+	PlacementLeastInstances PlacementStrategy = "least-instances"
+	// PlacementWeighted spreads instances across endpoints, proportionally to the
+	// weight of each endpoint.
+	PlacementWeighted PlacementStrategy = "weighted"
+	// PlacementCapacityAware creates new instances on the endpoint with the largest
+	// share of free memory.
+	PlacementCapacityAware PlacementStrategy = "capacity-aware"
+)
+
+// LXDEndpoint holds the connection information for one of the LXD servers runners
+// are spread across. The name of the endpoint is the key in the endpoints map of the
+// provider config.
+type LXDEndpoint struct {
+	// UnixSocket is the path on disk to the LXD unix socket. If defined,
+	// this is prefered over connecting via HTTPs.
+	UnixSocket string `toml:"unix_socket_path" json:"unix-socket-path"`
+	// URL holds the URL of the remote LXD server.
+	URL string `toml:"url" json:"url"`
+	// ClientCertificate is the x509 client certificate path used for authentication.
+	ClientCertificate string `toml:"client_certificate" json:"client_certificate"`
+	// ClientKey is the key used for client certificate authentication.
+	ClientKey string `toml:"client_key" json:"client-key"`
+	// TLS certificate of the remote server. If not specified, the system CA is used.
+	TLSServerCert string `toml:"tls_server_certificate" json:"tls-server-certificate"`
+	// TLSCA is the TLS CA certificate when running LXD in PKI mode.
+	TLSCA string `toml:"tls_ca" json:"tls-ca"`
+
+	// Weight is the relative share of instances this endpoint gets when using the
+	// weighted placement strategy. Defaults to 1.
+	Weight uint `toml:"weight" json:"weight"`
+	// MaxInstances is the maximum number of instances this provider creates on the
+	// endpoint. Zero means no limit.
+	MaxInstances uint `toml:"max_instances" json:"max-instances"`
+}
+
+// GetWeight returns the weight of the endpoint, with the default applied.
+func (e LXDEndpoint) GetWeight() uint {
+	if e.Weight == 0 {
+		return 1
+	}
+	return e.Weight
+}
+
+// projectConfigPrefixes are the prefixes of the project config keys that can be set
+// through the project_config option.
+var projectConfigPrefixes = []string{"features.", "limits.", "restricted"}
+
+// LXDProfile describes a profile the provider creates and keeps in sync, in the
+// projects it uses.
+type LXDProfile struct {
+	// Description is the description of the profile.
+	Description string `toml:"description" json:"description"`
+	// Config holds the config keys of the profile (limits.cpu, limits.memory, etc).
+	Config map[string]string `toml:"config" json:"config"`
+	// Devices holds the devices of the profile, indexed by device name.
+	Devices map[string]map[string]string `toml:"devices" json:"devices"`
+}
+
+func (p *LXDProfile) Validate() error {
+	return validateDevices(p.Devices)
+}
+
+// LXDFlavor describes a flavor that is applied directly to the instances of the
+// pools that use it, instead of an existing LXD profile.
+type LXDFlavor struct {
+	// Config holds the config keys set on the instance (limits.cpu, limits.memory, etc).
+	Config map[string]string `toml:"config" json:"config"`
+	// Devices holds the devices added to the instance, indexed by device name.
+	Devices map[string]map[string]string `toml:"devices" json:"devices"`
+}
+
+func (f *LXDFlavor) Validate() error {
+	return validateDevices(f.Devices)
+}
+
+func validateDevices(devices map[string]map[string]string) error {
+	for name, device := range devices {
+		if device["type"] == "" {
+			return fmt.Errorf("device %s is missing the type", name)
+		}
+	}
 	return nil
 }
 
@@ -83,6 +444,31 @@ type LXD struct {
 	// equates to a profile in the desired project.
 	ProjectName string `toml:"project_name" json:"project-name"`
 
+	// AutoCreateProject makes the provider create the project (and any allowed
+	// projects) if it does not exist, using ProjectConfig. Existing projects get
+	// the settings in ProjectConfig applied on every run.
+	AutoCreateProject bool `toml:"auto_create_project" json:"auto-create-project"`
+
+	// ProjectConfig holds the features, limits and restrictions set on projects
+	// the provider creates. Only features.*, limits.* and restricted* keys are
+	// allowed.
+	ProjectConfig map[string]string `toml:"project_config" json:"project-config"`
+
+	// Profiles holds profiles the provider creates in the projects it uses, if
+	// they don't exist. Profiles that drifted from their definition are updated.
+	Profiles map[string]LXDProfile `toml:"profiles" json:"profiles"`
+
+	// Flavors holds flavors that are applied inline to instances, without the
+	// need for a matching profile in LXD. When the flavor of a pool matches one
+	// of these, its config keys and devices are set on the instance itself.
+	Flavors map[string]LXDFlavor `toml:"flavors" json:"flavors"`
+
+	// AllowedProjects is a list of additional projects that pools may use instead
+	// of the one set in ProjectName, through the "project" extra spec. Instances
+	// are looked up in all of these projects, so they must all be dedicated to
+	// this provider.
+	AllowedProjects []string `toml:"allowed_projects" json:"allowed-projects"`
+
 	// IncludeDefaultProfile specifies whether or not this provider will always add
 	// the "default" profile to any newly created instance.
 	IncludeDefaultProfile bool `toml:"include_default_profile" json:"include-default-profile"`
@@ -108,6 +494,56 @@ type LXD struct {
 
 	// InstanceType allows you to choose between a virtual machine and a container
 	InstanceType LXDImageType `toml:"instance_type" json:"instance-type"`
+
+	// Readiness defines when a newly created instance is considered ready. This can
+	// be overridden per pool, using extra specs.
+	Readiness Readiness `toml:"readiness" json:"readiness"`
+
+	// Endpoints is a map of LXD servers to spread runners across. When set, the
+	// connection settings above are ignored, and every other setting applies to
+	// all endpoints.
+	Endpoints map[string]LXDEndpoint `toml:"endpoints" json:"endpoints"`
+	// Placement is the strategy used to pick an endpoint for new instances.
+	// Defaults to round-robin.
+	Placement PlacementStrategy `toml:"placement" json:"placement"`
+
+	// ImageCache defines the remote images that are kept in the local image store.
+	ImageCache ImageCache `toml:"image_cache" json:"image-cache"`
+
+	// WarmPools is the number of stopped instances kept ready for each pool, indexed
+	// by pool ID. New runners of the pool are started from a warm instance, instead of
+	// being created from scratch.
+	WarmPools map[string]uint `toml:"warm_pools" json:"warm-pools"`
+
+	// ImageBuilds are the runner images the publish-image command builds, indexed by
+	// the alias they are published with.
+	ImageBuilds map[string]ImageBuild `toml:"image_builds" json:"image-builds"`
+
+	// VendorData is the path to a cloud-config file that is merged into the
+	// vendor-data of all Linux runners. Pools can add their own vendor-data through
+	// the "vendor_data" extra spec.
+	VendorData string `toml:"vendor_data" json:"vendor-data"`
+}
+
+// GetPlacement returns the placement strategy, with the default applied.
+func (l *LXD) GetPlacement() PlacementStrategy {
+	if l.Placement == "" {
+		return PlacementRoundRobin
+	}
+	return l.Placement
+}
+
+// ForEndpoint returns a copy of the config that connects to the given endpoint.
+func (l *LXD) ForEndpoint(endpoint LXDEndpoint) *LXD {
+	cfg := *l
+	cfg.UnixSocket = endpoint.UnixSocket
+	cfg.URL = endpoint.URL
+	cfg.ClientCertificate = endpoint.ClientCertificate
+	cfg.ClientKey = endpoint.ClientKey
+	cfg.TLSServerCert = endpoint.TLSServerCert
+	cfg.TLSCA = endpoint.TLSCA
+	cfg.Endpoints = nil
+	return &cfg
 }
 
 func (l *LXD) GetInstanceType() LXDImageType {
@@ -119,7 +555,95 @@ func (l *LXD) GetInstanceType() LXDImageType {
 	}
 }
 
+// GetReadiness returns the readiness settings, with defaults applied.
+func (l *LXD) GetReadiness() Readiness {
+	readiness := l.Readiness
+	if readiness.Condition == "" {
+		readiness.Condition = ReadinessIPv4
+	}
+	if readiness.Timeout == 0 {
+		readiness.Timeout = DefaultReadinessTimeout
+	}
+	return readiness
+}
+
 func (l *LXD) Validate() error {
+	if err := l.Readiness.Validate(); err != nil {
+		return fmt.Errorf("invalid readiness settings: %w", err)
+	}
+
+	for _, project := range l.AllowedProjects {
+		if project == "" {
+			return fmt.Errorf("allowed_projects must not contain empty project names")
+		}
+	}
+
+	for key := range l.ProjectConfig {
+		if !slices.ContainsFunc(projectConfigPrefixes, func(prefix string) bool {
+			return strings.HasPrefix(key, prefix)
+		}) {
+			return fmt.Errorf("invalid project_config key %s", key)
+		}
+	}
+
+	for name, profile := range l.Profiles {
+		if err := profile.Validate(); err != nil {
+			return fmt.Errorf("profile %s is invalid: %w", name, err)
+		}
+	}
+
+	for name, flavor := range l.Flavors {
+		if _, ok := l.Profiles[name]; ok {
+			return fmt.Errorf("flavor %s conflicts with the profile of the same name", name)
+		}
+		if err := flavor.Validate(); err != nil {
+			return fmt.Errorf("flavor %s is invalid: %w", name, err)
+		}
+	}
+
+	for name, remote := range l.ImageRemotes {
+		if name == CopyInstancePrefix || name == CopySnapshotPrefix {
+			return fmt.Errorf("remote name %s is reserved", name)
+		}
+		if err := remote.Validate(); err != nil {
+			return fmt.Errorf("remote %s is invalid: %s", name, err)
+		}
+	}
+
+	if err := l.ImageCache.Validate(l.ImageRemotes); err != nil {
+		return fmt.Errorf("invalid image_cache settings: %w", err)
+	}
+
+	for alias, build := range l.ImageBuilds {
+		if err := build.Validate(); err != nil {
+			return fmt.Errorf("image build %s is invalid: %w", alias, err)
+		}
+	}
+
+	if l.VendorData != "" {
+		if _, err := os.Stat(l.VendorData); err != nil {
+			return fmt.Errorf("failed to access vendor_data %s: %w", l.VendorData, err)
+		}
+	}
+
+	switch l.Placement {
+	case "", PlacementRoundRobin, PlacementLeastInstances, PlacementWeighted, PlacementCapacityAware:
+	default:
+		return fmt.Errorf("invalid placement strategy %s", l.Placement)
+	}
+
+	if len(l.Endpoints) > 0 {
+		for name, endpoint := range l.Endpoints {
+			if name == "" || strings.Contains(name, "/") {
+				return fmt.Errorf("invalid endpoint name %q", name)
+			}
+			if err := l.ForEndpoint(endpoint).Validate(); err != nil {
+				return fmt.Errorf("endpoint %s is invalid: %w", name, err)
+			}
+		}
+		return nil
+	}
+
 	if l.UnixSocket != "" {
 		if _, err := os.Stat(l.UnixSocket); err != nil {
 			return fmt.Errorf("could not access unix socket %s: %w", l.UnixSocket, err)
@@ -158,11 +682,5 @@ func (l *LXD) Validate() error {
 			return fmt.Errorf("failed to access tls_server_certificate %s: %w", l.TLSServerCert, err)
 		}
 	}
-
-	for name, val := range l.ImageRemotes {
-		if err := val.Validate(); err != nil {
-			return fmt.Errorf("remote %s is invalid: %s", name, err)
-		}
-	}
 	return nil
 }
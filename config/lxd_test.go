@@ -8,6 +8,7 @@ package config
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -72,6 +73,95 @@ func TestLXDRemoteIvalidAddressScheme(t *testing.T) {
 	require.EqualError(t, err, "address must be http or https")
 }
 
+func TestLXDRemoteLXDProtocol(t *testing.T) {
+	cfg := getDefaultLXDImageRemoteConfig()
+	cfg.Protocol = LXDProtocol
+	cfg.Address = "https://images.example.com:8443"
+	require.Nil(t, cfg.Validate())
+
+	cfg.ClientCertificate = "../testdata/lxd/certs/client.crt"
+	cfg.ClientKey = "../testdata/lxd/certs/client.key"
+	cfg.TLSServerCert = "../testdata/lxd/certs/servercert.crt"
+	require.Nil(t, cfg.Validate())
+
+	cfg.Address = "http://images.example.com:8443"
+	err := cfg.Validate()
+	require.NotNil(t, err)
+	require.EqualError(t, err, "address must be https")
+
+	cfg.Address = "https://images.example.com:8443"
+	cfg.ClientKey = ""
+	err = cfg.Validate()
+	require.NotNil(t, err)
+	require.EqualError(t, err, "client_certificate and client_key must be set together")
+
+	cfg.ClientKey = "../testdata/lxd/certs/client.key"
+	cfg.TLSServerCert = "../testdata/lxd/certs/missing.crt"
+	err = cfg.Validate()
+	require.NotNil(t, err)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestLXDRemoteOCIProtocol(t *testing.T) {
+	cfg := getDefaultLXDImageRemoteConfig()
+	cfg.Protocol = OCIProtocol
+	cfg.Address = "https://docker.io"
+	require.Nil(t, cfg.Validate())
+
+	cfg.Address = "ftp://registry.example.com"
+	err := cfg.Validate()
+	require.NotNil(t, err)
+	require.EqualError(t, err, "address must be http or https")
+
+	cfg.Address = "http://registry.example.com:5000"
+	cfg.ClientCertificate = "../testdata/lxd/certs/client.crt"
+	err = cfg.Validate()
+	require.NotNil(t, err)
+	require.EqualError(t, err, "client_certificate and client_key are only supported by the lxd protocol")
+
+	cfg.Address = "https://registry.example.com"
+	cfg.ClientCertificate = ""
+	cfg.InsecureSkipVerify = true
+	err = cfg.Validate()
+	require.NotNil(t, err)
+	require.EqualError(t, err, "server_certificate, ca_cert and skip_verify are not supported by the oci protocol")
+}
+
+func TestLXDRemoteTLSSettings(t *testing.T) {
+	cfg := getDefaultLXDImageRemoteConfig()
+	cfg.Address = "https://mirror.example.com/images"
+	cfg.CACert = "../testdata/lxd/certs/servercert.crt"
+	require.Nil(t, cfg.Validate())
+
+	cfg.TLSServerCert = "../testdata/lxd/certs/servercert.crt"
+	err := cfg.Validate()
+	require.NotNil(t, err)
+	require.EqualError(t, err, "server_certificate and ca_cert are mutually exclusive")
+
+	cfg.CACert = ""
+	require.Nil(t, cfg.Validate())
+
+	cfg.InsecureSkipVerify = true
+	err = cfg.Validate()
+	require.NotNil(t, err)
+	require.EqualError(t, err, "skip_verify can not be used together with server_certificate or ca_cert")
+
+	cfg.TLSServerCert = ""
+	require.Nil(t, cfg.Validate())
+
+	cfg.Address = "http://mirror.example.com/images"
+	err = cfg.Validate()
+	require.NotNil(t, err)
+	require.EqualError(t, err, "server_certificate, ca_cert and skip_verify require an https address")
+
+	cfg.Address = "https://mirror.example.com/images"
+	cfg.InsecureSkipVerify = false
+	cfg.CACert = "../testdata/lxd/certs/client.key"
+	err = cfg.Validate()
+	require.NotNil(t, err)
+	require.EqualError(t, err, "../testdata/lxd/certs/client.key does not contain a PEM encoded certificate")
+}
+
 func TestLXDConfig(t *testing.T) {
 	cfg := getDefaultLXDConfig()
 	err := cfg.Validate()
@@ -163,5 +253,265 @@ func TestInvalidLXDImageRemotes(t *testing.T) {
 
 	err := cfg.Validate()
 	require.NotNil(t, err)
-	require.EqualError(t, err, "remote default is invalid: invalid remote protocol bogus. Supported protocols: simplestreams")
+	require.EqualError(t, err, "remote default is invalid: invalid remote protocol bogus. Supported protocols: simplestreams, lxd, oci")
+}
+
+func TestInvalidLXDImageRemotesWithUnixSocket(t *testing.T) {
+	socket := t.TempDir() + "/unix.socket"
+	require.NoError(t, os.WriteFile(socket, nil, 0o600))
+
+	cfg := getDefaultLXDConfig()
+	cfg.UnixSocket = socket
+	require.Nil(t, cfg.Validate())
+
+	cfg.ImageRemotes["default"] = LXDImageRemote{
+		Address:  "https://registry.example.com",
+		Protocol: OCIProtocol,
+		CACert:   "../testdata/lxd/certs/servercert.crt",
+	}
+	err := cfg.Validate()
+	require.NotNil(t, err)
+	require.EqualError(t, err, "remote default is invalid: server_certificate, ca_cert and skip_verify are not supported by the oci protocol")
+}
+
+func TestLXDReadiness(t *testing.T) {
+	cfg := getDefaultLXDConfig()
+	require.Equal(t, Readiness{Condition: ReadinessIPv4, Timeout: DefaultReadinessTimeout}, cfg.GetReadiness())
+
+	cfg.Readiness = Readiness{
+		Condition: ReadinessCloudInit,
+		Timeout:   600,
+	}
+	require.Nil(t, cfg.Validate())
+	require.Equal(t, cfg.Readiness, cfg.GetReadiness())
+}
+
+func TestLXDInvalidReadinessCondition(t *testing.T) {
+	cfg := getDefaultLXDConfig()
+	cfg.Readiness.Condition = ReadinessCondition("bogus")
+
+	err := cfg.Validate()
+	require.NotNil(t, err)
+	require.EqualError(t, err, "invalid readiness settings: invalid readiness condition bogus")
+}
+
+func TestLXDEmptyAllowedProject(t *testing.T) {
+	cfg := getDefaultLXDConfig()
+	cfg.AllowedProjects = []string{"garm-vms", ""}
+
+	err := cfg.Validate()
+	require.NotNil(t, err)
+	require.EqualError(t, err, "allowed_projects must not contain empty project names")
+}
+
+func TestLXDEndpoints(t *testing.T) {
+	cfg := getDefaultLXDConfig()
+	cfg.URL = ""
+	cfg.Placement = PlacementWeighted
+	cfg.Endpoints = map[string]LXDEndpoint{
+		"host1": {
+			URL:               "https://host1.example.com:8443",
+			ClientCertificate: "../testdata/lxd/certs/client.crt",
+			ClientKey:         "../testdata/lxd/certs/client.key",
+			Weight:            2,
+		},
+	}
+
+	err := cfg.Validate()
+	require.Nil(t, err)
+	require.Equal(t, uint(2), cfg.Endpoints["host1"].GetWeight())
+	require.Equal(t, uint(1), LXDEndpoint{}.GetWeight())
+
+	endpointCfg := cfg.ForEndpoint(cfg.Endpoints["host1"])
+	require.Equal(t, "https://host1.example.com:8443", endpointCfg.URL)
+	require.Equal(t, "", endpointCfg.TLSServerCert)
+	require.Nil(t, endpointCfg.Endpoints)
+	require.Equal(t, cfg.ImageRemotes, endpointCfg.ImageRemotes)
+}
+
+func TestLXDInvalidEndpoint(t *testing.T) {
+	cfg := getDefaultLXDConfig()
+	cfg.Endpoints = map[string]LXDEndpoint{
+		"host1": {
+			URL: "http://host1.example.com:8443",
+		},
+	}
+
+	err := cfg.Validate()
+	require.NotNil(t, err)
+	require.EqualError(t, err, "endpoint host1 is invalid: address must be https")
+
+	cfg.Endpoints = map[string]LXDEndpoint{
+		"host/1": {},
+	}
+	err = cfg.Validate()
+	require.NotNil(t, err)
+	require.EqualError(t, err, "invalid endpoint name \"host/1\"")
+}
+
+func TestLXDInvalidPlacement(t *testing.T) {
+	cfg := getDefaultLXDConfig()
+	cfg.Placement = PlacementStrategy("random")
+
+	err := cfg.Validate()
+	require.NotNil(t, err)
+	require.EqualError(t, err, "invalid placement strategy random")
+	require.Equal(t, PlacementRoundRobin, (&LXD{}).GetPlacement())
+}
+
+func TestLXDProjectConfig(t *testing.T) {
+	cfg := getDefaultLXDConfig()
+	cfg.AutoCreateProject = true
+	cfg.ProjectConfig = map[string]string{
+		"features.images":      "false",
+		"limits.instances":     "20",
+		"restricted":           "true",
+		"restricted.idmap.uid": "1000",
+	}
+	require.Nil(t, cfg.Validate())
+
+	cfg.ProjectConfig["user.comment"] = "runners"
+	err := cfg.Validate()
+	require.NotNil(t, err)
+	require.EqualError(t, err, "invalid project_config key user.comment")
+}
+
+func TestLXDProfiles(t *testing.T) {
+	cfg := getDefaultLXDConfig()
+	cfg.Profiles = map[string]LXDProfile{
+		"small": {
+			Config: map[string]string{"limits.cpu": "2"},
+			Devices: map[string]map[string]string{
+				"eth0": {"type": "nic", "network": "lxdbr0"},
+			},
+		},
+	}
+	require.Nil(t, cfg.Validate())
+
+	cfg.Profiles["small"].Devices["root"] = map[string]string{"path": "/", "pool": "default"}
+	err := cfg.Validate()
+	require.NotNil(t, err)
+	require.EqualError(t, err, "profile small is invalid: device root is missing the type")
+}
+
+func TestLXDFlavors(t *testing.T) {
+	cfg := getDefaultLXDConfig()
+	cfg.Flavors = map[string]LXDFlavor{
+		"small": {
+			Config: map[string]string{"limits.cpu": "2"},
+			Devices: map[string]map[string]string{
+				"root": {"type": "disk", "path": "/", "pool": "default"},
+			},
+		},
+	}
+	require.Nil(t, cfg.Validate())
+
+	cfg.Flavors["small"].Devices["eth0"] = map[string]string{"network": "lxdbr0"}
+	err := cfg.Validate()
+	require.NotNil(t, err)
+	require.EqualError(t, err, "flavor small is invalid: device eth0 is missing the type")
+
+	delete(cfg.Flavors["small"].Devices, "eth0")
+	cfg.Profiles = map[string]LXDProfile{"small": {}}
+	err = cfg.Validate()
+	require.NotNil(t, err)
+	require.EqualError(t, err, "flavor small conflicts with the profile of the same name")
+}
+
+func TestLXDRemoteResolveAliases(t *testing.T) {
+	cfg := getDefaultLXDImageRemoteConfig()
+	cfg.ResolveAliases = true
+	require.Nil(t, cfg.Validate())
+
+	cfg.Protocol = OCIProtocol
+	cfg.Address = "https://docker.io"
+	err := cfg.Validate()
+	require.NotNil(t, err)
+	require.EqualError(t, err, "resolve_aliases is not supported by the oci protocol")
+}
+
+func TestLXDReservedRemoteNames(t *testing.T) {
+	cfg := getDefaultLXDConfig()
+	cfg.ImageRemotes[CopySnapshotPrefix] = getDefaultLXDImageRemoteConfig()
+	err := cfg.Validate()
+	require.NotNil(t, err)
+	require.EqualError(t, err, "remote name snapshot is reserved")
+}
+
+func TestLXDImageCache(t *testing.T) {
+	cfg := getDefaultLXDConfig()
+	cfg.ImageCache = ImageCache{
+		Images: []CachedImage{
+			{Image: "default:24.04", InstanceType: LXDImageVirtualMachine, Architectures: []string{"amd64"}},
+		},
+	}
+	require.Nil(t, cfg.Validate())
+	require.Equal(t, 24*time.Hour, cfg.ImageCache.GetRefreshInterval())
+	require.Equal(t, 168*time.Hour, cfg.ImageCache.GetMaxAge())
+
+	cfg.ImageCache.Images[0].Image = "24.04"
+	err := cfg.Validate()
+	require.NotNil(t, err)
+	require.EqualError(t, err, `invalid image_cache settings: cached image "24.04" must be in the remote:alias format`)
+
+	cfg.ImageCache.Images[0].Image = "missing:24.04"
+	err = cfg.Validate()
+	require.NotNil(t, err)
+	require.EqualError(t, err, `invalid image_cache settings: cached image "missing:24.04" uses unknown remote missing`)
+
+	cfg.ImageCache.Images[0].Image = "default:24.04@4d0b9e8a3c2f"
+	err = cfg.Validate()
+	require.NotNil(t, err)
+	require.EqualError(t, err, `invalid image_cache settings: cached image "default:24.04@4d0b9e8a3c2f" can not be pinned to a fingerprint`)
+
+	cfg.ImageCache.Images[0].Image = "default:24.04"
+	cfg.ImageCache.Images[0].InstanceType = "vm"
+	err = cfg.Validate()
+	require.NotNil(t, err)
+	require.EqualError(t, err, `invalid image_cache settings: invalid instance_type vm for cached image "default:24.04"`)
+}
+
+func TestLXDImageBuilds(t *testing.T) {
+	script := t.TempDir() + "/provision.sh"
+	require.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\n"), 0o600))
+
+	cfg := getDefaultLXDConfig()
+	cfg.ImageBuilds = map[string]ImageBuild{
+		"runner-noble": {
+			BaseImage: "default:24.04",
+			Script:    script,
+			OS:        "ubuntu",
+			Release:   "noble",
+		},
+	}
+	require.Nil(t, cfg.Validate())
+	build := cfg.ImageBuilds["runner-noble"]
+	require.Equal(t, 30*time.Minute, build.GetTimeout())
+
+	build.Release = ""
+	cfg.ImageBuilds["runner-noble"] = build
+	err := cfg.Validate()
+	require.NotNil(t, err)
+	require.EqualError(t, err, "image build runner-noble is invalid: os and release are mandatory")
+
+	build.Release = "noble"
+	build.Script = t.TempDir() + "/missing.sh"
+	cfg.ImageBuilds["runner-noble"] = build
+	err = cfg.Validate()
+	require.NotNil(t, err)
+	require.ErrorContains(t, err, "image build runner-noble is invalid: failed to access script")
+}
+
+func TestLXDVendorData(t *testing.T) {
+	vendorData := t.TempDir() + "/vendor-data.yaml"
+	require.NoError(t, os.WriteFile(vendorData, []byte("#cloud-config\nntp:\n  servers: [ntp.example.com]\n"), 0o600))
+
+	cfg := getDefaultLXDConfig()
+	cfg.VendorData = vendorData
+	require.Nil(t, cfg.Validate())
+
+	cfg.VendorData = t.TempDir() + "/missing.yaml"
+	err := cfg.Validate()
+	require.NotNil(t, err)
+	require.ErrorContains(t, err, "failed to access vendor_data")
 }
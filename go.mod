@@ -7,11 +7,10 @@ require (
 	github.com/canonical/lxd v0.0.0-20260319145420-ebf3ce91376e
 	github.com/cloudbase/garm-provider-common v0.1.8
 	github.com/gorilla/websocket v1.5.4-0.20240702125206-a62d9d2a8413
-	github.com/juju/clock v1.1.1
-	github.com/juju/retry v1.0.1
 	github.com/pkg/errors v0.9.1
 	github.com/stretchr/testify v1.11.1
 	github.com/xeipuuv/gojsonschema v1.2.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -41,8 +40,6 @@ require (
 	github.com/gorilla/handlers v1.5.2 // indirect
 	github.com/gorilla/securecookie v1.1.2 // indirect
 	github.com/invopop/jsonschema v0.13.0
-	github.com/juju/errors v1.0.0 // indirect
-	github.com/juju/testing v1.0.2 // indirect
 	github.com/kr/fs v0.1.0 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/minio/sio v0.4.3 // indirect
@@ -62,5 +59,4 @@ require (
 	golang.org/x/term v0.41.0 // indirect
 	golang.org/x/text v0.35.0 // indirect
 	gopkg.in/natefinch/lumberjack.v2 v2.2.1 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
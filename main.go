@@ -29,6 +29,14 @@ func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), signals...)
 	defer stop()
 
+	if len(os.Args) > 1 {
+		if err := runCommand(ctx, os.Args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to run command: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	executionEnv, err := execution.GetEnvironment()
 	if err != nil {
 		log.Fatal(err)
@@ -0,0 +1,123 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+// Copyright 2023 Cloudbase Solutions SRL
+//
+// Licensed under the AGPLv3, see LICENCE file for details
+
+package provider
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/canonical/lxd/shared/api"
+	runnerErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/pkg/errors"
+)
+
+const (
+	// clusterGroupPrefix marks a target as a cluster group, rather than a member.
+	clusterGroupPrefix = "@"
+	// clusterMemberOnline is the status of cluster members that can run instances.
+	// Evacuated and offline members have other statuses.
+	clusterMemberOnline = "Online"
+)
+
+// clusterMembers returns the members of the cluster that match the target. The target
+// is either the name of a member, or the name of a cluster group prefixed with @. An
+// empty target matches all members.
+func clusterMembers(cli InstanceServerInterface, target string) ([]api.ClusterMember, error) {
+	if !cli.IsClustered() {
+		return nil, runnerErrors.NewBadRequestError("target %s was requested, but the LXD server is not clustered", target)
+	}
+
+	members, err := cli.GetClusterMembers()
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching cluster members")
+	}
+
+	group, isGroup := strings.CutPrefix(target, clusterGroupPrefix)
+	ret := []api.ClusterMember{}
+	for _, member := range members {
+		switch {
+		case target == "":
+		case isGroup && slices.Contains(member.Groups, group):
+		case !isGroup && member.ServerName == target:
+		default:
+			continue
+		}
+		ret = append(ret, member)
+	}
+
+	if len(ret) == 0 {
+		return nil, runnerErrors.NewBadRequestError("no cluster member matches target %s", target)
+	}
+	return ret, nil
+}
+
+// selectClusterMember returns the cluster member a new instance of the pool should be
+// created on. If the target is a member, it's used as is, as long as it's online.
+// Otherwise, we pick one of the online members in the target group (or in the whole
+// cluster), preferring the members that run the fewest instances of the same pool, so
+// a member going down takes out as few runners of a pool as possible. Ties go to the
+// member with the largest share of free memory. An empty result means LXD should pick
+// the member, as the server is not clustered.
+func (l *LXD) selectClusterMember(ctx context.Context, cli InstanceServerInterface, target, poolID string) (string, error) {
+	if target == "" && !cli.IsClustered() {
+		return "", nil
+	}
+
+	members, err := clusterMembers(cli, target)
+	if err != nil {
+		return "", errors.Wrap(err, "fetching cluster members")
+	}
+
+	if target != "" && !strings.HasPrefix(target, clusterGroupPrefix) {
+		if members[0].Status != clusterMemberOnline {
+			return "", errors.Errorf("cluster member %s is %s", target, strings.ToLower(members[0].Status))
+		}
+		return target, nil
+	}
+
+	members = slices.DeleteFunc(members, func(member api.ClusterMember) bool {
+		return member.Status != clusterMemberOnline
+	})
+	if len(members) == 0 {
+		return "", errors.Errorf("no online cluster member matches target %q", target)
+	}
+	slices.SortFunc(members, func(a, b api.ClusterMember) int {
+		return strings.Compare(a.ServerName, b.ServerName)
+	})
+
+	instances, err := l.listInstances(ctx, poolID)
+	if err != nil {
+		return "", errors.Wrap(err, "listing pool instances")
+	}
+	poolInstances := map[string]int{}
+	for _, instance := range instances {
+		poolInstances[instance.Location]++
+	}
+
+	freeMemory := map[string]float64{}
+	for _, member := range members {
+		// Best effort. Members we can't get the resources of are considered full.
+		resources, err := cli.UseTarget(member.ServerName).GetServerResources()
+		if err == nil && resources.Memory.Total > 0 {
+			freeMemory[member.ServerName] = float64(resources.Memory.Total-resources.Memory.Used) / float64(resources.Memory.Total)
+		}
+	}
+
+	selected := slices.MinFunc(members, func(a, b api.ClusterMember) int {
+		if diff := poolInstances[a.ServerName] - poolInstances[b.ServerName]; diff != 0 {
+			return diff
+		}
+		switch fa, fb := freeMemory[a.ServerName], freeMemory[b.ServerName]; {
+		case fa > fb:
+			return -1
+		case fa < fb:
+			return 1
+		}
+		return 0
+	})
+	return selected.ServerName, nil
+}
@@ -0,0 +1,201 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+// Copyright 2023 Cloudbase Solutions SRL
+//
+// Licensed under the AGPLv3, see LICENCE file for details
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	lxd "github.com/canonical/lxd/client"
+	"github.com/canonical/lxd/shared/api"
+	"github.com/cloudbase/garm-provider-lxd/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newClusterLXD(cli *MockLXDServer) *LXD {
+	return &LXD{
+		cfg: &config.LXD{
+			UnixSocket:   "/var/snap/lxd/common/lxd/unix.socket",
+			InstanceType: config.LXDImageContainer,
+		},
+		cli:          cli,
+		imageManager: &image{},
+		controllerID: "controller",
+	}
+}
+
+func mockClusterMember(cli *MockLXDServer, name string, total, used uint64) {
+	member := new(MockLXDServer)
+	if total == 0 {
+		member.On("GetServerResources").Return((*api.Resources)(nil), fmt.Errorf("member unreachable"))
+	} else {
+		member.On("GetServerResources").Return(&api.Resources{
+			Memory: api.ResourcesMemory{Total: total, Used: used},
+		}, nil)
+	}
+	cli.On("UseTarget", name).Return(&MockTargetServer{Member: member})
+}
+
+func TestClusterMembers(t *testing.T) {
+	cli := new(MockLXDServer)
+	cli.On("IsClustered").Return(true)
+	cli.On("GetClusterMembers").Return([]api.ClusterMember{
+		{ServerName: "node1", Status: "Online", Groups: []string{"default", "gpu"}},
+		{ServerName: "node2", Status: "Evacuated", Groups: []string{"default"}},
+	}, nil)
+
+	members, err := clusterMembers(cli, "")
+	require.NoError(t, err)
+	assert.Len(t, members, 2)
+
+	members, err = clusterMembers(cli, "node2")
+	require.NoError(t, err)
+	require.Len(t, members, 1)
+	assert.Equal(t, "node2", members[0].ServerName)
+
+	members, err = clusterMembers(cli, "@gpu")
+	require.NoError(t, err)
+	require.Len(t, members, 1)
+	assert.Equal(t, "node1", members[0].ServerName)
+
+	_, err = clusterMembers(cli, "@arm")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no cluster member matches target @arm")
+
+	standalone := new(MockLXDServer)
+	standalone.On("IsClustered").Return(false)
+	_, err = clusterMembers(standalone, "node1")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "the LXD server is not clustered")
+}
+
+func TestSelectClusterMember(t *testing.T) {
+	ctx := context.Background()
+	listArgs := lxd.GetInstancesFullArgs{InstanceType: api.InstanceTypeAny}
+	poolInstance := func(name, location string) api.InstanceFull {
+		return api.InstanceFull{
+			Instance: api.Instance{
+				Name:     name,
+				Location: location,
+				ExpandedConfig: map[string]string{
+					controllerIDKeyName: "controller",
+					poolIDKey:           "pool",
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		name      string
+		target    string
+		clustered bool
+		instances []api.InstanceFull
+		expected  string
+		errString string
+	}{
+		{
+			name:      "standalone server",
+			clustered: false,
+			expected:  "",
+		},
+		{
+			name:      "member target",
+			target:    "node1",
+			clustered: true,
+			expected:  "node1",
+		},
+		{
+			name:      "evacuated member target",
+			target:    "node3",
+			clustered: true,
+			errString: "cluster member node3 is evacuated",
+		},
+		{
+			name:      "spread pool instances",
+			clustered: true,
+			instances: []api.InstanceFull{
+				poolInstance("runner-1", "node1"),
+				poolInstance("runner-2", "node1"),
+				poolInstance("runner-3", "node2"),
+			},
+			expected: "node4",
+		},
+		{
+			name:      "free memory breaks ties",
+			clustered: true,
+			instances: []api.InstanceFull{
+				poolInstance("runner-1", "node4"),
+			},
+			expected: "node2",
+		},
+		{
+			name:      "group target",
+			target:    "@gpu",
+			clustered: true,
+			instances: []api.InstanceFull{
+				poolInstance("runner-1", "node1"),
+			},
+			expected: "node2",
+		},
+		{
+			name:      "no online member in group",
+			target:    "@arm",
+			clustered: true,
+			errString: "no online cluster member matches target",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cli := new(MockLXDServer)
+			l := newClusterLXD(cli)
+			cli.On("IsClustered").Return(tt.clustered)
+			cli.On("GetClusterMembers").Return([]api.ClusterMember{
+				{ServerName: "node1", Status: "Online", Groups: []string{"gpu"}},
+				{ServerName: "node2", Status: "Online", Groups: []string{"gpu"}},
+				{ServerName: "node3", Status: "Evacuated", Groups: []string{"arm"}},
+				{ServerName: "node4", Status: "Online"},
+			}, nil)
+			cli.On("GetInstancesFull", listArgs).Return(tt.instances, nil)
+			mockClusterMember(cli, "node1", 100, 30)
+			mockClusterMember(cli, "node2", 100, 20)
+			mockClusterMember(cli, "node4", 0, 0)
+
+			member, err := l.selectClusterMember(ctx, cli, tt.target, "pool")
+			if tt.errString != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.errString)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, member)
+		})
+	}
+}
+
+func TestLaunchInstanceWithTarget(t *testing.T) {
+	ctx := context.Background()
+	cli := new(MockLXDServer)
+	member := new(MockLXDServer)
+	l := newClusterLXD(cli)
+
+	createArgs := api.InstancesPost{Name: "runner-1"}
+	mockOp := new(MockOperation)
+	mockOp.On("Wait").Return(nil)
+	cli.On("UseTarget", "node2").Return(&MockTargetServer{Member: member})
+	member.On("CreateInstance", createArgs).Return(mockOp, nil)
+	cli.On("UpdateInstanceState", "runner-1", "", api.InstanceStatePut{
+		Action:  "start",
+		Timeout: -1,
+	}).Return(mockOp, nil)
+
+	err := l.launchInstance(ctx, "", "node2", createArgs)
+	require.NoError(t, err)
+	member.AssertCalled(t, "CreateInstance", createArgs)
+	cli.AssertNotCalled(t, "CreateInstance", createArgs)
+}
@@ -0,0 +1,364 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+// Copyright 2023 Cloudbase Solutions SRL
+//
+// Licensed under the AGPLv3, see LICENCE file for details
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/canonical/lxd/shared/api"
+	runnerErrors "github.com/cloudbase/garm-provider-common/errors"
+	execution "github.com/cloudbase/garm-provider-common/execution/v0.1.1"
+	commonParams "github.com/cloudbase/garm-provider-common/params"
+	"github.com/cloudbase/garm-provider-lxd/config"
+	"github.com/pkg/errors"
+)
+
+// endpointSeparator separates the endpoint name from the instance name in the
+// ProviderID of instances. LXD does not allow slashes in instance names.
+const endpointSeparator = "/"
+
+var _ execution.ExternalProvider = &lxdEndpoints{}
+
+// lxdEndpoints spreads runners across multiple standalone LXD servers. Each endpoint
+// is handled by its own LXD provider. The endpoint an instance was created on is
+// recorded in the ProviderID of the instance, as <endpoint>/<instance name>, so later
+// operations go straight to the right endpoint.
+type lxdEndpoints struct {
+	cfg *config.LXD
+	// names holds the sorted names of the endpoints.
+	names []string
+	// endpoints holds a provider for each endpoint, indexed by endpoint name.
+	endpoints map[string]*LXD
+}
+
+func newLXDEndpoints(cfg *config.LXD, controllerID string) *lxdEndpoints {
+	ret := &lxdEndpoints{
+		cfg:       cfg,
+		endpoints: map[string]*LXD{},
+	}
+	for name, endpoint := range cfg.Endpoints {
+		ret.names = append(ret.names, name)
+		ret.endpoints[name] = &LXD{
+			cfg:          cfg.ForEndpoint(endpoint),
+			controllerID: controllerID,
+			imageManager: &image{
+				remotes: cfg.ImageRemotes,
+				cache:   cfg.ImageCache,
+			},
+		}
+	}
+	slices.Sort(ret.names)
+	return ret
+}
+
+// endpointErrors collects the errors returned by individual endpoints, indexed by
+// endpoint name.
+type endpointErrors map[string]error
+
+func (e endpointErrors) Error() string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	msgs := make([]string, 0, len(names))
+	for _, name := range names {
+		msgs = append(msgs, fmt.Sprintf("endpoint %s: %s", name, e[name]))
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e endpointErrors) Unwrap() []error {
+	ret := make([]error, 0, len(e))
+	for _, err := range e {
+		ret = append(ret, err)
+	}
+	return ret
+}
+
+// asError returns nil if no endpoint failed.
+func (e endpointErrors) asError() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+func parseProviderID(providerID string) (endpoint, instanceName string) {
+	endpoint, instanceName, found := strings.Cut(providerID, endpointSeparator)
+	if !found {
+		return "", providerID
+	}
+	return endpoint, instanceName
+}
+
+func withEndpoint(endpoint string, instance commonParams.ProviderInstance) commonParams.ProviderInstance {
+	if instance.Name != "" {
+		instance.ProviderID = endpoint + endpointSeparator + instance.Name
+	}
+	return instance
+}
+
+func (l *LXD) getServerResources(ctx context.Context) (*api.Resources, error) {
+	cli, err := l.getCLI(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching client")
+	}
+	resources, err := cli.GetServerResources()
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching server resources")
+	}
+	return resources, nil
+}
+
+// placementCandidates returns the endpoints a new instance may be created on, in the
+// order given by the placement strategy. Endpoints we fail to reach are left out.
+func (e *lxdEndpoints) placementCandidates(ctx context.Context) ([]string, error) {
+	strategy := e.cfg.GetPlacement()
+	failed := endpointErrors{}
+	stats := []endpointStats{}
+	for _, name := range e.names {
+		endpoint := e.endpoints[name]
+		instances, err := endpoint.listInstances(ctx, "")
+		if err != nil {
+			failed[name] = err
+			continue
+		}
+
+		stat := endpointStats{
+			name:       name,
+			endpoint:   e.cfg.Endpoints[name],
+			instances:  len(instances),
+			freeMemory: -1,
+		}
+		for _, instance := range instances {
+			if instance.CreatedAt.After(stat.lastCreated) {
+				stat.lastCreated = instance.CreatedAt
+			}
+		}
+
+		if strategy == config.PlacementCapacityAware {
+			// Best effort. Endpoints we can't get the resources of are tried last.
+			resources, err := endpoint.getServerResources(ctx)
+			if err == nil && resources.Memory.Total > 0 {
+				stat.freeMemory = float64(resources.Memory.Total-resources.Memory.Used) / float64(resources.Memory.Total)
+			}
+		}
+		stats = append(stats, stat)
+	}
+
+	ordered := orderEndpoints(strategy, stats)
+	if len(ordered) == 0 {
+		if len(failed) > 0 {
+			return nil, errors.Wrap(failed, "no endpoint available")
+		}
+		return nil, fmt.Errorf("all endpoints reached their maximum number of instances")
+	}
+
+	ret := make([]string, 0, len(ordered))
+	for _, stat := range ordered {
+		ret = append(ret, stat.name)
+	}
+	return ret, nil
+}
+
+// CreateInstance creates a new compute instance on one of the endpoints. If creating
+// the instance fails on the endpoint selected by the placement strategy, we fail over
+// to the next one.
+func (e *lxdEndpoints) CreateInstance(ctx context.Context, bootstrapParams commonParams.BootstrapInstance) (commonParams.ProviderInstance, error) {
+	// Invalid extra specs would fail on every endpoint.
+	if _, err := parseExtraSpecsFromBootstrapParams(bootstrapParams); err != nil {
+		return commonParams.ProviderInstance{}, errors.Wrap(err, "parsing extra specs")
+	}
+
+	candidates, err := e.placementCandidates(ctx)
+	if err != nil {
+		return commonParams.ProviderInstance{}, errors.Wrap(err, "selecting endpoint")
+	}
+
+	failed := endpointErrors{}
+	var lastInstance commonParams.ProviderInstance
+	for _, name := range candidates {
+		instance, err := e.endpoints[name].CreateInstance(ctx, bootstrapParams)
+		if err == nil {
+			return withEndpoint(name, instance), nil
+		}
+		failed[name] = err
+		lastInstance = instance
+		if errors.Is(err, runnerErrors.ErrBadRequest) || ctx.Err() != nil {
+			break
+		}
+	}
+	return lastInstance, errors.Wrap(failed, "creating instance")
+}
+
+// locateInstance returns the endpoint that holds the instance. ProviderIDs carry the
+// endpoint name. Plain instance names are looked up on every endpoint.
+func (e *lxdEndpoints) locateInstance(ctx context.Context, instance string) (string, string, error) {
+	endpoint, instanceName := parseProviderID(instance)
+	if endpoint != "" {
+		if _, ok := e.endpoints[endpoint]; !ok {
+			return "", "", errors.Wrapf(runnerErrors.ErrNotFound, "unknown endpoint %s", endpoint)
+		}
+		return endpoint, instanceName, nil
+	}
+
+	failed := endpointErrors{}
+	for _, name := range e.names {
+		_, err := e.endpoints[name].GetInstance(ctx, instanceName)
+		if err == nil {
+			return name, instanceName, nil
+		}
+		if !errors.Is(err, runnerErrors.ErrNotFound) {
+			failed[name] = err
+		}
+	}
+	if len(failed) > 0 {
+		return "", "", errors.Wrapf(failed, "looking for instance %s", instanceName)
+	}
+	return "", "", errors.Wrapf(runnerErrors.ErrNotFound, "looking for instance %s", instanceName)
+}
+
+// GetInstance will return details about one instance.
+func (e *lxdEndpoints) GetInstance(ctx context.Context, instance string) (commonParams.ProviderInstance, error) {
+	endpoint, instanceName, err := e.locateInstance(ctx, instance)
+	if err != nil {
+		return commonParams.ProviderInstance{}, err
+	}
+	ret, err := e.endpoints[endpoint].GetInstance(ctx, instanceName)
+	if err != nil {
+		return commonParams.ProviderInstance{}, errors.Wrapf(err, "fetching instance from endpoint %s", endpoint)
+	}
+	return withEndpoint(endpoint, ret), nil
+}
+
+// DeleteInstance will delete the instance. Instances referenced by name only are
+// removed from every endpoint that has them. Instances on an endpoint that is no
+// longer configured can't be removed, and are not reported as gone, as they may
+// still exist.
+func (e *lxdEndpoints) DeleteInstance(ctx context.Context, instance string) error {
+	endpoint, instanceName := parseProviderID(instance)
+	names := e.names
+	if endpoint != "" {
+		if _, ok := e.endpoints[endpoint]; !ok {
+			return runnerErrors.NewBadRequestError("instance %s is on unknown endpoint %s", instanceName, endpoint)
+		}
+		names = []string{endpoint}
+	}
+
+	failed := endpointErrors{}
+	for _, name := range names {
+		if err := e.endpoints[name].DeleteInstance(ctx, instanceName); err != nil {
+			failed[name] = err
+		}
+	}
+	if err := failed.asError(); err != nil {
+		return errors.Wrapf(err, "removing instance %s", instanceName)
+	}
+	return nil
+}
+
+// ListInstances will list the instances from all endpoints. If some endpoints fail,
+// the instances from the other endpoints are returned, along with an error that lists
+// the endpoints that failed.
+func (e *lxdEndpoints) ListInstances(ctx context.Context, poolID string) ([]commonParams.ProviderInstance, error) {
+	ret := []commonParams.ProviderInstance{}
+	failed := endpointErrors{}
+	for _, name := range e.names {
+		instances, err := e.endpoints[name].ListInstances(ctx, poolID)
+		if err != nil {
+			failed[name] = err
+			continue
+		}
+		for _, instance := range instances {
+			ret = append(ret, withEndpoint(name, instance))
+		}
+	}
+	if err := failed.asError(); err != nil {
+		return ret, errors.Wrap(err, "listing instances")
+	}
+	return ret, nil
+}
+
+// RemoveAllInstances will remove all instances created by this provider, on all endpoints.
+func (e *lxdEndpoints) RemoveAllInstances(ctx context.Context) error {
+	failed := endpointErrors{}
+	for _, name := range e.names {
+		if err := e.endpoints[name].RemoveAllInstances(ctx); err != nil {
+			failed[name] = err
+		}
+	}
+	if err := failed.asError(); err != nil {
+		return errors.Wrap(err, "removing instances")
+	}
+	return nil
+}
+
+// Stop shuts down the instance.
+func (e *lxdEndpoints) Stop(ctx context.Context, instance string, force bool) error {
+	endpoint, instanceName, err := e.locateInstance(ctx, instance)
+	if err != nil {
+		return err
+	}
+	return e.endpoints[endpoint].Stop(ctx, instanceName, force)
+}
+
+// Start boots up an instance.
+func (e *lxdEndpoints) Start(ctx context.Context, instance string) error {
+	endpoint, instanceName, err := e.locateInstance(ctx, instance)
+	if err != nil {
+		return err
+	}
+	return e.endpoints[endpoint].Start(ctx, instanceName)
+}
+
+// GetVersion returns the interface version of the provider.
+func (e *lxdEndpoints) GetVersion(ctx context.Context) string {
+	return Version
+}
+
+// GetSupportedInterfaceVersions will return the supported interface versions.
+func (e *lxdEndpoints) GetSupportedInterfaceVersions(ctx context.Context) []string {
+	return e.endpoints[e.names[0]].GetSupportedInterfaceVersions(ctx)
+}
+
+// ValidatePoolInfo validates the pool info against every endpoint, as instances of
+// the pool may be created on any of them.
+func (e *lxdEndpoints) ValidatePoolInfo(ctx context.Context, image string, flavor string, providerConfig string, extraspecs string) error {
+	failed := endpointErrors{}
+	for _, name := range e.names {
+		if err := e.endpoints[name].ValidatePoolInfo(ctx, image, flavor, providerConfig, extraspecs); err != nil {
+			failed[name] = err
+		}
+	}
+	if err := failed.asError(); err != nil {
+		return errors.Wrap(err, "validating pool")
+	}
+	return nil
+}
+
+// GetConfigJSONSchema will return the JSON schema for the provider's configuration.
+func (e *lxdEndpoints) GetConfigJSONSchema(ctx context.Context) (string, error) {
+	schema, err := json.Marshal(generateConfigJSONSchema())
+	if err != nil {
+		return "", errors.Wrap(err, "marshaling config schema")
+	}
+	return string(schema), nil
+}
+
+// GetExtraSpecsJSONSchema will return the JSON schema for the provider's extra specs.
+func (e *lxdEndpoints) GetExtraSpecsJSONSchema(ctx context.Context) (string, error) {
+	schema, err := json.Marshal(generateJSONSchema())
+	if err != nil {
+		return "", errors.Wrap(err, "marshaling extra specs schema")
+	}
+	return string(schema), nil
+}
@@ -0,0 +1,237 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+// Copyright 2023 Cloudbase Solutions SRL
+//
+// Licensed under the AGPLv3, see LICENCE file for details
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	lxd "github.com/canonical/lxd/client"
+	"github.com/canonical/lxd/shared/api"
+	runnerErrors "github.com/cloudbase/garm-provider-common/errors"
+	commonParams "github.com/cloudbase/garm-provider-common/params"
+	"github.com/cloudbase/garm-provider-lxd/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestEndpoints(placement config.PlacementStrategy, clients map[string]*MockLXDServer) *lxdEndpoints {
+	cfg := &config.LXD{
+		InstanceType: config.LXDImageContainer,
+		Placement:    placement,
+		Endpoints:    map[string]config.LXDEndpoint{},
+	}
+	for name := range clients {
+		cfg.Endpoints[name] = config.LXDEndpoint{
+			UnixSocket: "/var/snap/lxd/common/lxd/unix.socket",
+		}
+	}
+	ret := newLXDEndpoints(cfg, "controller")
+	for name, cli := range clients {
+		ret.endpoints[name].cli = cli
+	}
+	return ret
+}
+
+func testRunner(name string, createdAt time.Time) api.InstanceFull {
+	return api.InstanceFull{
+		Instance: api.Instance{
+			Name:         name,
+			Architecture: "x86_64",
+			CreatedAt:    createdAt,
+			ExpandedConfig: map[string]string{
+				controllerIDKeyName: "controller",
+				poolIDKey:           "pool",
+			},
+		},
+		State: &api.InstanceState{
+			Status: "Running",
+			Network: map[string]api.InstanceStateNetwork{
+				"eth0": {
+					Addresses: []api.InstanceStateNetworkAddress{
+						{
+							Address: "10.10.0.10",
+							Scope:   "global",
+							Family:  "inet",
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestParseProviderID(t *testing.T) {
+	endpoint, name := parseProviderID("alpha/runner-1")
+	assert.Equal(t, "alpha", endpoint)
+	assert.Equal(t, "runner-1", name)
+
+	endpoint, name = parseProviderID("runner-1")
+	assert.Equal(t, "", endpoint)
+	assert.Equal(t, "runner-1", name)
+
+	instance := withEndpoint("alpha", commonParams.ProviderInstance{Name: "runner-1", ProviderID: "runner-1"})
+	assert.Equal(t, "alpha/runner-1", instance.ProviderID)
+	assert.Equal(t, "", withEndpoint("alpha", commonParams.ProviderInstance{}).ProviderID)
+}
+
+func TestEndpointsListInstancesPartialFailure(t *testing.T) {
+	ctx := context.Background()
+	alpha := new(MockLXDServer)
+	beta := new(MockLXDServer)
+	e := newTestEndpoints(config.PlacementRoundRobin, map[string]*MockLXDServer{
+		"alpha": alpha,
+		"beta":  beta,
+	})
+
+	listArgs := lxd.GetInstancesFullArgs{InstanceType: api.InstanceTypeAny}
+	alpha.On("GetInstancesFull", listArgs).Return([]api.InstanceFull{testRunner("runner-1", time.Now())}, nil)
+	beta.On("GetInstancesFull", listArgs).Return([]api.InstanceFull(nil), fmt.Errorf("connection refused"))
+
+	instances, err := e.ListInstances(ctx, "pool")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "endpoint beta")
+	assert.Contains(t, err.Error(), "connection refused")
+	require.Len(t, instances, 1)
+	assert.Equal(t, "alpha/runner-1", instances[0].ProviderID)
+}
+
+func TestEndpointsCreateInstanceFailover(t *testing.T) {
+	ctx := context.Background()
+	alpha := new(MockLXDServer)
+	beta := new(MockLXDServer)
+	e := newTestEndpoints(config.PlacementLeastInstances, map[string]*MockLXDServer{
+		"alpha": alpha,
+		"beta":  beta,
+	})
+
+	DefaultToolFetch = func(_ commonParams.OSType, _ commonParams.OSArch, tools []commonParams.RunnerApplicationDownload) (commonParams.RunnerApplicationDownload, error) {
+		return tools[0], nil
+	}
+	DefaultGetCloudconfig = func(_ commonParams.BootstrapInstance, _ commonParams.RunnerApplicationDownload, _ string) (string, error) {
+		return "#cloud-config", nil
+	}
+
+	listArgs := lxd.GetInstancesFullArgs{InstanceType: api.InstanceTypeAny}
+	// alpha has fewer instances, so it's tried first, but it's missing the flavor.
+	alpha.On("GetInstancesFull", listArgs).Return([]api.InstanceFull{}, nil)
+	alpha.On("GetProfileNames").Return([]string{"default"}, nil)
+	beta.On("GetInstancesFull", listArgs).Return([]api.InstanceFull{testRunner("runner-1", time.Now())}, nil)
+	beta.On("GetProfileNames").Return([]string{"default", "container"}, nil)
+
+	aliases := map[string]*api.ImageAliasesEntry{
+		"x86_64": {
+			Name: "ubuntu",
+			Type: "container",
+		},
+	}
+	beta.On("GetImageAliasArchitectures", config.LXDImageContainer.String(), "ubuntu").Return(aliases, nil)
+	beta.On("GetImage", aliases["x86_64"].Target).Return(&api.Image{Fingerprint: "123abc"}, "", nil)
+	beta.On("GetServer").Return(&api.Server{
+		ServerUntrusted: api.ServerUntrusted{APIExtensions: []string{cloudInitConfigExtension}},
+		Environment:     api.ServerEnvironment{Architectures: []string{"x86_64", "i686"}},
+	}, "", nil)
+	mockOp := new(MockOperation)
+	mockOp.On("Wait").Return(nil)
+	beta.On("CreateInstance", mock.Anything).Return(mockOp, nil)
+	beta.On("UpdateInstanceState", "runner-2", "", api.InstanceStatePut{
+		Action:  "start",
+		Timeout: -1,
+	}).Return(mockOp, nil)
+	beta.On("GetEvents").Return((*lxd.EventListener)(nil), fmt.Errorf("events not available"))
+	beta.On("IsClustered").Return(false)
+	runner := testRunner("runner-2", time.Now())
+	beta.On("GetInstanceFull", "runner-2").Return(&runner, "", nil)
+	beta.On("GetInstance", "runner-2").Return(&api.Instance{Name: "runner-2"}, "", nil)
+
+	instance, err := e.CreateInstance(ctx, commonParams.BootstrapInstance{
+		Name:   "runner-2",
+		Image:  "ubuntu",
+		Flavor: "container",
+		OSArch: commonParams.Amd64,
+		OSType: commonParams.Linux,
+		Tools: []commonParams.RunnerApplicationDownload{
+			{
+				OS:           ptr("linux"),
+				Architecture: ptr("x64"),
+				DownloadURL:  ptr("https://example.com"),
+				Filename:     ptr("test-app"),
+			},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "beta/runner-2", instance.ProviderID)
+	alpha.AssertNotCalled(t, "CreateInstance", mock.Anything)
+}
+
+func TestEndpointsCreateInstanceAllFull(t *testing.T) {
+	ctx := context.Background()
+	alpha := new(MockLXDServer)
+	e := newTestEndpoints(config.PlacementRoundRobin, map[string]*MockLXDServer{
+		"alpha": alpha,
+	})
+	e.cfg.Endpoints["alpha"] = config.LXDEndpoint{MaxInstances: 1}
+
+	alpha.On("GetInstancesFull", lxd.GetInstancesFullArgs{InstanceType: api.InstanceTypeAny}).Return([]api.InstanceFull{testRunner("runner-1", time.Now())}, nil)
+
+	_, err := e.CreateInstance(ctx, commonParams.BootstrapInstance{Name: "runner-2"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "all endpoints reached their maximum number of instances")
+}
+
+func TestEndpointsRouting(t *testing.T) {
+	ctx := context.Background()
+	alpha := new(MockLXDServer)
+	beta := new(MockLXDServer)
+	e := newTestEndpoints(config.PlacementRoundRobin, map[string]*MockLXDServer{
+		"alpha": alpha,
+		"beta":  beta,
+	})
+
+	notFound := api.StatusErrorf(http.StatusNotFound, "Instance not found")
+	runner := testRunner("runner-1", time.Now())
+	alpha.On("GetInstanceFull", "runner-1").Return((*api.InstanceFull)(nil), "", notFound)
+	beta.On("GetInstanceFull", "runner-1").Return(&runner, "", nil)
+
+	// Plain instance names are looked up on all endpoints.
+	instance, err := e.GetInstance(ctx, "runner-1")
+	require.NoError(t, err)
+	assert.Equal(t, "beta/runner-1", instance.ProviderID)
+
+	// ProviderIDs go straight to the endpoint.
+	instance, err = e.GetInstance(ctx, "beta/runner-1")
+	require.NoError(t, err)
+	assert.Equal(t, "beta/runner-1", instance.ProviderID)
+
+	_, err = e.GetInstance(ctx, "gamma/runner-1")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown endpoint gamma")
+
+	mockOp := new(MockOperation)
+	mockOp.On("WaitContext", mock.Anything).Return(nil)
+	beta.On("UpdateInstanceState", "runner-1", "", api.InstanceStatePut{
+		Action:  "stop",
+		Timeout: -1,
+		Force:   true,
+	}).Return(mockOp, nil)
+	beta.On("DeleteInstance", "runner-1", false).Return(mockOp, nil)
+	beta.On("GetInstance", "runner-1").Return(&api.Instance{Name: "runner-1"}, "", nil)
+
+	require.NoError(t, e.DeleteInstance(ctx, "beta/runner-1"))
+	beta.AssertCalled(t, "DeleteInstance", "runner-1", false)
+	alpha.AssertNotCalled(t, "DeleteInstance", mock.Anything, mock.Anything)
+
+	// The instance may still exist on an endpoint that was removed from the config,
+	// so it must not be reported as deleted.
+	err = e.DeleteInstance(ctx, "gamma/runner-1")
+	require.Error(t, err)
+	assert.ErrorIs(t, err, runnerErrors.ErrBadRequest)
+	assert.Contains(t, err.Error(), "unknown endpoint gamma")
+}
@@ -0,0 +1,115 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+// Copyright 2023 Cloudbase Solutions SRL
+//
+// Licensed under the AGPLv3, see LICENCE file for details
+
+package provider
+
+import (
+	"encoding/json"
+	"net/url"
+	"path"
+
+	lxd "github.com/canonical/lxd/client"
+	"github.com/canonical/lxd/shared/api"
+	"github.com/pkg/errors"
+)
+
+// EventListenerInterface is the subset of the lxd.EventListener we use to watch
+// instances.
+type EventListenerInterface interface {
+	AddHandler(types []string, function func(api.Event)) (*lxd.EventTarget, error)
+	RemoveHandler(target *lxd.EventTarget) error
+	Disconnect()
+}
+
+type GetEventListenerFunc func(cli InstanceServerInterface) (EventListenerInterface, error)
+
+// DefaultGetEventListener connects to the events websocket of the LXD server.
+var DefaultGetEventListener GetEventListenerFunc = func(cli InstanceServerInterface) (EventListenerInterface, error) {
+	listener, err := cli.GetEvents()
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching event listener")
+	}
+	return listener, nil
+}
+
+// isInstanceLifecycleEvent returns true if the event is a lifecycle event that
+// references the instance with the given name.
+func isInstanceLifecycleEvent(event api.Event, instanceName string) bool {
+	if event.Type != api.EventTypeLifecycle {
+		return false
+	}
+
+	var lifecycle api.EventLifecycle
+	if err := json.Unmarshal(event.Metadata, &lifecycle); err != nil {
+		return false
+	}
+
+	if lifecycle.Source == "" {
+		return lifecycle.Name == instanceName
+	}
+	return isInstanceURL(lifecycle.Source, instanceName)
+}
+
+// isInstanceOperationEvent returns true if the event is an operation event for an
+// operation on the instance with the given name, such as starting it, or running a
+// command in it. Operation events are sent whenever the status of the operation changes.
+func isInstanceOperationEvent(event api.Event, instanceName string) bool {
+	if event.Type != api.EventTypeOperation {
+		return false
+	}
+
+	var operation api.Operation
+	if err := json.Unmarshal(event.Metadata, &operation); err != nil {
+		return false
+	}
+
+	for _, resource := range operation.Resources["instances"] {
+		if isInstanceURL(resource, instanceName) {
+			return true
+		}
+	}
+	return false
+}
+
+// isInstanceURL returns true if the URL references the instance with the given name.
+// Instances outside the default project have the project in the query string.
+// Eg: /1.0/instances/my-instance?project=garm
+func isInstanceURL(rawURL string, instanceName string) bool {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	return path.Dir(parsed.Path) == "/1.0/instances" && path.Base(parsed.Path) == instanceName
+}
+
+// watchInstance subscribes to the lifecycle and operation events of an instance. The
+// returned channel receives a value whenever the instance changes state, its config
+// or devices are updated, the LXD agent of a virtual machine comes online, or an
+// operation on the instance progresses. The returned function must be called to stop
+// watching.
+func watchInstance(cli InstanceServerInterface, instanceName string) (<-chan struct{}, func(), error) {
+	listener, err := DefaultGetEventListener(cli)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	changed := make(chan struct{}, 1)
+	_, err = listener.AddHandler([]string{api.EventTypeLifecycle, api.EventTypeOperation}, func(event api.Event) {
+		if !isInstanceLifecycleEvent(event, instanceName) && !isInstanceOperationEvent(event, instanceName) {
+			return
+		}
+		// We only care that something changed, not how many times.
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil {
+		listener.Disconnect()
+		return nil, nil, errors.Wrap(err, "adding event handler")
+	}
+
+	return changed, listener.Disconnect, nil
+}
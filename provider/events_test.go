@@ -0,0 +1,213 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+// Copyright 2023 Cloudbase Solutions SRL
+//
+// Licensed under the AGPLv3, see LICENCE file for details
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	lxd "github.com/canonical/lxd/client"
+	"github.com/canonical/lxd/shared/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func lifecycleEvent(t *testing.T, lifecycle api.EventLifecycle) api.Event {
+	metadata, err := json.Marshal(lifecycle)
+	require.NoError(t, err)
+	return api.Event{
+		Type:     api.EventTypeLifecycle,
+		Metadata: metadata,
+	}
+}
+
+func operationEvent(t *testing.T, instances ...string) api.Event {
+	metadata, err := json.Marshal(api.Operation{
+		Status:    api.Success.String(),
+		Resources: map[string][]string{"instances": instances},
+	})
+	require.NoError(t, err)
+	return api.Event{
+		Type:     api.EventTypeOperation,
+		Metadata: metadata,
+	}
+}
+
+func TestIsInstanceOperationEvent(t *testing.T) {
+	tests := []struct {
+		name  string
+		event api.Event
+		want  bool
+	}{
+		{
+			name:  "matching instance",
+			event: operationEvent(t, "/1.0/instances/test-instance"),
+			want:  true,
+		},
+		{
+			name:  "matching instance in another project",
+			event: operationEvent(t, "/1.0/instances/test-instance?project=garm"),
+			want:  true,
+		},
+		{
+			name:  "other instance",
+			event: operationEvent(t, "/1.0/instances/other-instance"),
+			want:  false,
+		},
+		{
+			name:  "no instances",
+			event: operationEvent(t),
+			want:  false,
+		},
+		{
+			name:  "not an operation event",
+			event: lifecycleEvent(t, api.EventLifecycle{Name: "test-instance"}),
+			want:  false,
+		},
+		{
+			name: "invalid metadata",
+			event: api.Event{
+				Type:     api.EventTypeOperation,
+				Metadata: json.RawMessage(`bogus`),
+			},
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, isInstanceOperationEvent(tt.event, "test-instance"))
+		})
+	}
+}
+
+func TestIsInstanceLifecycleEvent(t *testing.T) {
+	tests := []struct {
+		name  string
+		event api.Event
+		want  bool
+	}{
+		{
+			name: "matching name",
+			event: lifecycleEvent(t, api.EventLifecycle{
+				Action: api.EventLifecycleInstanceStarted,
+				Source: "/1.0/instances/test-instance",
+				Name:   "test-instance",
+			}),
+			want: true,
+		},
+		{
+			name: "matching source without name",
+			event: lifecycleEvent(t, api.EventLifecycle{
+				Action: api.EventLifecycleInstanceReady,
+				Source: "/1.0/instances/test-instance",
+			}),
+			want: true,
+		},
+		{
+			name: "matching source in another project",
+			event: lifecycleEvent(t, api.EventLifecycle{
+				Action:  api.EventLifecycleInstanceStarted,
+				Source:  "/1.0/instances/test-instance?project=garm",
+				Project: "garm",
+			}),
+			want: true,
+		},
+		{
+			name: "other instance in another project",
+			event: lifecycleEvent(t, api.EventLifecycle{
+				Action:  api.EventLifecycleInstanceStarted,
+				Source:  "/1.0/instances/other-instance?project=garm",
+				Project: "garm",
+			}),
+			want: false,
+		},
+		{
+			name: "other instance",
+			event: lifecycleEvent(t, api.EventLifecycle{
+				Action: api.EventLifecycleInstanceStarted,
+				Source: "/1.0/instances/other-instance",
+				Name:   "other-instance",
+			}),
+			want: false,
+		},
+		{
+			name: "other entity with the same name",
+			event: lifecycleEvent(t, api.EventLifecycle{
+				Action: "profile-created",
+				Source: "/1.0/profiles/test-instance",
+				Name:   "test-instance",
+			}),
+			want: false,
+		},
+		{
+			name: "not a lifecycle event",
+			event: api.Event{
+				Type:     api.EventTypeOperation,
+				Metadata: json.RawMessage(`{}`),
+			},
+			want: false,
+		},
+		{
+			name: "invalid metadata",
+			event: api.Event{
+				Type:     api.EventTypeLifecycle,
+				Metadata: json.RawMessage(`bogus`),
+			},
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, isInstanceLifecycleEvent(tt.event, "test-instance"))
+		})
+	}
+}
+
+func TestWatchInstance(t *testing.T) {
+	listener := new(MockEventListener)
+	listener.On("AddHandler", []string{api.EventTypeLifecycle, api.EventTypeOperation}, mock.Anything).Return(&lxd.EventTarget{}, nil)
+	listener.On("Disconnect").Return()
+	getEventListener := DefaultGetEventListener
+	t.Cleanup(func() {
+		DefaultGetEventListener = getEventListener
+	})
+	DefaultGetEventListener = func(_ InstanceServerInterface) (EventListenerInterface, error) {
+		return listener, nil
+	}
+
+	changed, stop, err := watchInstance(new(MockLXDServer), "test-instance")
+	require.NoError(t, err)
+
+	listener.SendEvent(lifecycleEvent(t, api.EventLifecycle{Name: "other-instance"}))
+	assert.Len(t, changed, 0)
+
+	listener.SendEvent(lifecycleEvent(t, api.EventLifecycle{Name: "test-instance"}))
+	listener.SendEvent(lifecycleEvent(t, api.EventLifecycle{Name: "test-instance"}))
+	assert.Len(t, changed, 1)
+	<-changed
+
+	listener.SendEvent(operationEvent(t, "/1.0/instances/other-instance"))
+	assert.Len(t, changed, 0)
+
+	listener.SendEvent(operationEvent(t, "/1.0/instances/test-instance?project=garm"))
+	assert.Len(t, changed, 1)
+
+	stop()
+	listener.AssertCalled(t, "Disconnect")
+}
+
+func TestWatchInstanceNoEvents(t *testing.T) {
+	cli := new(MockLXDServer)
+	cli.On("GetEvents").Return((*lxd.EventListener)(nil), fmt.Errorf("not supported"))
+
+	_, _, err := watchInstance(cli, "test-instance")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "fetching event listener: not supported")
+}
@@ -0,0 +1,139 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+// Copyright 2023 Cloudbase Solutions SRL
+//
+// Licensed under the AGPLv3, see LICENCE file for details
+
+package provider
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	lxd "github.com/canonical/lxd/client"
+	commonParams "github.com/cloudbase/garm-provider-common/params"
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxProviderFaultSize is the maximum size of the diagnostics we send back to
+	// garm in the ProviderFault field of an instance.
+	maxProviderFaultSize = 16 * 1024
+	// maxLogTailSize is the maximum number of bytes we keep from the end of each
+	// log we collect from an instance.
+	maxLogTailSize = 6 * 1024
+
+	cloudInitOutputLog = "/var/log/cloud-init-output.log"
+)
+
+// providerFaultError is returned when an instance failed after it was created in LXD.
+// It holds the diagnostics we managed to gather before the instance was removed.
+type providerFaultError struct {
+	err   error
+	fault []byte
+}
+
+// Error returns the cause of the failure, followed by the diagnostics. GARM discards the
+// instance returned by CreateInstance when there is an error, and the instance is gone by
+// then, so the error is the only way the diagnostics reach GARM.
+func (p *providerFaultError) Error() string {
+	if len(p.fault) == 0 {
+		return p.err.Error()
+	}
+	return fmt.Sprintf("%s\n%s", p.err, p.fault)
+}
+
+func (p *providerFaultError) Unwrap() error {
+	return p.err
+}
+
+// instanceFromFault returns a ProviderInstance holding the diagnostics attached to
+// err. If err does not carry any diagnostics, an empty instance is returned.
+func instanceFromFault(instanceName string, err error) commonParams.ProviderInstance {
+	var faultErr *providerFaultError
+	if !errors.As(err, &faultErr) {
+		return commonParams.ProviderInstance{}
+	}
+	return commonParams.ProviderInstance{
+		ProviderID:    instanceName,
+		Name:          instanceName,
+		Status:        commonParams.InstanceError,
+		ProviderFault: faultErr.fault,
+	}
+}
+
+// readTail reads r until EOF and returns at most the last size bytes.
+func readTail(r io.Reader, size int) ([]byte, error) {
+	tail := make([]byte, 0, size)
+	chunk := make([]byte, 4096)
+	for {
+		n, err := r.Read(chunk)
+		tail = append(tail, chunk[:n]...)
+		if len(tail) > size {
+			tail = append(tail[:0], tail[len(tail)-size:]...)
+		}
+		if err != nil {
+			if err == io.EOF {
+				return tail, nil
+			}
+			return tail, err
+		}
+	}
+}
+
+// getProviderFault collects diagnostics about a failed instance. We record the error
+// that caused the failure, the tail of the instance console log and the tail of the
+// cloud-init output log. Every source is best effort. If we fail to fetch one of them,
+// the reason is recorded in the fault instead. The result is capped to
+// maxProviderFaultSize.
+func (l *LXD) getProviderFault(ctx context.Context, instanceName string, cause error) []byte {
+	var fault bytes.Buffer
+	if cause != nil {
+		fmt.Fprintf(&fault, "error: %s\n", cause)
+	}
+
+	cli, err := l.getInstanceCLI(ctx, instanceName)
+	if err != nil {
+		fmt.Fprintf(&fault, "failed to fetch client: %s\n", err)
+		return capFault(fault.Bytes())
+	}
+
+	fault.WriteString("\n--- console log ---\n")
+	consoleLog, err := cli.GetInstanceConsoleLog(instanceName, &lxd.InstanceConsoleLogArgs{})
+	if err != nil {
+		fmt.Fprintf(&fault, "failed to fetch console log: %s\n", err)
+	} else {
+		writeLogTail(&fault, consoleLog)
+	}
+
+	fmt.Fprintf(&fault, "\n--- %s ---\n", cloudInitOutputLog)
+	cloudInitLog, _, err := cli.GetInstanceFile(instanceName, cloudInitOutputLog)
+	if err != nil {
+		fmt.Fprintf(&fault, "failed to fetch %s: %s\n", cloudInitOutputLog, err)
+	} else {
+		writeLogTail(&fault, cloudInitLog)
+	}
+
+	return capFault(fault.Bytes())
+}
+
+func writeLogTail(w *bytes.Buffer, log io.ReadCloser) {
+	defer log.Close()
+
+	tail, err := readTail(log, maxLogTailSize)
+	w.Write(tail)
+	if err != nil {
+		fmt.Fprintf(w, "\nfailed to read log: %s\n", err)
+	}
+}
+
+func capFault(fault []byte) []byte {
+	if len(fault) <= maxProviderFaultSize {
+		return fault
+	}
+	marker := []byte("\n[truncated]")
+	capped := make([]byte, 0, maxProviderFaultSize)
+	capped = append(capped, fault[:maxProviderFaultSize-len(marker)]...)
+	return append(capped, marker...)
+}
@@ -0,0 +1,107 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+// Copyright 2023 Cloudbase Solutions SRL
+//
+// Licensed under the AGPLv3, see LICENCE file for details
+
+package provider
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	lxd "github.com/canonical/lxd/client"
+	commonParams "github.com/cloudbase/garm-provider-common/params"
+	"github.com/cloudbase/garm-provider-lxd/config"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadTail(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		size     int
+		expected string
+	}{
+		{
+			name:     "shorter than size",
+			input:    "hello",
+			size:     10,
+			expected: "hello",
+		},
+		{
+			name:     "longer than size",
+			input:    "hello world",
+			size:     5,
+			expected: "world",
+		},
+		{
+			name:     "longer than read chunk",
+			input:    strings.Repeat("a", 5000) + "end",
+			size:     3,
+			expected: "end",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readTail(strings.NewReader(tt.input), tt.size)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, string(got))
+		})
+	}
+}
+
+func TestCapFault(t *testing.T) {
+	small := []byte("small fault")
+	assert.Equal(t, small, capFault(small))
+
+	large := bytes.Repeat([]byte("a"), maxProviderFaultSize+100)
+	capped := capFault(large)
+	assert.Len(t, capped, maxProviderFaultSize)
+	assert.True(t, bytes.HasSuffix(capped, []byte("[truncated]")))
+}
+
+func TestGetProviderFault(t *testing.T) {
+	ctx := context.Background()
+	cli := new(MockLXDServer)
+	l := &LXD{
+		cfg:          &config.LXD{},
+		cli:          cli,
+		imageManager: &image{},
+		controllerID: "controller",
+	}
+	consoleLog := strings.Repeat("x", maxLogTailSize) + "last console line"
+	cli.On("GetInstanceConsoleLog", "test-instance", mock.Anything).Return(io.NopCloser(strings.NewReader(consoleLog)), nil)
+	cli.On("GetInstanceFile", "test-instance", cloudInitOutputLog).Return(io.NopCloser(strings.NewReader("")), (*lxd.InstanceFileResponse)(nil), fmt.Errorf("file not found"))
+
+	fault := string(l.getProviderFault(ctx, "test-instance", fmt.Errorf("operation failed")))
+	assert.True(t, strings.HasPrefix(fault, "error: operation failed\n"))
+	assert.Contains(t, fault, "last console line")
+	assert.NotContains(t, fault, strings.Repeat("x", maxLogTailSize))
+	assert.Contains(t, fault, "failed to fetch /var/log/cloud-init-output.log: file not found")
+	assert.LessOrEqual(t, len(fault), maxProviderFaultSize)
+}
+
+func TestInstanceFromFault(t *testing.T) {
+	err := errors.Wrap(&providerFaultError{
+		err:   fmt.Errorf("boom"),
+		fault: []byte("diagnostics"),
+	}, "creating instance")
+
+	instance := instanceFromFault("test-instance", err)
+	assert.Equal(t, commonParams.ProviderInstance{
+		ProviderID:    "test-instance",
+		Name:          "test-instance",
+		Status:        commonParams.InstanceError,
+		ProviderFault: []byte("diagnostics"),
+	}, instance)
+
+	assert.Equal(t, commonParams.ProviderInstance{}, instanceFromFault("test-instance", fmt.Errorf("boom")))
+}
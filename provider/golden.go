@@ -0,0 +1,93 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+// Copyright 2023 Cloudbase Solutions SRL
+//
+// Licensed under the AGPLv3, see LICENCE file for details
+
+package provider
+
+import (
+	"strings"
+
+	"github.com/canonical/lxd/shared/api"
+	runnerErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/cloudbase/garm-provider-lxd/config"
+	"github.com/pkg/errors"
+)
+
+// isCopySource returns true if the image of a pool is a golden instance its runners
+// are cloned from. Pools clone a golden instance with instance:<name>, or one of its
+// snapshots with snapshot:<name>/<snapshot>.
+func isCopySource(imageName string) bool {
+	prefix, _, found := strings.Cut(imageName, ":")
+	return found && (prefix == config.CopyInstancePrefix || prefix == config.CopySnapshotPrefix)
+}
+
+// getGoldenSource checks that the golden instance or snapshot exists in the project,
+// and that runners of the given type can be cloned from it. It returns the copy source
+// and the architecture of the golden instance.
+func getGoldenSource(cli InstanceServerInterface, imageName string, imageType config.LXDImageType) (string, string, error) {
+	prefix, source, _ := strings.Cut(imageName, ":")
+
+	instanceName, snapshotName := source, ""
+	if prefix == config.CopySnapshotPrefix {
+		var found bool
+		instanceName, snapshotName, found = strings.Cut(source, "/")
+		if !found || instanceName == "" || snapshotName == "" {
+			return "", "", runnerErrors.NewBadRequestError("snapshot %q must be in the <instance>/<snapshot> format", source)
+		}
+	} else if instanceName == "" || strings.Contains(instanceName, "/") {
+		return "", "", runnerErrors.NewBadRequestError("invalid golden instance name %q", source)
+	}
+
+	instance, _, err := cli.GetInstance(instanceName)
+	if err != nil {
+		if isNotFoundError(err) {
+			return "", "", errors.Wrapf(runnerErrors.ErrNotFound, "golden instance %s not found in project", instanceName)
+		}
+		return "", "", errors.Wrapf(err, "fetching golden instance %s", instanceName)
+	}
+
+	if instance.Type != imageType.String() {
+		return "", "", runnerErrors.NewBadRequestError("golden instance %s is a %s, not a %s", instanceName, instance.Type, imageType)
+	}
+	// Runners inherit the config of the golden instance. If it was a runner itself,
+	// its clones would be mistaken for runners of another pool or controller.
+	if instance.Config[controllerIDKeyName] != "" {
+		return "", "", runnerErrors.NewBadRequestError("golden instance %s is managed by garm", instanceName)
+	}
+
+	if snapshotName == "" {
+		if instance.StatusCode != api.Stopped {
+			return "", "", runnerErrors.NewBadRequestError("golden instance %s must be stopped", instanceName)
+		}
+		return instanceName, instance.Architecture, nil
+	}
+
+	snapshot, _, err := cli.GetInstanceSnapshot(instanceName, snapshotName)
+	if err != nil {
+		if isNotFoundError(err) {
+			return "", "", errors.Wrapf(runnerErrors.ErrNotFound, "snapshot %s not found in project", source)
+		}
+		return "", "", errors.Wrapf(err, "fetching snapshot %s", source)
+	}
+	return source, snapshot.Architecture, nil
+}
+
+// getCopySource returns an instance source that clones the golden instance or snapshot.
+// LXD copies instances within a storage pool using copy-on-write, where the storage
+// driver supports it.
+func getCopySource(cli InstanceServerInterface, imageName string, imageType config.LXDImageType, arch string) (api.InstanceSource, error) {
+	source, sourceArch, err := getGoldenSource(cli, imageName, imageType)
+	if err != nil {
+		return api.InstanceSource{}, err
+	}
+	if sourceArch != arch {
+		return api.InstanceSource{}, runnerErrors.NewBadRequestError("golden instance %s is %s, not %s", source, sourceArch, arch)
+	}
+
+	return api.InstanceSource{
+		Type:         api.SourceTypeCopy,
+		Source:       source,
+		InstanceOnly: true,
+	}, nil
+}
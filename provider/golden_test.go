@@ -0,0 +1,144 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+// Copyright 2023 Cloudbase Solutions SRL
+//
+// Licensed under the AGPLv3, see LICENCE file for details
+
+package provider
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/canonical/lxd/shared/api"
+	runnerErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/cloudbase/garm-provider-lxd/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsCopySource(t *testing.T) {
+	assert.True(t, isCopySource("instance:golden-runner"))
+	assert.True(t, isCopySource("snapshot:golden-runner/ready"))
+	assert.False(t, isCopySource("ubuntu:24.04"))
+	assert.False(t, isCopySource("golden-runner"))
+}
+
+func TestGetCopySource(t *testing.T) {
+	golden := &api.Instance{
+		Name:         "golden-runner",
+		Type:         "container",
+		Architecture: "x86_64",
+		StatusCode:   api.Stopped,
+	}
+	running := &api.Instance{
+		Name:         "golden-running",
+		Type:         "container",
+		Architecture: "x86_64",
+		StatusCode:   api.Running,
+	}
+	runner := &api.Instance{
+		Name:         "garm-runner",
+		Type:         "container",
+		Architecture: "x86_64",
+		StatusCode:   api.Stopped,
+		Config:       map[string]string{controllerIDKeyName: "controller"},
+	}
+	notFound := api.StatusErrorf(http.StatusNotFound, "Instance not found")
+
+	cli := new(MockLXDServer)
+	cli.On("GetInstance", "golden-runner").Return(golden, "", nil)
+	cli.On("GetInstance", "golden-running").Return(running, "", nil)
+	cli.On("GetInstance", "garm-runner").Return(runner, "", nil)
+	cli.On("GetInstance", "missing").Return((*api.Instance)(nil), "", notFound)
+	cli.On("GetInstanceSnapshot", "golden-running", "ready").Return(&api.InstanceSnapshot{Name: "ready", Architecture: "x86_64"}, "", nil)
+	cli.On("GetInstanceSnapshot", "golden-running", "missing").Return((*api.InstanceSnapshot)(nil), "", notFound)
+
+	tests := []struct {
+		name      string
+		image     string
+		imageType config.LXDImageType
+		arch      string
+		expected  api.InstanceSource
+		errString string
+		errIs     error
+	}{
+		{
+			name:      "stopped instance",
+			image:     "instance:golden-runner",
+			imageType: config.LXDImageContainer,
+			arch:      "x86_64",
+			expected:  api.InstanceSource{Type: api.SourceTypeCopy, Source: "golden-runner", InstanceOnly: true},
+		},
+		{
+			name:      "snapshot of a running instance",
+			image:     "snapshot:golden-running/ready",
+			imageType: config.LXDImageContainer,
+			arch:      "x86_64",
+			expected:  api.InstanceSource{Type: api.SourceTypeCopy, Source: "golden-running/ready", InstanceOnly: true},
+		},
+		{
+			name:      "running instance",
+			image:     "instance:golden-running",
+			imageType: config.LXDImageContainer,
+			arch:      "x86_64",
+			errString: "golden instance golden-running must be stopped",
+		},
+		{
+			name:      "missing instance",
+			image:     "instance:missing",
+			imageType: config.LXDImageContainer,
+			arch:      "x86_64",
+			errIs:     runnerErrors.ErrNotFound,
+		},
+		{
+			name:      "missing snapshot",
+			image:     "snapshot:golden-running/missing",
+			imageType: config.LXDImageContainer,
+			arch:      "x86_64",
+			errIs:     runnerErrors.ErrNotFound,
+		},
+		{
+			name:      "snapshot without a name",
+			image:     "snapshot:golden-running",
+			imageType: config.LXDImageContainer,
+			arch:      "x86_64",
+			errString: `snapshot "golden-running" must be in the <instance>/<snapshot> format`,
+		},
+		{
+			name:      "wrong instance type",
+			image:     "instance:golden-runner",
+			imageType: config.LXDImageVirtualMachine,
+			arch:      "x86_64",
+			errString: "golden instance golden-runner is a container, not a virtual-machine",
+		},
+		{
+			name:      "wrong architecture",
+			image:     "instance:golden-runner",
+			imageType: config.LXDImageContainer,
+			arch:      "aarch64",
+			errString: "golden instance golden-runner is x86_64, not aarch64",
+		},
+		{
+			name:      "runner managed by garm",
+			image:     "instance:garm-runner",
+			imageType: config.LXDImageContainer,
+			arch:      "x86_64",
+			errString: "golden instance garm-runner is managed by garm",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source, err := getCopySource(cli, tt.image, tt.imageType, tt.arch)
+			switch {
+			case tt.errIs != nil:
+				require.ErrorIs(t, err, tt.errIs)
+			case tt.errString != "":
+				require.EqualError(t, err, tt.errString)
+			default:
+				require.NoError(t, err)
+				assert.Equal(t, tt.expected, source)
+			}
+		})
+	}
+}
@@ -0,0 +1,237 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+// Copyright 2023 Cloudbase Solutions SRL
+//
+// Licensed under the AGPLv3, see LICENCE file for details
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/canonical/lxd/shared/api"
+	commonParams "github.com/cloudbase/garm-provider-common/params"
+	"github.com/cloudbase/garm-provider-lxd/config"
+	"github.com/pkg/errors"
+)
+
+// cachedImageAliasPrefix is the prefix of the local aliases of cached images.
+const cachedImageAliasPrefix = "garm-cache"
+
+// cachedImageAlias returns the local alias of a cached remote image. Local aliases
+// point to a single image, so the alias includes the image type and architecture.
+func cachedImageAlias(remoteName, alias string, imageType config.LXDImageType, arch string) string {
+	return fmt.Sprintf("%s/%s/%s/%s/%s", cachedImageAliasPrefix, remoteName, alias, imageType, arch)
+}
+
+// getCachedImage returns the cached image with the given local alias, or nil if the
+// image is not cached.
+func (i *image) getCachedImage(cli InstanceServerInterface, cacheAlias string, imageType config.LXDImageType, arch string) (*api.Image, error) {
+	aliases, err := cli.GetImageAliasArchitectures(imageType.String(), cacheAlias)
+	if err != nil {
+		if isNotFoundError(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "resolving alias: %s", cacheAlias)
+	}
+
+	alias, ok := aliases[arch]
+	if !ok {
+		return nil, nil
+	}
+
+	cached, _, err := cli.GetImage(alias.Target)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching image details")
+	}
+	return cached, nil
+}
+
+// cacheImage copies a remote image into the local image store, under the given local
+// alias. The image is marked for auto update, so LXD keeps it in sync with the remote
+// alias.
+func (i *image) cacheImage(cli InstanceServerInterface, cacheAlias string, remote config.LXDImageRemote, alias string, imageType config.LXDImageType, arch string) (*api.Image, error) {
+	if remote.Protocol == config.OCIProtocol {
+		return nil, fmt.Errorf("images from %s remotes can not be cached", config.OCIProtocol)
+	}
+
+	imageDetails, secret, err := i.resolveRemoteImage(remote, alias, "", imageType, arch)
+	if err != nil {
+		return nil, errors.Wrap(err, "resolving remote image")
+	}
+
+	certificate, err := remoteCertificate(remote)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting certificate of remote")
+	}
+
+	op, err := cli.CreateImage(api.ImagesPost{
+		ImagePut: api.ImagePut{
+			AutoUpdate: true,
+		},
+		Source: &api.ImagesPostSource{
+			ImageSource: api.ImageSource{
+				Alias:       alias,
+				Certificate: certificate,
+				Protocol:    string(remote.Protocol),
+				Server:      remote.Address,
+				ImageType:   imageType.String(),
+			},
+			Type:        api.SourceTypeImage,
+			Mode:        "pull",
+			Fingerprint: imageDetails.Fingerprint,
+			Secret:      secret,
+		},
+		Aliases: []api.ImageAlias{
+			{
+				Name: cacheAlias,
+			},
+		},
+	}, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "copying image")
+	}
+	if err := op.Wait(); err != nil {
+		return nil, errors.Wrap(err, "waiting for image to be copied")
+	}
+	return imageDetails, nil
+}
+
+// getOrCacheImage returns the cached copy of a remote image. If the image is not cached
+// and automatic caching is enabled, it is cached first. Any failure is logged and
+// returns nil, and the image is then used straight from the remote.
+func (i *image) getOrCacheImage(cli InstanceServerInterface, remoteName string, remote config.LXDImageRemote, alias string, imageType config.LXDImageType, arch string) *api.Image {
+	cacheAlias := cachedImageAlias(remoteName, alias, imageType, arch)
+	cached, err := i.getCachedImage(cli, cacheAlias, imageType, arch)
+	if err != nil {
+		slog.Warn("failed to look up cached image, using the remote image", "alias", cacheAlias, "error", err)
+		return nil
+	}
+
+	if cached == nil && i.cache.Auto {
+		cached, err = i.cacheImage(cli, cacheAlias, remote, alias, imageType, arch)
+		if err != nil {
+			slog.Warn("failed to cache image, using the remote image", "alias", cacheAlias, "error", err)
+			return nil
+		}
+	}
+	return cached
+}
+
+// prefetchImage caches a remote image, or refreshes the cached copy if it is older than
+// the refresh interval. It returns a short description of what was done.
+func (i *image) prefetchImage(cli InstanceServerInterface, imageName string, imageType config.LXDImageType, arch string) (string, error) {
+	remote, alias, err := i.parseImageName(imageName)
+	if err != nil {
+		return "", errors.Wrapf(err, "parsing image name: %s", imageName)
+	}
+	remoteName, _, _ := strings.Cut(imageName, ":")
+	cacheAlias := cachedImageAlias(remoteName, alias, imageType, arch)
+
+	cached, err := i.getCachedImage(cli, cacheAlias, imageType, arch)
+	if err != nil {
+		return "", errors.Wrap(err, "looking up cached image")
+	}
+
+	if cached == nil {
+		cached, err = i.cacheImage(cli, cacheAlias, remote, alias, imageType, arch)
+		if err != nil {
+			return "", errors.Wrap(err, "caching image")
+		}
+		return fmt.Sprintf("cached %s", shortFingerprint(cached.Fingerprint)), nil
+	}
+
+	if time.Since(cached.UploadedAt) < i.cache.GetRefreshInterval() {
+		return fmt.Sprintf("up to date %s", shortFingerprint(cached.Fingerprint)), nil
+	}
+
+	op, err := cli.RefreshImage(cached.Fingerprint)
+	if err != nil {
+		return "", errors.Wrap(err, "refreshing image")
+	}
+	if err := op.Wait(); err != nil {
+		return "", errors.Wrap(err, "waiting for image to be refreshed")
+	}
+
+	refreshed, err := i.getCachedImage(cli, cacheAlias, imageType, arch)
+	if err != nil {
+		return "", errors.Wrap(err, "looking up refreshed image")
+	}
+	if refreshed == nil {
+		return "", fmt.Errorf("cached image %s disappeared after refresh", cacheAlias)
+	}
+	if refreshed.Fingerprint == cached.Fingerprint {
+		return fmt.Sprintf("up to date %s", shortFingerprint(cached.Fingerprint)), nil
+	}
+	return fmt.Sprintf("refreshed %s -> %s", shortFingerprint(cached.Fingerprint), shortFingerprint(refreshed.Fingerprint)), nil
+}
+
+// prefetchImages caches the images in the image_cache section of the config, and
+// writes a line for each image and architecture to w.
+func (l *LXD) prefetchImages(ctx context.Context, w io.Writer) error {
+	cli, err := l.getCLI(ctx)
+	if err != nil {
+		return errors.Wrap(err, "fetching client")
+	}
+
+	var nativeArch string
+	var failed bool
+	for _, cachedImage := range l.cfg.ImageCache.Images {
+		imageType := cachedImage.InstanceType
+		if imageType == "" {
+			imageType = getInstanceType(l.cfg, extraSpecs{})
+		}
+
+		archs := []string{}
+		for _, osArch := range cachedImage.Architectures {
+			arch, err := resolveArchitecture(commonParams.OSArch(osArch))
+			if err != nil {
+				return errors.Wrapf(err, "resolving architecture of %s", cachedImage.Image)
+			}
+			archs = append(archs, arch)
+		}
+		if len(archs) == 0 {
+			if nativeArch == "" {
+				server, err := l.getServer(cli)
+				if err != nil {
+					return err
+				}
+				nativeArch, err = getNativeArchitecture(server)
+				if err != nil {
+					return err
+				}
+			}
+			archs = append(archs, nativeArch)
+		}
+
+		for _, arch := range archs {
+			status, err := l.imageManager.prefetchImage(cli, cachedImage.Image, imageType, arch)
+			if err != nil {
+				failed = true
+				status = fmt.Sprintf("failed: %s", err)
+			}
+			fmt.Fprintf(w, "%s (%s, %s): %s\n", cachedImage.Image, imageType, arch, status)
+		}
+	}
+
+	if failed {
+		return fmt.Errorf("failed to prefetch some images")
+	}
+	return nil
+}
+
+// getNativeArchitecture returns the native architecture of the LXD server.
+func getNativeArchitecture(server *api.Server) (string, error) {
+	if len(server.Environment.Architectures) == 0 {
+		return "", fmt.Errorf("server did not report its architecture")
+	}
+	return server.Environment.Architectures[0], nil
+}
+
+func shortFingerprint(fingerprint string) string {
+	return fingerprint[:min(len(fingerprint), 12)]
+}
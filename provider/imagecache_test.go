@@ -0,0 +1,220 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+// Copyright 2023 Cloudbase Solutions SRL
+//
+// Licensed under the AGPLv3, see LICENCE file for details
+
+package provider
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	lxd "github.com/canonical/lxd/client"
+	"github.com/canonical/lxd/shared/api"
+	"github.com/cloudbase/garm-provider-lxd/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+const cachedUbuntuAlias = "garm-cache/ubuntu/24.04/container/x86_64"
+
+func newCachingImage(auto bool) *image {
+	return &image{
+		remotes: map[string]config.LXDImageRemote{
+			"ubuntu": {
+				Address:  "https://cloud-images.ubuntu.com/releases",
+				Protocol: config.SimpleStreams,
+			},
+		},
+		cache: config.ImageCache{
+			Auto: auto,
+			Images: []config.CachedImage{
+				{Image: "ubuntu:24.04"},
+			},
+		},
+	}
+}
+
+func mockRemoteImageServer(t *testing.T, fingerprint string) *MockLXDServer {
+	srv := new(MockLXDServer)
+	DefaultConnectImageServer = func(_ config.LXDImageRemote) (ImageServerInterface, error) {
+		return srv, nil
+	}
+	t.Cleanup(func() { DefaultConnectImageServer = connectImageServer })
+
+	aliases := map[string]*api.ImageAliasesEntry{
+		"x86_64": {Name: "24.04", Target: fingerprint},
+	}
+	srv.On("GetImageAliasArchitectures", "container", "24.04").Return(aliases, nil)
+	srv.On("GetImage", fingerprint).Return(&api.Image{Fingerprint: fingerprint, Public: true}, "", nil)
+	return srv
+}
+
+func expectedCacheImagesPost(fingerprint string) api.ImagesPost {
+	return api.ImagesPost{
+		ImagePut: api.ImagePut{AutoUpdate: true},
+		Source: &api.ImagesPostSource{
+			ImageSource: api.ImageSource{
+				Alias:     "24.04",
+				Protocol:  "simplestreams",
+				Server:    "https://cloud-images.ubuntu.com/releases",
+				ImageType: "container",
+			},
+			Type:        api.SourceTypeImage,
+			Mode:        "pull",
+			Fingerprint: fingerprint,
+		},
+		Aliases: []api.ImageAlias{{Name: cachedUbuntuAlias}},
+	}
+}
+
+func TestGetInstanceSourceCachedImage(t *testing.T) {
+	cli := new(MockLXDServer)
+	i := newCachingImage(false)
+
+	aliases := map[string]*api.ImageAliasesEntry{
+		"x86_64": {Name: cachedUbuntuAlias, Target: "cached123"},
+	}
+	cli.On("GetImageAliasArchitectures", "container", cachedUbuntuAlias).Return(aliases, nil)
+	cli.On("GetImage", "cached123").Return(&api.Image{Fingerprint: "cached123"}, "", nil)
+
+	instanceSource, err := i.getInstanceSource("ubuntu:24.04", config.LXDImageContainer, "x86_64", cli)
+	require.NoError(t, err)
+	assert.Equal(t, api.InstanceSource{Type: "image", Fingerprint: "cached123"}, instanceSource)
+}
+
+func TestGetInstanceSourceNotCached(t *testing.T) {
+	cli := new(MockLXDServer)
+	i := newCachingImage(false)
+	cli.On("GetImageAliasArchitectures", "container", cachedUbuntuAlias).Return(
+		map[string]*api.ImageAliasesEntry(nil), api.StatusErrorf(http.StatusNotFound, "not found"))
+
+	instanceSource, err := i.getInstanceSource("ubuntu:24.04", config.LXDImageContainer, "x86_64", cli)
+	require.NoError(t, err)
+	assert.Equal(t, api.InstanceSource{
+		Type:     "image",
+		Alias:    "24.04",
+		Server:   "https://cloud-images.ubuntu.com/releases",
+		Protocol: "simplestreams",
+	}, instanceSource)
+	cli.AssertNotCalled(t, "CreateImage", mock.Anything, mock.Anything)
+}
+
+func TestGetInstanceSourceAutoCache(t *testing.T) {
+	cli := new(MockLXDServer)
+	mockOp := new(MockOperation)
+	i := newCachingImage(true)
+	mockRemoteImageServer(t, "remote123")
+
+	cli.On("GetImageAliasArchitectures", "container", cachedUbuntuAlias).Return(map[string]*api.ImageAliasesEntry{}, nil)
+	cli.On("CreateImage", expectedCacheImagesPost("remote123"), (*lxd.ImageCreateArgs)(nil)).Return(mockOp, nil)
+	mockOp.On("Wait").Return(nil)
+
+	instanceSource, err := i.getInstanceSource("ubuntu:24.04", config.LXDImageContainer, "x86_64", cli)
+	require.NoError(t, err)
+	assert.Equal(t, api.InstanceSource{Type: "image", Fingerprint: "remote123"}, instanceSource)
+	cli.AssertExpectations(t)
+}
+
+func TestGetInstanceSourceAutoCacheFailure(t *testing.T) {
+	cli := new(MockLXDServer)
+	mockOp := new(MockOperation)
+	i := newCachingImage(true)
+	mockRemoteImageServer(t, "remote123")
+
+	cli.On("GetImageAliasArchitectures", "container", cachedUbuntuAlias).Return(map[string]*api.ImageAliasesEntry{}, nil)
+	cli.On("CreateImage", mock.Anything, mock.Anything).Return(mockOp, nil)
+	mockOp.On("Wait").Return(fmt.Errorf("remote unreachable"))
+
+	// Failing to cache the image does not block the runner.
+	instanceSource, err := i.getInstanceSource("ubuntu:24.04", config.LXDImageContainer, "x86_64", cli)
+	require.NoError(t, err)
+	assert.Equal(t, "24.04", instanceSource.Alias)
+	assert.Equal(t, "https://cloud-images.ubuntu.com/releases", instanceSource.Server)
+}
+
+func TestPrefetchImage(t *testing.T) {
+	t.Run("image is cached", func(t *testing.T) {
+		cli := new(MockLXDServer)
+		mockOp := new(MockOperation)
+		i := newCachingImage(false)
+		mockRemoteImageServer(t, "remote1234567890")
+
+		cli.On("GetImageAliasArchitectures", "container", cachedUbuntuAlias).Return(map[string]*api.ImageAliasesEntry{}, nil)
+		cli.On("CreateImage", expectedCacheImagesPost("remote1234567890"), (*lxd.ImageCreateArgs)(nil)).Return(mockOp, nil)
+		mockOp.On("Wait").Return(nil)
+
+		status, err := i.prefetchImage(cli, "ubuntu:24.04", config.LXDImageContainer, "x86_64")
+		require.NoError(t, err)
+		assert.Equal(t, "cached remote123456", status)
+	})
+
+	t.Run("recent copy is left alone", func(t *testing.T) {
+		cli := new(MockLXDServer)
+		i := newCachingImage(false)
+		aliases := map[string]*api.ImageAliasesEntry{
+			"x86_64": {Name: cachedUbuntuAlias, Target: "cached123"},
+		}
+		cli.On("GetImageAliasArchitectures", "container", cachedUbuntuAlias).Return(aliases, nil)
+		cli.On("GetImage", "cached123").Return(&api.Image{Fingerprint: "cached123", UploadedAt: time.Now()}, "", nil)
+
+		status, err := i.prefetchImage(cli, "ubuntu:24.04", config.LXDImageContainer, "x86_64")
+		require.NoError(t, err)
+		assert.Equal(t, "up to date cached123", status)
+		cli.AssertNotCalled(t, "RefreshImage", mock.Anything)
+	})
+
+	t.Run("old copy is refreshed", func(t *testing.T) {
+		cli := new(MockLXDServer)
+		mockOp := new(MockOperation)
+		i := newCachingImage(false)
+		old := map[string]*api.ImageAliasesEntry{
+			"x86_64": {Name: cachedUbuntuAlias, Target: "old123"},
+		}
+		refreshed := map[string]*api.ImageAliasesEntry{
+			"x86_64": {Name: cachedUbuntuAlias, Target: "new123"},
+		}
+		cli.On("GetImageAliasArchitectures", "container", cachedUbuntuAlias).Return(old, nil).Once()
+		cli.On("GetImageAliasArchitectures", "container", cachedUbuntuAlias).Return(refreshed, nil).Once()
+		cli.On("GetImage", "old123").Return(&api.Image{Fingerprint: "old123", UploadedAt: time.Now().Add(-48 * time.Hour)}, "", nil)
+		cli.On("GetImage", "new123").Return(&api.Image{Fingerprint: "new123", UploadedAt: time.Now()}, "", nil)
+		cli.On("RefreshImage", "old123").Return(mockOp, nil)
+		mockOp.On("Wait").Return(nil)
+
+		status, err := i.prefetchImage(cli, "ubuntu:24.04", config.LXDImageContainer, "x86_64")
+		require.NoError(t, err)
+		assert.Equal(t, "refreshed old123 -> new123", status)
+	})
+}
+
+func TestPrefetchImages(t *testing.T) {
+	ctx := context.Background()
+	cli := new(MockLXDServer)
+	mockOp := new(MockOperation)
+	i := newCachingImage(false)
+	mockRemoteImageServer(t, "remote123")
+	l := &LXD{
+		cfg: &config.LXD{
+			InstanceType: config.LXDImageContainer,
+			ImageCache:   i.cache,
+		},
+		cli:          cli,
+		imageManager: i,
+	}
+
+	cli.On("GetServer").Return(&api.Server{
+		Environment: api.ServerEnvironment{Architectures: []string{"x86_64", "i686"}},
+	}, "", nil)
+	cli.On("GetImageAliasArchitectures", "container", cachedUbuntuAlias).Return(map[string]*api.ImageAliasesEntry{}, nil)
+	cli.On("CreateImage", expectedCacheImagesPost("remote123"), (*lxd.ImageCreateArgs)(nil)).Return(mockOp, nil)
+	mockOp.On("Wait").Return(nil)
+
+	out := &bytes.Buffer{}
+	require.NoError(t, l.prefetchImages(ctx, out))
+	assert.Equal(t, "ubuntu:24.04 (container, x86_64): cached remote123\n", out.String())
+}
@@ -0,0 +1,234 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+// Copyright 2023 Cloudbase Solutions SRL
+//
+// Licensed under the AGPLv3, see LICENCE file for details
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	lxd "github.com/canonical/lxd/client"
+	"github.com/canonical/lxd/shared/api"
+	"github.com/pkg/errors"
+)
+
+// baseImageKey is the key LXD uses in the instance config to record the image an
+// instance was created from.
+const baseImageKey = "volatile.base_image"
+
+// imageLastUsed returns the last time the image was used, or the time it was added
+// to the image store if it was never used.
+func imageLastUsed(img api.Image) time.Time {
+	if img.LastUsedAt.After(img.UploadedAt) {
+		return img.LastUsedAt
+	}
+	return img.UploadedAt
+}
+
+// imageInUse returns the reason an image must be kept, or an empty string if the
+// image is not referenced. Images are referenced by the instances created from them,
+// by the fingerprints pools and image builds are pinned to, and by their aliases.
+// Pools may use any local alias, except for the aliases of cached images, which are
+// only referenced if the image is still in the cache config.
+func imageInUse(img api.Image, usedByInstances map[string]struct{}, pinned []string, cachePrefixes []string) string {
+	if _, ok := usedByInstances[img.Fingerprint]; ok {
+		return "used by instances"
+	}
+	for _, fingerprint := range pinned {
+		if strings.HasPrefix(img.Fingerprint, fingerprint) {
+			return fmt.Sprintf("pinned as %s", fingerprint)
+		}
+	}
+	for _, alias := range img.Aliases {
+		if !strings.HasPrefix(alias.Name, cachedImageAliasPrefix+"/") {
+			return fmt.Sprintf("has alias %s", alias.Name)
+		}
+		if slices.ContainsFunc(cachePrefixes, func(prefix string) bool {
+			return strings.HasPrefix(alias.Name, prefix)
+		}) {
+			return fmt.Sprintf("cached as %s", alias.Name)
+		}
+	}
+	return ""
+}
+
+// cachedAliasPrefixes returns the prefixes of the local aliases of the images in the
+// cache config. The architecture is left out, so all architectures of an image match.
+func (l *LXD) cachedAliasPrefixes() []string {
+	ret := []string{}
+	for _, cachedImage := range l.cfg.ImageCache.Images {
+		imageType := cachedImage.InstanceType
+		if imageType == "" {
+			imageType = getInstanceType(l.cfg, extraSpecs{})
+		}
+		remoteName, alias, _ := strings.Cut(cachedImage.Image, ":")
+		ret = append(ret, cachedImageAlias(remoteName, alias, imageType, ""))
+	}
+	return ret
+}
+
+// sharesImageStore returns true if the project uses the image store of the default
+// project. The default project shares its image store with every project that has
+// features.images disabled.
+func sharesImageStore(cli InstanceServerInterface, project string) (bool, error) {
+	if project == api.ProjectDefaultName {
+		return true, nil
+	}
+	current, _, err := cli.GetProject(project)
+	if err != nil {
+		return false, errors.Wrapf(err, "fetching project %s", project)
+	}
+	return current.Config["features.images"] != "true", nil
+}
+
+// listImageUsers returns the instances that may use the images in the image store of
+// the provider. If the image store is shared with the default project, instances in
+// any project may use it, GARM runners or not.
+func (l *LXD) listImageUsers(ctx context.Context, cli InstanceServerInterface) ([]api.InstanceFull, error) {
+	shared, err := sharesImageStore(cli, projectName(l.cfg))
+	if err != nil {
+		return nil, err
+	}
+	if shared {
+		instances, err := cli.GetInstancesFull(lxd.GetInstancesFullArgs{InstanceType: api.InstanceTypeAny, AllProjects: true})
+		if err != nil {
+			return nil, errors.Wrap(err, "listing instances in all projects")
+		}
+		return instances, nil
+	}
+
+	ret := []api.InstanceFull{}
+	for _, project := range managedProjects(l.cfg) {
+		projectCLI, err := l.getProjectCLI(ctx, project)
+		if err != nil {
+			return nil, errors.Wrapf(err, "fetching client for project %s", project)
+		}
+		instances, err := listProjectInstances(projectCLI)
+		if err != nil {
+			return nil, errors.Wrapf(err, "listing instances in project %s", project)
+		}
+		ret = append(ret, instances...)
+	}
+	return ret, nil
+}
+
+// pinnedFingerprint returns the fingerprint an image name is pinned to, if any.
+func pinnedFingerprint(imageName string) string {
+	_, fingerprint, err := splitImageFingerprint(imageName)
+	if err != nil {
+		return ""
+	}
+	return fingerprint
+}
+
+// getImageReferences returns the fingerprints of the images instances were created
+// from, and the fingerprints that are pinned by the warm pool templates of instances
+// and by the image builds in the config. Pinned fingerprints may be short.
+func (l *LXD) getImageReferences(ctx context.Context, cli InstanceServerInterface) (map[string]struct{}, []string, error) {
+	instances, err := l.listImageUsers(ctx, cli)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	usedByInstances := map[string]struct{}{}
+	pinned := []string{}
+	for _, instance := range instances {
+		for _, key := range []string{baseImageKey, imageFingerprintKey} {
+			if fingerprint := instance.ExpandedConfig[key]; fingerprint != "" {
+				usedByInstances[fingerprint] = struct{}{}
+			}
+		}
+
+		var template warmTemplate
+		if err := json.Unmarshal([]byte(instance.ExpandedConfig[warmTemplateKey]), &template); err == nil {
+			if fingerprint := pinnedFingerprint(template.Image); fingerprint != "" {
+				pinned = append(pinned, fingerprint)
+			}
+		}
+	}
+	for _, build := range l.cfg.ImageBuilds {
+		if fingerprint := pinnedFingerprint(build.BaseImage); fingerprint != "" {
+			pinned = append(pinned, fingerprint)
+		}
+	}
+	return usedByInstances, pinned, nil
+}
+
+// collectImages deletes images in the project of the provider that are not referenced
+// and were not used for longer than the max age. With dryRun, images are only
+// reported. A line is written to w for every image.
+func (l *LXD) collectImages(ctx context.Context, dryRun bool, w io.Writer) error {
+	cli, err := l.getCLI(ctx)
+	if err != nil {
+		return errors.Wrap(err, "fetching client")
+	}
+
+	usedByInstances, pinned, err := l.getImageReferences(ctx, cli)
+	if err != nil {
+		return err
+	}
+
+	images, err := cli.GetImages()
+	if err != nil {
+		return errors.Wrap(err, "listing images")
+	}
+	slices.SortFunc(images, func(a, b api.Image) int {
+		return strings.Compare(a.Fingerprint, b.Fingerprint)
+	})
+
+	cachePrefixes := l.cachedAliasPrefixes()
+	maxAge := l.cfg.ImageCache.GetMaxAge()
+	var failed bool
+	for _, img := range images {
+		name := shortFingerprint(img.Fingerprint)
+		if description := img.Properties["description"]; description != "" {
+			name = fmt.Sprintf("%s (%s)", name, description)
+		}
+
+		if reason := imageInUse(img, usedByInstances, pinned, cachePrefixes); reason != "" {
+			fmt.Fprintf(w, "keep %s: %s\n", name, reason)
+			continue
+		}
+
+		lastUsed := imageLastUsed(img)
+		if time.Since(lastUsed) < maxAge {
+			fmt.Fprintf(w, "keep %s: last used %s\n", name, lastUsed.UTC().Format(time.RFC3339))
+			continue
+		}
+
+		if dryRun {
+			fmt.Fprintf(w, "would delete %s: last used %s\n", name, lastUsed.UTC().Format(time.RFC3339))
+			continue
+		}
+
+		if err := deleteImage(cli, img.Fingerprint); err != nil {
+			failed = true
+			fmt.Fprintf(w, "failed to delete %s: %s\n", name, err)
+			continue
+		}
+		fmt.Fprintf(w, "deleted %s: last used %s\n", name, lastUsed.UTC().Format(time.RFC3339))
+	}
+
+	if failed {
+		return fmt.Errorf("failed to delete some images")
+	}
+	return nil
+}
+
+func deleteImage(cli InstanceServerInterface, fingerprint string) error {
+	op, err := cli.DeleteImage(fingerprint)
+	if err != nil {
+		return errors.Wrap(err, "deleting image")
+	}
+	if err := op.Wait(); err != nil {
+		return errors.Wrap(err, "waiting for image to be deleted")
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+// Copyright 2023 Cloudbase Solutions SRL
+//
+// Licensed under the AGPLv3, see LICENCE file for details
+
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	lxd "github.com/canonical/lxd/client"
+	"github.com/canonical/lxd/shared/api"
+	"github.com/cloudbase/garm-provider-lxd/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func newGCTestLXD(t *testing.T) (*LXD, *MockLXDServer) {
+	t.Helper()
+	cli := new(MockLXDServer)
+	l := &LXD{
+		cfg: &config.LXD{
+			InstanceType: config.LXDImageContainer,
+			ImageCache: config.ImageCache{
+				MaxAge: 24,
+				Images: []config.CachedImage{
+					{Image: "ubuntu:24.04"},
+				},
+			},
+		},
+		cli:          cli,
+		imageManager: &image{},
+	}
+
+	old := time.Now().Add(-72 * time.Hour)
+	cli.On("GetProject", DefaultProjectName).Return(&api.Project{
+		Name:   DefaultProjectName,
+		Config: map[string]string{"features.images": "true"},
+	}, "", nil)
+	cli.On("GetInstancesFull", lxd.GetInstancesFullArgs{InstanceType: api.InstanceTypeAny}).Return([]api.InstanceFull{
+		{
+			Instance: api.Instance{
+				Name:           "runner",
+				ExpandedConfig: map[string]string{baseImageKey: "aaaa0000inuse"},
+			},
+		},
+	}, nil)
+	cli.On("GetImages").Return([]api.Image{
+		{Fingerprint: "aaaa0000inuse", UploadedAt: old},
+		{Fingerprint: "bbbb0000alias", UploadedAt: old, Aliases: []api.ImageAlias{{Name: "my-runner-image"}}},
+		{Fingerprint: "cccc0000cached", UploadedAt: old, Aliases: []api.ImageAlias{{Name: "garm-cache/ubuntu/24.04/container/x86_64"}}},
+		{Fingerprint: "dddd0000recent", UploadedAt: old, LastUsedAt: time.Now().Add(-time.Hour)},
+		{Fingerprint: "eeee0000stale", UploadedAt: old, Properties: map[string]string{"description": "ubuntu 22.04"}},
+		{Fingerprint: "ffff0000uncached", UploadedAt: old, Aliases: []api.ImageAlias{{Name: "garm-cache/ubuntu/22.04/container/x86_64"}}},
+	}, nil)
+	return l, cli
+}
+
+func TestCollectImagesDryRun(t *testing.T) {
+	l, cli := newGCTestLXD(t)
+
+	out := &bytes.Buffer{}
+	require.NoError(t, l.collectImages(context.Background(), true, out))
+	lines := out.String()
+	assert.Contains(t, lines, "keep aaaa0000inus: used by instances\n")
+	assert.Contains(t, lines, "keep bbbb0000alia: has alias my-runner-image\n")
+	assert.Contains(t, lines, "keep cccc0000cach: cached as garm-cache/ubuntu/24.04/container/x86_64\n")
+	assert.Contains(t, lines, "keep dddd0000rece: last used")
+	assert.Contains(t, lines, "would delete eeee0000stal (ubuntu 22.04): last used")
+	assert.Contains(t, lines, "would delete ffff0000unca: last used")
+	cli.AssertNotCalled(t, "DeleteImage", mock.Anything)
+}
+
+func TestCollectImages(t *testing.T) {
+	l, cli := newGCTestLXD(t)
+	mockOp := new(MockOperation)
+	cli.On("DeleteImage", "eeee0000stale").Return(mockOp, nil)
+	cli.On("DeleteImage", "ffff0000uncached").Return(mockOp, nil)
+	mockOp.On("Wait").Return(nil)
+
+	out := &bytes.Buffer{}
+	require.NoError(t, l.collectImages(context.Background(), false, out))
+	assert.Contains(t, out.String(), "deleted eeee0000stal (ubuntu 22.04): last used")
+	assert.Contains(t, out.String(), "deleted ffff0000unca: last used")
+	cli.AssertExpectations(t)
+	cli.AssertNumberOfCalls(t, "DeleteImage", 2)
+}
+
+func TestCollectImagesSharedImageStore(t *testing.T) {
+	cli := new(MockLXDServer)
+	l := &LXD{
+		cfg: &config.LXD{
+			InstanceType: config.LXDImageContainer,
+			ImageCache:   config.ImageCache{MaxAge: 24},
+		},
+		cli:          cli,
+		imageManager: &image{},
+	}
+
+	// With features.images disabled, the project uses the image store of the default
+	// project, so instances in any project may use its images.
+	cli.On("GetProject", DefaultProjectName).Return(&api.Project{
+		Name:   DefaultProjectName,
+		Config: map[string]string{"features.images": "false"},
+	}, "", nil)
+	cli.On("GetInstancesFull", lxd.GetInstancesFullArgs{InstanceType: api.InstanceTypeAny, AllProjects: true}).Return([]api.InstanceFull{
+		{
+			Instance: api.Instance{
+				Name:           "web-server",
+				Project:        "default",
+				ExpandedConfig: map[string]string{baseImageKey: "aaaa0000other"},
+			},
+		},
+	}, nil)
+	old := time.Now().Add(-72 * time.Hour)
+	cli.On("GetImages").Return([]api.Image{
+		{Fingerprint: "aaaa0000other", UploadedAt: old},
+		{Fingerprint: "bbbb0000stale", UploadedAt: old},
+	}, nil)
+
+	out := &bytes.Buffer{}
+	require.NoError(t, l.collectImages(context.Background(), true, out))
+	assert.Contains(t, out.String(), "keep aaaa0000othe: used by instances\n")
+	assert.Contains(t, out.String(), "would delete bbbb0000stal: last used")
+	cli.AssertNotCalled(t, "GetInstancesFull", lxd.GetInstancesFullArgs{InstanceType: api.InstanceTypeAny})
+}
+
+func TestCollectImagesPinnedFingerprints(t *testing.T) {
+	cli := new(MockLXDServer)
+	l := &LXD{
+		cfg: &config.LXD{
+			InstanceType: config.LXDImageContainer,
+			ImageCache:   config.ImageCache{MaxAge: 24},
+			ImageBuilds: map[string]config.ImageBuild{
+				"runner-image": {BaseImage: "ubuntu:24.04@bbbb0000b1d5"},
+			},
+		},
+		cli:          cli,
+		imageManager: &image{},
+	}
+
+	cli.On("GetProject", DefaultProjectName).Return(&api.Project{
+		Name:   DefaultProjectName,
+		Config: map[string]string{"features.images": "true"},
+	}, "", nil)
+	// The warm instance was created from an image its pool is pinned to. The alias of
+	// that image has since moved, and the instance records a different base image.
+	template, err := json.Marshal(warmTemplate{Image: "local:runner@aaaa0000a1d5"})
+	require.NoError(t, err)
+	cli.On("GetInstancesFull", lxd.GetInstancesFullArgs{InstanceType: api.InstanceTypeAny}).Return([]api.InstanceFull{
+		{
+			Instance: api.Instance{
+				Name: "garm-warm",
+				ExpandedConfig: map[string]string{
+					warmPoolKey:     "pool",
+					warmTemplateKey: string(template),
+				},
+			},
+		},
+	}, nil)
+	old := time.Now().Add(-72 * time.Hour)
+	cli.On("GetImages").Return([]api.Image{
+		{Fingerprint: "aaaa0000a1d5pinned", UploadedAt: old},
+		{Fingerprint: "bbbb0000b1d5pinned", UploadedAt: old},
+		{Fingerprint: "cccc0000stale", UploadedAt: old},
+	}, nil)
+
+	out := &bytes.Buffer{}
+	require.NoError(t, l.collectImages(context.Background(), true, out))
+	assert.Contains(t, out.String(), "keep aaaa0000a1d5: pinned as aaaa0000a1d5\n")
+	assert.Contains(t, out.String(), "keep bbbb0000b1d5: pinned as bbbb0000b1d5\n")
+	assert.Contains(t, out.String(), "would delete cccc0000stal: last used")
+}
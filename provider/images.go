@@ -6,18 +6,163 @@
 package provider
 
 import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
 	"strings"
+	"time"
 
 	runnerErrors "github.com/cloudbase/garm-provider-common/errors"
 	"github.com/cloudbase/garm-provider-lxd/config"
 
+	lxd "github.com/canonical/lxd/client"
+	"github.com/canonical/lxd/shared"
 	"github.com/canonical/lxd/shared/api"
 	"github.com/pkg/errors"
 )
 
+// ImageServerInterface is the subset of lxd.ImageServer we use to look up images on
+// remotes that use the lxd protocol.
+type ImageServerInterface interface {
+	GetImageAliasArchitectures(imageType string, name string) (map[string]*api.ImageAliasesEntry, error)
+	GetImage(fingerprint string) (*api.Image, string, error)
+	GetImageSecret(fingerprint string) (string, error)
+}
+
+type ConnectImageServerFunc func(remote config.LXDImageRemote) (ImageServerInterface, error)
+
+type GetRemoteCertificateFunc func(address string) (*x509.Certificate, error)
+
+var (
+	DefaultConnectImageServer   ConnectImageServerFunc   = connectImageServer
+	DefaultGetRemoteCertificate GetRemoteCertificateFunc = getRemoteCertificate
+)
+
+// imageFingerprintRegex matches full fingerprints, and the short fingerprints shown
+// by "lxc image list".
+var imageFingerprintRegex = regexp.MustCompile(`^[0-9a-f]{12,64}$`)
+
+// remoteCertificateTimeout is the time we allow for fetching the certificate of an
+// image remote that has skip_verify enabled.
+const remoteCertificateTimeout = 30 * time.Second
+
+// imageAliasResolver is implemented by both instance and image servers.
+type imageAliasResolver interface {
+	GetImageAliasArchitectures(imageType string, name string) (map[string]*api.ImageAliasesEntry, error)
+	GetImage(fingerprint string) (*api.Image, string, error)
+}
+
 type image struct {
 	remotes map[string]config.LXDImageRemote
+	cache   config.ImageCache
+}
+
+// connectImageServer connects to an image remote, using the TLS settings of the remote.
+func connectImageServer(remote config.LXDImageRemote) (ImageServerInterface, error) {
+	var srvCrtContents, tlsCAContents, clientCertContents, clientKeyContents []byte
+	var err error
+
+	if remote.TLSServerCert != "" {
+		srvCrtContents, err = os.ReadFile(remote.TLSServerCert)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading server certificate")
+		}
+	}
+
+	if remote.CACert != "" {
+		tlsCAContents, err = os.ReadFile(remote.CACert)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading CA certificate")
+		}
+	}
+
+	if remote.ClientCertificate != "" {
+		clientCertContents, err = os.ReadFile(remote.ClientCertificate)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading client certificate")
+		}
+	}
+
+	if remote.ClientKey != "" {
+		clientKeyContents, err = os.ReadFile(remote.ClientKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading client key")
+		}
+	}
+
+	connectArgs := lxd.ConnectionArgs{
+		TLSServerCert:      string(srvCrtContents),
+		TLSCA:              string(tlsCAContents),
+		TLSClientCert:      string(clientCertContents),
+		TLSClientKey:       string(clientKeyContents),
+		InsecureSkipVerify: remote.InsecureSkipVerify,
+		SkipGetServer:      true,
+	}
+
+	var cli ImageServerInterface
+	switch remote.Protocol {
+	case config.SimpleStreams:
+		cli, err = lxd.ConnectSimpleStreams(remote.Address, &connectArgs)
+	case config.LXDProtocol:
+		cli, err = lxd.ConnectLXD(remote.Address, &connectArgs)
+	default:
+		return nil, runnerErrors.NewBadRequestError("images can not be resolved on %s remotes", remote.Protocol)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "connecting to %s", remote.Address)
+	}
+	return cli, nil
+}
+
+func getRemoteCertificate(address string) (*x509.Certificate, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), remoteCertificateTimeout)
+	defer cancel()
+	return shared.GetRemoteCertificate(ctx, address, "garm-provider-lxd")
+}
+
+// remoteCertificate returns the certificate the LXD server should trust when it
+// downloads images from the remote. With skip_verify, we trust the certificate the
+// remote presents, the same way "lxc remote add --accept-certificate" does.
+func remoteCertificate(remote config.LXDImageRemote) (string, error) {
+	var certFile string
+	switch {
+	case remote.TLSServerCert != "":
+		certFile = remote.TLSServerCert
+	case remote.CACert != "":
+		certFile = remote.CACert
+	case remote.InsecureSkipVerify:
+		cert, err := DefaultGetRemoteCertificate(remote.Address)
+		if err != nil {
+			return "", errors.Wrapf(err, "fetching certificate of %s", remote.Address)
+		}
+		return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})), nil
+	default:
+		return "", nil
+	}
+
+	contents, err := os.ReadFile(certFile)
+	if err != nil {
+		return "", errors.Wrapf(err, "reading certificate %s", certFile)
+	}
+	return string(contents), nil
+}
+
+// splitImageFingerprint splits the fingerprint an image is pinned to from the image
+// name. Images are pinned using the remote:alias@fingerprint syntax.
+func splitImageFingerprint(imageName string) (string, string, error) {
+	name, fingerprint, found := strings.Cut(imageName, "@")
+	if !found {
+		return imageName, "", nil
+	}
+	if !imageFingerprintRegex.MatchString(fingerprint) {
+		return "", "", runnerErrors.NewBadRequestError("invalid image fingerprint %q", fingerprint)
+	}
+	return name, fingerprint, nil
 }
 
 // parseImageName parses the image name that comes in from the config and returns a
@@ -36,15 +181,18 @@ func (i *image) parseImageName(imageName string) (config.LXDImageRemote, string,
 	return config.LXDImageRemote{}, "", fmt.Errorf("could not find %s in %v: %w", imageName, i.remotes, runnerErrors.ErrNotFound)
 }
 
-func (i *image) getLocalImageByAlias(imageName string, imageType config.LXDImageType, arch string, cli InstanceServerInterface) (*api.Image, error) {
+func (i *image) getLocalImageByAlias(imageName string, imageType config.LXDImageType, arch string, cli imageAliasResolver) (*api.Image, error) {
 	aliases, err := cli.GetImageAliasArchitectures(imageType.String(), imageName)
 	if err != nil {
 		return nil, errors.Wrapf(err, "resolving alias: %s", imageName)
 	}
 
+	if len(aliases) == 0 {
+		return nil, errors.Wrapf(runnerErrors.ErrNotFound, "no image found for image type %s with name %s", imageType, imageName)
+	}
 	alias, ok := aliases[arch]
 	if !ok {
-		return nil, fmt.Errorf("no image found for arch %s and image type %s with name %s", arch, imageType, imageName)
+		return nil, runnerErrors.NewBadRequestError("image %s is not available for architecture %s (available: %s)", imageName, arch, strings.Join(slices.Sorted(maps.Keys(aliases)), ", "))
 	}
 
 	image, _, err := cli.GetImage(alias.Target)
@@ -54,11 +202,96 @@ func (i *image) getLocalImageByAlias(imageName string, imageType config.LXDImage
 	return image, nil
 }
 
+// validateImage checks that the image can be resolved. Images with a remote only need
+// the remote to be configured, as LXD will fetch them at instance creation time. Local
+// aliases must exist on the server for at least one architecture. The pool architecture
+// is not known at this point, so it is checked when the instance is created.
+func (i *image) validateImage(imageName string, imageType config.LXDImageType, cli InstanceServerInterface, server *api.Server) error {
+	if imageName == "" {
+		return runnerErrors.NewBadRequestError("missing image")
+	}
+
+	if isCopySource(imageName) {
+		_, arch, err := getGoldenSource(cli, imageName, imageType)
+		if err != nil {
+			return errors.Wrapf(err, "validating golden instance %s", imageName)
+		}
+		if err := validateServerArchitecture(server, imageType, arch); err != nil {
+			return errors.Wrapf(err, "validating golden instance %s", imageName)
+		}
+		return nil
+	}
+
+	imageName, fingerprint, err := splitImageFingerprint(imageName)
+	if err != nil {
+		return errors.Wrap(err, "parsing image fingerprint")
+	}
+
+	if strings.Contains(imageName, ":") {
+		remote, parsedName, err := i.parseImageName(imageName)
+		if err != nil {
+			return errors.Wrapf(err, "parsing image name: %s", imageName)
+		}
+		if parsedName == "" {
+			return runnerErrors.NewBadRequestError("missing image alias in %s", imageName)
+		}
+		if remote.Protocol == config.OCIProtocol && imageType != config.LXDImageContainer {
+			return runnerErrors.NewBadRequestError("images from %s remotes can only be used with containers", config.OCIProtocol)
+		}
+		return nil
+	}
+
+	if fingerprint != "" {
+		image, _, err := cli.GetImage(fingerprint)
+		if err != nil {
+			return errors.Wrapf(err, "fetching image %s", fingerprint)
+		}
+		if err := validateServerArchitecture(server, imageType, image.Architecture); err != nil {
+			return errors.Wrapf(err, "validating image %s", fingerprint)
+		}
+		return nil
+	}
+
+	aliases, err := cli.GetImageAliasArchitectures(imageType.String(), imageName)
+	if err != nil {
+		return errors.Wrapf(err, "resolving alias: %s", imageName)
+	}
+	if len(aliases) == 0 {
+		return errors.Wrapf(runnerErrors.ErrNotFound, "no image found for image type %s with name %s", imageType, imageName)
+	}
+
+	supported := serverArchitectures(server, imageType)
+	for arch := range aliases {
+		if slices.Contains(supported, arch) {
+			return nil
+		}
+	}
+	return runnerErrors.NewBadRequestError("image %s is not available for any architecture supported by the LXD server (supported: %s)", imageName, strings.Join(supported, ", "))
+}
+
 func (i *image) getInstanceSource(imageName string, imageType config.LXDImageType, arch string, cli InstanceServerInterface) (api.InstanceSource, error) {
+	if isCopySource(imageName) {
+		return getCopySource(cli, imageName, imageType, arch)
+	}
+
 	instanceSource := api.InstanceSource{
 		Type: "image",
 	}
+	imageName, fingerprint, err := splitImageFingerprint(imageName)
+	if err != nil {
+		return api.InstanceSource{}, errors.Wrap(err, "parsing image fingerprint")
+	}
+
 	if !strings.Contains(imageName, ":") {
+		if fingerprint != "" {
+			// LXD accepts short fingerprints for local images, but we record the full one.
+			imageDetails, _, err := cli.GetImage(fingerprint)
+			if err != nil {
+				return api.InstanceSource{}, errors.Wrapf(err, "fetching image %s", fingerprint)
+			}
+			instanceSource.Fingerprint = imageDetails.Fingerprint
+			return instanceSource, nil
+		}
 		// A remote was not specified, try to find an image using the imageName as
 		// an alias.
 		imageDetails, err := i.getLocalImageByAlias(imageName, imageType, arch, cli)
@@ -71,9 +304,85 @@ func (i *image) getInstanceSource(imageName string, imageType config.LXDImageTyp
 		if err != nil {
 			return api.InstanceSource{}, errors.Wrapf(err, "parsing image name: %s", imageName)
 		}
+
+		if fingerprint == "" && i.cache.Enabled() && remote.Protocol != config.OCIProtocol {
+			remoteName, _, _ := strings.Cut(imageName, ":")
+			if cached := i.getOrCacheImage(cli, remoteName, remote, parsedName, imageType, arch); cached != nil {
+				instanceSource.Fingerprint = cached.Fingerprint
+				return instanceSource, nil
+			}
+		}
+
 		instanceSource.Alias = parsedName
 		instanceSource.Server = remote.Address
 		instanceSource.Protocol = string(remote.Protocol)
+
+		if remote.Protocol == config.OCIProtocol && imageType != config.LXDImageContainer {
+			return api.InstanceSource{}, runnerErrors.NewBadRequestError("images from %s remotes can only be used with containers", config.OCIProtocol)
+		}
+
+		instanceSource.Certificate, err = remoteCertificate(remote)
+		if err != nil {
+			return api.InstanceSource{}, errors.Wrapf(err, "getting certificate of remote for %s", imageName)
+		}
+
+		if err := i.setRemoteImage(&instanceSource, remote, parsedName, fingerprint, imageType, arch); err != nil {
+			return api.InstanceSource{}, errors.Wrapf(err, "resolving image %s", imageName)
+		}
 	}
 	return instanceSource, nil
 }
+
+// setRemoteImage sets the fingerprint of pinned images on the instance source. Image
+// aliases are resolved on the remote if the remote has resolve_aliases enabled, or if
+// it is an lxd remote with a client certificate, which may need a secret for private
+// images.
+func (i *image) setRemoteImage(instanceSource *api.InstanceSource, remote config.LXDImageRemote, alias, fingerprint string, imageType config.LXDImageType, arch string) error {
+	if fingerprint != "" {
+		instanceSource.Alias = ""
+		instanceSource.Fingerprint = fingerprint
+	}
+
+	private := remote.Protocol == config.LXDProtocol && remote.ClientCertificate != ""
+	if !private && (fingerprint != "" || !remote.ResolveAliases) {
+		return nil
+	}
+
+	imageDetails, secret, err := i.resolveRemoteImage(remote, alias, fingerprint, imageType, arch)
+	if err != nil {
+		return err
+	}
+	instanceSource.Alias = ""
+	instanceSource.Fingerprint = imageDetails.Fingerprint
+	instanceSource.Secret = secret
+	return nil
+}
+
+// resolveRemoteImage looks up an image on the remote, by fingerprint if one is given, or
+// by alias. For private images on lxd remotes, a secret is requested that allows the
+// LXD server to download the image, the same way the lxc client does.
+func (i *image) resolveRemoteImage(remote config.LXDImageRemote, alias, fingerprint string, imageType config.LXDImageType, arch string) (*api.Image, string, error) {
+	srv, err := DefaultConnectImageServer(remote)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "connecting to image remote")
+	}
+
+	var imageDetails *api.Image
+	if fingerprint != "" {
+		imageDetails, _, err = srv.GetImage(fingerprint)
+	} else {
+		imageDetails, err = i.getLocalImageByAlias(alias, imageType, arch, srv)
+	}
+	if err != nil {
+		return nil, "", errors.Wrap(err, "fetching image")
+	}
+
+	var secret string
+	if remote.Protocol == config.LXDProtocol && remote.ClientCertificate != "" && !imageDetails.Public {
+		secret, err = srv.GetImageSecret(imageDetails.Fingerprint)
+		if err != nil {
+			return nil, "", errors.Wrap(err, "fetching image secret")
+		}
+	}
+	return imageDetails, secret, nil
+}
@@ -6,12 +6,17 @@
 package provider
 
 import (
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
+	"os"
 	"testing"
 
 	"github.com/canonical/lxd/shared/api"
+	runnerErrors "github.com/cloudbase/garm-provider-common/errors"
 	"github.com/cloudbase/garm-provider-lxd/config"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 )
 
@@ -125,6 +130,23 @@ func TestGetLocalImageByAlias_Error(t *testing.T) {
 	cli.AssertExpectations(t)
 }
 
+func TestGetLocalImageByAliasMissingArchitecture(t *testing.T) {
+	cli := new(MockLXDServer)
+	i := &image{}
+	cli.On("GetImageAliasArchitectures", "virtual-machine", "ubuntu").Return(map[string]*api.ImageAliasesEntry{
+		"x86_64": {},
+		"i686":   {},
+	}, nil)
+	cli.On("GetImageAliasArchitectures", "virtual-machine", "missing").Return(map[string]*api.ImageAliasesEntry{}, nil)
+
+	_, err := i.getLocalImageByAlias("ubuntu", config.LXDImageVirtualMachine, "aarch64", cli)
+	require.ErrorIs(t, err, runnerErrors.ErrBadRequest)
+	assert.EqualError(t, err, "image ubuntu is not available for architecture aarch64 (available: i686, x86_64)")
+
+	_, err = i.getLocalImageByAlias("missing", config.LXDImageVirtualMachine, "aarch64", cli)
+	require.ErrorIs(t, err, runnerErrors.ErrNotFound)
+}
+
 func TestGetInstanceSource_Success(t *testing.T) {
 	cli := new(MockLXDServer)
 	i := &image{
@@ -173,3 +195,222 @@ func TestGetInstanceSource_Error(t *testing.T) {
 	assert.Equal(t, api.InstanceSource{}, instanceSource)
 	cli.AssertExpectations(t)
 }
+
+func TestGetInstanceSourceOCIRemote(t *testing.T) {
+	cli := new(MockLXDServer)
+	i := &image{
+		remotes: map[string]config.LXDImageRemote{
+			"docker": {
+				Address:  "https://docker.io",
+				Protocol: config.OCIProtocol,
+			},
+		},
+	}
+
+	instanceSource, err := i.getInstanceSource("docker:ubuntu/runner", config.LXDImageContainer, "x86_64", cli)
+	require.NoError(t, err)
+	assert.Equal(t, api.InstanceSource{
+		Type:     "image",
+		Alias:    "ubuntu/runner",
+		Server:   "https://docker.io",
+		Protocol: "oci",
+	}, instanceSource)
+
+	_, err = i.getInstanceSource("docker:ubuntu/runner", config.LXDImageVirtualMachine, "x86_64", cli)
+	require.Error(t, err)
+	assert.ErrorIs(t, err, runnerErrors.ErrBadRequest)
+
+	err = i.validateImage("docker:ubuntu/runner", config.LXDImageVirtualMachine, cli, &api.Server{})
+	require.Error(t, err)
+	assert.ErrorIs(t, err, runnerErrors.ErrBadRequest)
+}
+
+func TestGetInstanceSourceLXDRemote(t *testing.T) {
+	cli := new(MockLXDServer)
+	remote := config.LXDImageRemote{
+		Address:           "https://images.example.com:8443",
+		Protocol:          config.LXDProtocol,
+		ClientCertificate: "../testdata/lxd/certs/client.crt",
+		ClientKey:         "../testdata/lxd/certs/client.key",
+		TLSServerCert:     "../testdata/lxd/certs/servercert.crt",
+	}
+	i := &image{
+		remotes: map[string]config.LXDImageRemote{
+			"private": remote,
+		},
+	}
+	srvCrt, err := os.ReadFile(remote.TLSServerCert)
+	require.NoError(t, err)
+
+	srv := new(MockLXDServer)
+	DefaultConnectImageServer = func(r config.LXDImageRemote) (ImageServerInterface, error) {
+		assert.Equal(t, remote, r)
+		return srv, nil
+	}
+	defer func() { DefaultConnectImageServer = connectImageServer }()
+
+	aliases := map[string]*api.ImageAliasesEntry{
+		"x86_64": {Name: "runner", Target: "123abc"},
+	}
+	srv.On("GetImageAliasArchitectures", "container", "runner").Return(aliases, nil)
+	srv.On("GetImage", "123abc").Return(&api.Image{Fingerprint: "123abc", Public: false}, "", nil)
+	srv.On("GetImageSecret", "123abc").Return("secret", nil)
+
+	instanceSource, err := i.getInstanceSource("private:runner", config.LXDImageContainer, "x86_64", cli)
+	require.NoError(t, err)
+	assert.Equal(t, api.InstanceSource{
+		Type:        "image",
+		Fingerprint: "123abc",
+		Server:      "https://images.example.com:8443",
+		Protocol:    "lxd",
+		Certificate: string(srvCrt),
+		Secret:      "secret",
+	}, instanceSource)
+	srv.AssertExpectations(t)
+
+	// Without a client certificate, the LXD server resolves the alias itself.
+	remote.ClientCertificate = ""
+	remote.ClientKey = ""
+	i.remotes["private"] = remote
+	instanceSource, err = i.getInstanceSource("private:runner", config.LXDImageContainer, "x86_64", cli)
+	require.NoError(t, err)
+	assert.Equal(t, api.InstanceSource{
+		Type:        "image",
+		Alias:       "runner",
+		Server:      "https://images.example.com:8443",
+		Protocol:    "lxd",
+		Certificate: string(srvCrt),
+	}, instanceSource)
+}
+
+func TestGetInstanceSourceRemoteCertificate(t *testing.T) {
+	cli := new(MockLXDServer)
+	caCert, err := os.ReadFile("../testdata/lxd/certs/servercert.crt")
+	require.NoError(t, err)
+	block, _ := pem.Decode(caCert)
+	require.NotNil(t, block)
+	remoteCert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+
+	i := &image{
+		remotes: map[string]config.LXDImageRemote{
+			"mirror": {
+				Address:  "https://mirror.example.com/images",
+				Protocol: config.SimpleStreams,
+				CACert:   "../testdata/lxd/certs/servercert.crt",
+			},
+			"insecure": {
+				Address:            "https://insecure.example.com/images",
+				Protocol:           config.SimpleStreams,
+				InsecureSkipVerify: true,
+			},
+		},
+	}
+
+	instanceSource, err := i.getInstanceSource("mirror:ubuntu/24.04", config.LXDImageContainer, "x86_64", cli)
+	require.NoError(t, err)
+	assert.Equal(t, string(caCert), instanceSource.Certificate)
+
+	DefaultGetRemoteCertificate = func(address string) (*x509.Certificate, error) {
+		assert.Equal(t, "https://insecure.example.com/images", address)
+		return remoteCert, nil
+	}
+	defer func() { DefaultGetRemoteCertificate = getRemoteCertificate }()
+
+	instanceSource, err = i.getInstanceSource("insecure:ubuntu/24.04", config.LXDImageContainer, "x86_64", cli)
+	require.NoError(t, err)
+	assert.Equal(t, string(pem.EncodeToMemory(block)), instanceSource.Certificate)
+
+	DefaultGetRemoteCertificate = func(_ string) (*x509.Certificate, error) {
+		return nil, fmt.Errorf("connection refused")
+	}
+	_, err = i.getInstanceSource("insecure:ubuntu/24.04", config.LXDImageContainer, "x86_64", cli)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "connection refused")
+}
+
+func TestSplitImageFingerprint(t *testing.T) {
+	name, fingerprint, err := splitImageFingerprint("ubuntu:24.04")
+	require.NoError(t, err)
+	assert.Equal(t, "ubuntu:24.04", name)
+	assert.Equal(t, "", fingerprint)
+
+	name, fingerprint, err = splitImageFingerprint("ubuntu:24.04@4d0b9e8a3c2f")
+	require.NoError(t, err)
+	assert.Equal(t, "ubuntu:24.04", name)
+	assert.Equal(t, "4d0b9e8a3c2f", fingerprint)
+
+	_, _, err = splitImageFingerprint("ubuntu:24.04@latest")
+	require.Error(t, err)
+	assert.ErrorIs(t, err, runnerErrors.ErrBadRequest)
+}
+
+func TestGetInstanceSourcePinnedImage(t *testing.T) {
+	cli := new(MockLXDServer)
+	i := &image{
+		remotes: map[string]config.LXDImageRemote{
+			"ubuntu": {
+				Address:  "https://cloud-images.ubuntu.com/releases",
+				Protocol: config.SimpleStreams,
+			},
+		},
+	}
+
+	instanceSource, err := i.getInstanceSource("ubuntu:24.04@4d0b9e8a3c2f", config.LXDImageContainer, "x86_64", cli)
+	require.NoError(t, err)
+	assert.Equal(t, api.InstanceSource{
+		Type:        "image",
+		Fingerprint: "4d0b9e8a3c2f",
+		Server:      "https://cloud-images.ubuntu.com/releases",
+		Protocol:    "simplestreams",
+	}, instanceSource)
+
+	// Local images are looked up, to record the full fingerprint.
+	cli.On("GetImage", "4d0b9e8a3c2f").Return(&api.Image{Fingerprint: "4d0b9e8a3c2f1e6d", Architecture: "x86_64"}, "", nil)
+	server := &api.Server{
+		Environment: api.ServerEnvironment{Architectures: []string{"x86_64", "i686"}},
+	}
+	instanceSource, err = i.getInstanceSource("runner@4d0b9e8a3c2f", config.LXDImageContainer, "x86_64", cli)
+	require.NoError(t, err)
+	assert.Equal(t, api.InstanceSource{Type: "image", Fingerprint: "4d0b9e8a3c2f1e6d"}, instanceSource)
+	require.NoError(t, i.validateImage("runner@4d0b9e8a3c2f", config.LXDImageContainer, cli, server))
+	cli.AssertExpectations(t)
+}
+
+func TestGetInstanceSourceResolveAliases(t *testing.T) {
+	cli := new(MockLXDServer)
+	remote := config.LXDImageRemote{
+		Address:        "https://cloud-images.ubuntu.com/releases",
+		Protocol:       config.SimpleStreams,
+		ResolveAliases: true,
+	}
+	i := &image{
+		remotes: map[string]config.LXDImageRemote{
+			"ubuntu": remote,
+		},
+	}
+
+	srv := new(MockLXDServer)
+	DefaultConnectImageServer = func(r config.LXDImageRemote) (ImageServerInterface, error) {
+		assert.Equal(t, remote, r)
+		return srv, nil
+	}
+	defer func() { DefaultConnectImageServer = connectImageServer }()
+
+	aliases := map[string]*api.ImageAliasesEntry{
+		"x86_64": {Name: "24.04", Target: "4d0b9e8a3c2f1e6d"},
+	}
+	srv.On("GetImageAliasArchitectures", "container", "24.04").Return(aliases, nil)
+	srv.On("GetImage", "4d0b9e8a3c2f1e6d").Return(&api.Image{Fingerprint: "4d0b9e8a3c2f1e6d", Public: true}, "", nil)
+
+	instanceSource, err := i.getInstanceSource("ubuntu:24.04", config.LXDImageContainer, "x86_64", cli)
+	require.NoError(t, err)
+	assert.Equal(t, api.InstanceSource{
+		Type:        "image",
+		Fingerprint: "4d0b9e8a3c2f1e6d",
+		Server:      "https://cloud-images.ubuntu.com/releases",
+		Protocol:    "simplestreams",
+	}, instanceSource)
+	srv.AssertExpectations(t)
+	srv.AssertNotCalled(t, "GetImageSecret", mock.Anything)
+}
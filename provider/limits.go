@@ -0,0 +1,97 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+// Copyright 2023 Cloudbase Solutions SRL
+//
+// Licensed under the AGPLv3, see LICENCE file for details
+
+package provider
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/canonical/lxd/shared/units"
+	runnerErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/cloudbase/garm-provider-lxd/config"
+	"github.com/pkg/errors"
+)
+
+// getResourceLimits translates the resource limits in the extra specs into LXD
+// instance config keys. These keys are set on the instance itself, so they take
+// precedence over any limits set in the flavor profile.
+func getResourceLimits(specs extraSpecs, instanceType config.LXDImageType) (map[string]string, error) {
+	ret := map[string]string{}
+
+	if specs.CPU > 0 {
+		ret["limits.cpu"] = fmt.Sprintf("%d", specs.CPU)
+	}
+
+	if specs.Memory != "" {
+		if !strings.HasSuffix(specs.Memory, "%") {
+			if _, err := units.ParseByteSizeString(specs.Memory); err != nil {
+				return nil, runnerErrors.NewBadRequestError("invalid memory limit %q: %s", specs.Memory, err)
+			}
+		}
+		ret["limits.memory"] = specs.Memory
+	}
+
+	if specs.Processes > 0 {
+		if instanceType != config.LXDImageContainer {
+			return nil, runnerErrors.NewBadRequestError("processes limit is only supported for containers")
+		}
+		ret["limits.processes"] = fmt.Sprintf("%d", specs.Processes)
+	}
+
+	if specs.CPUAllowance != "" {
+		if instanceType != config.LXDImageContainer {
+			return nil, runnerErrors.NewBadRequestError("cpu allowance is only supported for containers")
+		}
+		ret["limits.cpu.allowance"] = specs.CPUAllowance
+	}
+
+	if specs.RootDiskSize != "" {
+		if _, err := units.ParseByteSizeString(specs.RootDiskSize); err != nil {
+			return nil, runnerErrors.NewBadRequestError("invalid root disk size %q: %s", specs.RootDiskSize, err)
+		}
+	}
+
+	return ret, nil
+}
+
+// getRootDiskDevice returns a root disk device that overrides the one inherited from
+// the profiles, with the size set to the requested value. LXD does not allow changing
+// a single property of a device inherited from a profile, so we copy the root disk
+// of the last profile that defines one, as that is the one the instance would get.
+// A root disk in devices, which are set on the instance itself, wins over profiles.
+func getRootDiskDevice(cli InstanceServerInterface, profiles []string, devices map[string]map[string]string, size string) (string, map[string]string, error) {
+	var deviceName string
+	var rootDevice map[string]string
+	for _, name := range profiles {
+		profile, _, err := cli.GetProfile(name)
+		if err != nil {
+			return "", nil, errors.Wrapf(err, "fetching profile %s", name)
+		}
+		for devName, dev := range profile.Devices {
+			if dev["type"] == "disk" && dev["path"] == "/" {
+				deviceName = devName
+				rootDevice = dev
+			}
+		}
+	}
+	for devName, dev := range devices {
+		if dev["type"] == "disk" && dev["path"] == "/" {
+			deviceName = devName
+			rootDevice = dev
+		}
+	}
+
+	if rootDevice == nil {
+		return "", nil, runnerErrors.NewBadRequestError("no root disk device found in profiles %s", strings.Join(profiles, ", "))
+	}
+
+	ret := make(map[string]string, len(rootDevice)+1)
+	for key, val := range rootDevice {
+		ret[key] = val
+	}
+	ret["size"] = size
+	return deviceName, ret, nil
+}
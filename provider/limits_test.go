@@ -0,0 +1,134 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+// Copyright 2023 Cloudbase Solutions SRL
+//
+// Licensed under the AGPLv3, see LICENCE file for details
+
+package provider
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/canonical/lxd/shared/api"
+	"github.com/cloudbase/garm-provider-lxd/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetResourceLimits(t *testing.T) {
+	tests := []struct {
+		name         string
+		specs        extraSpecs
+		instanceType config.LXDImageType
+		expected     map[string]string
+		errString    string
+	}{
+		{
+			name:         "no limits",
+			specs:        extraSpecs{},
+			instanceType: config.LXDImageContainer,
+			expected:     map[string]string{},
+		},
+		{
+			name: "container limits",
+			specs: extraSpecs{
+				CPU:          2,
+				Memory:       "4GiB",
+				Processes:    500,
+				CPUAllowance: "50%",
+			},
+			instanceType: config.LXDImageContainer,
+			expected: map[string]string{
+				"limits.cpu":           "2",
+				"limits.memory":        "4GiB",
+				"limits.processes":     "500",
+				"limits.cpu.allowance": "50%",
+			},
+		},
+		{
+			name: "vm limits",
+			specs: extraSpecs{
+				CPU:          4,
+				Memory:       "50%",
+				RootDiskSize: "20GiB",
+			},
+			instanceType: config.LXDImageVirtualMachine,
+			expected: map[string]string{
+				"limits.cpu":    "4",
+				"limits.memory": "50%",
+			},
+		},
+		{
+			name:         "processes on vm",
+			specs:        extraSpecs{Processes: 500},
+			instanceType: config.LXDImageVirtualMachine,
+			errString:    "processes limit is only supported for containers",
+		},
+		{
+			name:         "cpu allowance on vm",
+			specs:        extraSpecs{CPUAllowance: "50%"},
+			instanceType: config.LXDImageVirtualMachine,
+			errString:    "cpu allowance is only supported for containers",
+		},
+		{
+			name:         "invalid memory",
+			specs:        extraSpecs{Memory: "4XB"},
+			instanceType: config.LXDImageContainer,
+			errString:    "invalid memory limit",
+		},
+		{
+			name:         "invalid root disk size",
+			specs:        extraSpecs{RootDiskSize: "20XB"},
+			instanceType: config.LXDImageContainer,
+			errString:    "invalid root disk size",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ret, err := getResourceLimits(tt.specs, tt.instanceType)
+			if tt.errString != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.errString)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, ret)
+		})
+	}
+}
+
+func TestGetRootDiskDevice(t *testing.T) {
+	cli := new(MockLXDServer)
+	cli.On("GetProfile", "default").Return(&api.Profile{
+		Devices: map[string]map[string]string{
+			"root": {"type": "disk", "path": "/", "pool": "default"},
+			"eth0": {"type": "nic", "network": "lxdbr0"},
+		},
+	}, "", nil)
+	cli.On("GetProfile", "fast").Return(&api.Profile{
+		Devices: map[string]map[string]string{
+			"rootfs": {"type": "disk", "path": "/", "pool": "nvme"},
+		},
+	}, "", nil)
+	cli.On("GetProfile", "nodisk").Return(&api.Profile{}, "", nil)
+	cli.On("GetProfile", "missing").Return((*api.Profile)(nil), "", fmt.Errorf("not found"))
+
+	name, device, err := getRootDiskDevice(cli, []string{"default", "fast"}, nil, "20GiB")
+	require.NoError(t, err)
+	assert.Equal(t, "rootfs", name)
+	assert.Equal(t, map[string]string{"type": "disk", "path": "/", "pool": "nvme", "size": "20GiB"}, device)
+
+	name, device, err = getRootDiskDevice(cli, []string{"default", "nodisk"}, nil, "10GiB")
+	require.NoError(t, err)
+	assert.Equal(t, "root", name)
+	assert.Equal(t, map[string]string{"type": "disk", "path": "/", "pool": "default", "size": "10GiB"}, device)
+
+	_, _, err = getRootDiskDevice(cli, []string{"nodisk"}, nil, "10GiB")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no root disk device found")
+
+	_, _, err = getRootDiskDevice(cli, []string{"missing"}, nil, "10GiB")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "fetching profile missing")
+}
@@ -7,12 +7,18 @@ package provider
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"maps"
+	"os"
+	"strings"
 	"sync"
 	"time"
 
 	runnerErrors "github.com/cloudbase/garm-provider-common/errors"
-	execution "github.com/cloudbase/garm-provider-common/execution/v0.1.0"
+	commonExecution "github.com/cloudbase/garm-provider-common/execution/common"
+	execution "github.com/cloudbase/garm-provider-common/execution/v0.1.1"
 	"github.com/cloudbase/garm-provider-lxd/config"
 
 	lxd "github.com/canonical/lxd/client"
@@ -43,25 +49,42 @@ const (
 	// architecture a runner is supposed to have. This value is defined in the pool and
 	// passed into the provider as bootstrap params.
 	osArchKeyNAme = "user.os-arch"
+
+	// imageFingerprintKey is the key we use in the instance config to record the
+	// fingerprint of the image the instance was created from, when it is known.
+	imageFingerprintKey = "user.image-fingerprint"
 )
 
 var (
 	configToLXDArchMap map[commonParams.OSArch]string = map[commonParams.OSArch]string{
 		commonParams.Amd64: "x86_64",
+		commonParams.I386:  "i686",
 		commonParams.Arm64: "aarch64",
 		commonParams.Arm:   "armv7l",
 	}
 
 	lxdToConfigArch map[string]commonParams.OSArch = map[string]commonParams.OSArch{
 		"x86_64":  commonParams.Amd64,
+		"i686":    commonParams.I386,
 		"aarch64": commonParams.Arm64,
 		"armv7l":  commonParams.Arm,
 	}
 )
 
+// unknownArchitecture is reported for instances of an architecture LXD doesn't know.
+const unknownArchitecture commonParams.OSArch = "unknown"
+
 const (
 	DefaultProjectDescription = "This project was created automatically by garm to be used for github ephemeral action runners."
 	DefaultProjectName        = "garm-project"
+
+	// instanceCleanupTimeout is the time we allow for an instance that failed
+	// to come up to be stopped and removed.
+	instanceCleanupTimeout = 3 * time.Minute
+
+	// instanceReadyPollInterval is the interval at which we check if a new instance
+	// is ready, in between events.
+	instanceReadyPollInterval = 2 * time.Second
 )
 
 type ToolFetchFunc func(osType commonParams.OSType, osArch commonParams.OSArch, tools []commonParams.RunnerApplicationDownload) (commonParams.RunnerApplicationDownload, error)
@@ -86,11 +109,16 @@ func NewLXDProvider(configFile, controllerID string) (execution.ExternalProvider
 		return nil, fmt.Errorf("no image remotes configured")
 	}
 
+	if len(cfg.Endpoints) > 0 {
+		return newLXDEndpoints(cfg, controllerID), nil
+	}
+
 	provider := &LXD{
 		cfg:          cfg,
 		controllerID: controllerID,
 		imageManager: &image{
 			remotes: cfg.ImageRemotes,
+			cache:   cfg.ImageCache,
 		},
 	}
 
@@ -100,14 +128,40 @@ func NewLXDProvider(configFile, controllerID string) (execution.ExternalProvider
 type InstanceServerInterface interface {
 	GetImageAliasArchitectures(string, string) (map[string]*api.ImageAliasesEntry, error)
 	GetImage(fingerprint string) (*api.Image, string, error)
+	CreateImage(image api.ImagesPost, args *lxd.ImageCreateArgs) (lxd.Operation, error)
+	RefreshImage(fingerprint string) (lxd.Operation, error)
+	GetImages() ([]api.Image, error)
+	DeleteImage(fingerprint string) (lxd.Operation, error)
+	GetImageAlias(name string) (*api.ImageAliasesEntry, string, error)
+	CreateImageAlias(alias api.ImageAliasesPost) error
+	UpdateImageAlias(name string, alias api.ImageAliasesEntryPut, ETag string) error
+	GetServer() (*api.Server, string, error)
 	GetProject(name string) (*api.Project, string, error)
 	UseProject(name string) lxd.InstanceServer
 	GetProfileNames() ([]string, error)
+	GetProfile(name string) (*api.Profile, string, error)
+	GetInstance(name string) (*api.Instance, string, error)
+	GetInstanceSnapshot(instanceName string, name string) (*api.InstanceSnapshot, string, error)
+	UpdateInstance(name string, instance api.InstancePut, ETag string) (lxd.Operation, error)
+	RenameInstance(name string, instance api.InstancePost) (lxd.Operation, error)
+	GetServerResources() (*api.Resources, error)
+	IsClustered() bool
+	UseTarget(name string) lxd.InstanceServer
+	GetClusterMembers() ([]api.ClusterMember, error)
+	CreateProject(project api.ProjectsPost) error
+	UpdateProject(name string, project api.ProjectPut, ETag string) error
+	CreateProfile(profile api.ProfilesPost) error
+	UpdateProfile(name string, profile api.ProfilePut, ETag string) (lxd.Operation, error)
 	CreateInstance(instance api.InstancesPost) (lxd.Operation, error)
 	UpdateInstanceState(name string, state api.InstanceStatePut, ETag string) (lxd.Operation, error)
 	GetInstanceFull(name string) (*api.InstanceFull, string, error)
 	DeleteInstance(name string, force bool) (lxd.Operation, error)
 	GetInstancesFull(args lxd.GetInstancesFullArgs) ([]api.InstanceFull, error)
+	GetInstanceConsoleLog(instanceName string, args *lxd.InstanceConsoleLogArgs) (io.ReadCloser, error)
+	GetInstanceFile(instanceName string, path string) (io.ReadCloser, *lxd.InstanceFileResponse, error)
+	CreateInstanceFile(instanceName string, path string, args lxd.InstanceFileArgs) error
+	GetEvents() (*lxd.EventListener, error)
+	ExecInstance(instanceName string, exec api.InstanceExecPost, args *lxd.InstanceExecArgs) (lxd.Operation, error)
 }
 
 type LXD struct {
@@ -115,10 +169,16 @@ type LXD struct {
 	cfg *config.LXD
 	// cli is the LXD client.
 	cli InstanceServerInterface
+	// projectClients holds the clients for the allowed projects pools can
+	// use instead of the default project, indexed by project name.
+	projectClients map[string]InstanceServerInterface
 	// imageManager downloads images from remotes
 	imageManager *image
 	// controllerID is the ID of this controller
 	controllerID string
+	// server is the server info of the LXD server. It is fetched once, and shared by
+	// the clients of all projects.
+	server *api.Server
 
 	mux sync.Mutex
 }
@@ -135,17 +195,36 @@ func (l *LXD) getCLI(ctx context.Context) (InstanceServerInterface, error) {
 		return nil, errors.Wrap(err, "creating LXD client")
 	}
 
-	_, _, err = cli.GetProject(projectName(l.cfg))
-	if err != nil {
-		return nil, errors.Wrapf(err, "fetching project name: %s", projectName(l.cfg))
+	if err := l.ensureProject(cli, projectName(l.cfg)); err != nil {
+		return nil, err
 	}
 	cli = cli.UseProject(projectName(l.cfg))
+	if err := l.ensureProfiles(cli); err != nil {
+		return nil, errors.Wrap(err, "setting up profiles")
+	}
 	l.cli = cli
 
 	return cli, nil
 }
 
-func (l *LXD) getProfiles(ctx context.Context, flavor string) ([]string, error) {
+// getServer returns the server info of the LXD server. Clients are created without
+// fetching it, so we fetch it the first time it is needed.
+func (l *LXD) getServer(cli InstanceServerInterface) (*api.Server, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if l.server != nil {
+		return l.server, nil
+	}
+	server, _, err := cli.GetServer()
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching server info")
+	}
+	l.server = server
+	return server, nil
+}
+
+func (l *LXD) getProfiles(ctx context.Context, project, flavor string) ([]string, error) {
 	ret := []string{}
 	if l.cfg.IncludeDefaultProfile {
 		ret = append(ret, "default")
@@ -153,7 +232,7 @@ func (l *LXD) getProfiles(ctx context.Context, flavor string) ([]string, error)
 
 	set := map[string]struct{}{}
 
-	cli, err := l.getCLI(ctx)
+	cli, err := l.getProjectCLI(ctx, project)
 	if err != nil {
 		return nil, errors.Wrap(err, "fetching client")
 	}
@@ -166,6 +245,15 @@ func (l *LXD) getProfiles(ctx context.Context, flavor string) ([]string, error)
 		set[profile] = struct{}{}
 	}
 
+	if _, ok := l.cfg.Flavors[flavor]; ok {
+		// Declared flavors are applied to the instance directly, so no profile is
+		// needed. A profile with the same name would be ambiguous.
+		if _, exists := set[flavor]; exists {
+			return nil, runnerErrors.NewBadRequestError("flavor %s is declared in the provider config and also exists as a profile", flavor)
+		}
+		return ret, nil
+	}
+
 	if _, ok := set[flavor]; !ok {
 		return nil, errors.Wrapf(runnerErrors.ErrNotFound, "looking for profile %s", flavor)
 	}
@@ -175,60 +263,209 @@ func (l *LXD) getProfiles(ctx context.Context, flavor string) ([]string, error)
 }
 
 // sadly, the security.secureboot flag is a string encoded boolean.
-func (l *LXD) secureBootEnabled() string {
-	if l.cfg.SecureBoot {
+func (l *LXD) secureBootEnabled(specs extraSpecs) string {
+	secureBoot := l.cfg.SecureBoot
+	if specs.SecureBoot != nil {
+		secureBoot = *specs.SecureBoot
+	}
+	if secureBoot {
 		return "uefi-secureboot"
 	}
 	return "uefi-nosecureboot"
 }
 
-func (l *LXD) getCreateInstanceArgs(ctx context.Context, bootstrapParams commonParams.BootstrapInstance, specs extraSpecs) (api.InstancesPost, error) {
-	if bootstrapParams.Name == "" {
-		return api.InstancesPost{}, runnerErrors.NewBadRequestError("missing name")
+// getInstanceType returns the instance type a pool uses. The extra specs of
+// the pool take precedence over the provider config.
+func getInstanceType(cfg *config.LXD, specs extraSpecs) config.LXDImageType {
+	if specs.InstanceType != "" {
+		return specs.InstanceType
 	}
-	profiles, err := l.getProfiles(ctx, bootstrapParams.Flavor)
+	return cfg.GetInstanceType()
+}
+
+func (l *LXD) getCreateInstanceArgs(ctx context.Context, bootstrapParams commonParams.BootstrapInstance, specs extraSpecs) (api.InstancesPost, error) {
+	args, err := l.getInstanceArgs(ctx, bootstrapParams, specs)
 	if err != nil {
-		return api.InstancesPost{}, errors.Wrap(err, "fetching profiles")
+		return api.InstancesPost{}, err
 	}
 
-	arch, err := resolveArchitecture(bootstrapParams.OSArch)
+	cli, err := l.getProjectCLI(ctx, specs.Project)
 	if err != nil {
-		return api.InstancesPost{}, errors.Wrap(err, "fetching archictecture")
+		return api.InstancesPost{}, errors.Wrap(err, "fetching client")
 	}
 
-	instanceType := l.cfg.GetInstanceType()
-	instanceSource, err := l.imageManager.getInstanceSource(bootstrapParams.Image, instanceType, arch, l.cli)
+	bootstrapConfig, err := l.getBootstrapConfig(cli, bootstrapParams, specs, args.Source.Type == api.SourceTypeCopy)
 	if err != nil {
-		return api.InstancesPost{}, errors.Wrap(err, "getting instance source")
+		return api.InstancesPost{}, err
 	}
+	maps.Copy(args.Config, bootstrapConfig)
+	return args, nil
+}
 
+// getBootstrapConfig returns the instance config that bootstraps the runner: the
+// user-data, the SSH keys and CA bundle that give access to the instance, and the
+// vendor-data from the provider config and the extra specs.
+func (l *LXD) getBootstrapConfig(cli InstanceServerInterface, bootstrapParams commonParams.BootstrapInstance, specs extraSpecs, fromCopy bool) (map[string]string, error) {
 	tools, err := DefaultToolFetch(bootstrapParams.OSType, bootstrapParams.OSArch, bootstrapParams.Tools)
 	if err != nil {
-		return api.InstancesPost{}, errors.Wrap(err, "getting tools")
+		return nil, errors.Wrap(err, "getting tools")
 	}
 
 	bootstrapParams.UserDataOptions.DisableUpdatesOnBoot = specs.DisableUpdates
 	bootstrapParams.UserDataOptions.ExtraPackages = specs.ExtraPackages
 	bootstrapParams.UserDataOptions.EnableBootDebug = specs.EnableBootDebug
+	if fromCopy {
+		// Golden instances come with their packages installed and up to date, so
+		// cloud-init only needs to install and register the runner.
+		bootstrapParams.UserDataOptions.DisableUpdatesOnBoot = true
+		bootstrapParams.UserDataOptions.ExtraPackages = nil
+	}
 	cloudCfg, err := DefaultGetCloudconfig(bootstrapParams, tools, bootstrapParams.Name)
 	if err != nil {
-		return api.InstancesPost{}, errors.Wrap(err, "generating cloud-config")
+		return nil, errors.Wrap(err, "generating cloud-config")
+	}
+
+	server, err := l.getServer(cli)
+	if err != nil {
+		return nil, err
 	}
 
+	configMap := map[string]string{}
 	if bootstrapParams.OSType == commonParams.Windows {
-		cloudCfg = fmt.Sprintf("#ps1_sysnative\n%s", cloudCfg)
+		cloudCfg, err = getWindowsBootstrapScript(bootstrapParams, cloudCfg)
+		if err != nil {
+			return nil, errors.Wrap(err, "generating windows bootstrap script")
+		}
+	} else {
+		vendorData, err := l.getVendorData(specs)
+		if err != nil {
+			return nil, err
+		}
+		accessConfig, err := getLinuxAccessConfig(server, bootstrapParams, vendorData...)
+		if err != nil {
+			return nil, errors.Wrap(err, "generating access config")
+		}
+		maps.Copy(configMap, accessConfig)
+	}
+	userDataKey, _ := getCloudInitKeys(server)
+	configMap[userDataKey] = cloudCfg
+	return configMap, nil
+}
+
+// getVendorData returns the vendor-data documents of the provider config and of the
+// extra specs, in the order they are merged.
+func (l *LXD) getVendorData(specs extraSpecs) ([]string, error) {
+	vendorData := []string{}
+	if l.cfg.VendorData != "" {
+		contents, err := os.ReadFile(l.cfg.VendorData)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading vendor data")
+		}
+		vendorData = append(vendorData, string(contents))
+	}
+	if specs.VendorData != "" {
+		vendorData = append(vendorData, specs.VendorData)
+	}
+	return vendorData, nil
+}
+
+// getInstanceArgs returns the arguments to create an instance for the pool, without
+// the config that bootstraps the runner.
+func (l *LXD) getInstanceArgs(ctx context.Context, bootstrapParams commonParams.BootstrapInstance, specs extraSpecs) (api.InstancesPost, error) {
+	if bootstrapParams.Name == "" {
+		return api.InstancesPost{}, runnerErrors.NewBadRequestError("missing name")
+	}
+	profiles, err := l.getProfiles(ctx, specs.Project, bootstrapParams.Flavor)
+	if err != nil {
+		return api.InstancesPost{}, errors.Wrap(err, "fetching profiles")
 	}
 
-	configMap := map[string]string{
-		"user.user-data":    cloudCfg,
-		osTypeKeyName:       string(bootstrapParams.OSType),
-		osArchKeyNAme:       string(bootstrapParams.OSArch),
-		controllerIDKeyName: l.controllerID,
-		poolIDKey:           bootstrapParams.PoolID,
+	arch, err := resolveArchitecture(bootstrapParams.OSArch)
+	if err != nil {
+		return api.InstancesPost{}, errors.Wrap(err, "fetching archictecture")
+	}
+
+	cli, err := l.getProjectCLI(ctx, specs.Project)
+	if err != nil {
+		return api.InstancesPost{}, errors.Wrap(err, "fetching client")
+	}
+
+	instanceType, err := getRunnerInstanceType(l.cfg, specs, bootstrapParams.OSType)
+	if err != nil {
+		return api.InstancesPost{}, err
+	}
+	server, err := l.getServer(cli)
+	if err != nil {
+		return api.InstancesPost{}, err
+	}
+	if err := validateServerArchitecture(server, instanceType, arch); err != nil {
+		return api.InstancesPost{}, errors.Wrap(err, "validating architecture")
+	}
+
+	instanceSource, err := l.imageManager.getInstanceSource(bootstrapParams.Image, instanceType, arch, cli)
+	if err != nil {
+		return api.InstancesPost{}, errors.Wrap(err, "getting instance source")
+	}
+
+	flavor := l.cfg.Flavors[bootstrapParams.Flavor]
+	configMap := map[string]string{}
+	for key, val := range flavor.Config {
+		configMap[key] = val
+	}
+	configMap[osTypeKeyName] = string(bootstrapParams.OSType)
+	configMap[osArchKeyNAme] = string(bootstrapParams.OSArch)
+	configMap[controllerIDKeyName] = l.controllerID
+	configMap[poolIDKey] = bootstrapParams.PoolID
+	if instanceSource.Fingerprint != "" {
+		configMap[imageFingerprintKey] = instanceSource.Fingerprint
+	}
+	if l.cfg.WarmPools[bootstrapParams.PoolID] > 0 {
+		template, err := newWarmTemplate(bootstrapParams)
+		if err != nil {
+			return api.InstancesPost{}, errors.Wrap(err, "recording warm pool template")
+		}
+		configMap[warmTemplateKey] = template
+	}
+
+	limits, err := getResourceLimits(specs, instanceType)
+	if err != nil {
+		return api.InstancesPost{}, errors.Wrap(err, "getting resource limits")
+	}
+	for key, val := range limits {
+		configMap[key] = val
 	}
 
 	if instanceType == config.LXDImageVirtualMachine {
-		configMap["boot.mode"] = l.secureBootEnabled()
+		configMap["boot.mode"] = l.secureBootEnabled(specs)
+	}
+
+	var devices map[string]map[string]string
+	if len(flavor.Devices) > 0 {
+		devices = make(map[string]map[string]string, len(flavor.Devices))
+		for name, device := range flavor.Devices {
+			devices[name] = maps.Clone(device)
+		}
+	}
+	if bootstrapParams.OSType == commonParams.Windows {
+		if devices == nil {
+			devices = map[string]map[string]string{}
+		}
+		for name, device := range getWindowsDevices(specs) {
+			if _, ok := devices[name]; !ok {
+				devices[name] = device
+			}
+		}
+	}
+
+	if specs.RootDiskSize != "" {
+		deviceName, rootDevice, err := getRootDiskDevice(cli, profiles, devices, specs.RootDiskSize)
+		if err != nil {
+			return api.InstancesPost{}, errors.Wrap(err, "getting root disk device")
+		}
+		if devices == nil {
+			devices = map[string]map[string]string{}
+		}
+		devices[deviceName] = rootDevice
 	}
 
 	args := api.InstancesPost{
@@ -237,6 +474,7 @@ func (l *LXD) getCreateInstanceArgs(ctx context.Context, bootstrapParams commonP
 			Profiles:     profiles,
 			Description:  "Github runner provisioned by garm",
 			Config:       configMap,
+			Devices:      devices,
 		},
 		Source: instanceSource,
 		Name:   bootstrapParams.Name,
@@ -245,21 +483,30 @@ func (l *LXD) getCreateInstanceArgs(ctx context.Context, bootstrapParams commonP
 	return args, nil
 }
 
-func (l *LXD) launchInstance(ctx context.Context, createArgs api.InstancesPost) error {
-	cli, err := l.getCLI(ctx)
+// launchInstance creates and starts the instance. If a target cluster member is set,
+// the instance is created on that member.
+func (l *LXD) launchInstance(ctx context.Context, project, target string, createArgs api.InstancesPost) error {
+	cli, err := l.getProjectCLI(ctx, project)
 	if err != nil {
 		return errors.Wrap(err, "fetching client")
 	}
+
+	createCLI := cli
+	if target != "" {
+		createCLI = cli.UseTarget(target)
+	}
 	// Get LXD to create the instance (background operation)
-	op, err := cli.CreateInstance(createArgs)
+	op, err := createCLI.CreateInstance(createArgs)
 	if err != nil {
 		return errors.Wrap(err, "creating instance")
 	}
 
+	// From this point on, the instance may exist in LXD. Any failure will
+	// trigger a cleanup, so we don't leave broken instances behind.
 	// Wait for the operation to complete
 	err = op.Wait()
 	if err != nil {
-		return errors.Wrap(err, "waiting for instance creation")
+		return l.rollbackInstance(createArgs.Name, errors.Wrap(err, "waiting for instance creation"))
 	}
 
 	// Get LXD to start the instance (background operation)
@@ -270,35 +517,95 @@ func (l *LXD) launchInstance(ctx context.Context, createArgs api.InstancesPost)
 
 	op, err = cli.UpdateInstanceState(createArgs.Name, reqState, "")
 	if err != nil {
-		return errors.Wrap(err, "starting instance")
+		return l.rollbackInstance(createArgs.Name, errors.Wrap(err, "starting instance"))
 	}
 
 	// Wait for the operation to complete
 	err = op.Wait()
 	if err != nil {
-		return errors.Wrap(err, "waiting for instance to start")
+		return l.rollbackInstance(createArgs.Name, errors.Wrap(err, "waiting for instance to start"))
 	}
 	return nil
 }
 
+// rollbackInstance does a best effort removal of an instance that was created, but
+// failed to come up properly. The cleanup uses its own timeout, as the context of the
+// caller may already be canceled. The original error is returned with the outcome of
+// the cleanup attached.
+//
+// Before removing the instance, we collect any diagnostics we can from it, and
+// attach them to the returned error.
+func (l *LXD) rollbackInstance(instanceName string, cause error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), instanceCleanupTimeout)
+	defer cancel()
+
+	fault := l.getProviderFault(ctx, instanceName, cause)
+	if err := l.DeleteInstance(ctx, instanceName); err != nil {
+		return &providerFaultError{
+			err:   fmt.Errorf("%w (failed to clean up instance %s: %s)", cause, instanceName, err),
+			fault: fault,
+		}
+	}
+	return &providerFaultError{
+		err:   fmt.Errorf("%w (instance %s was removed)", cause, instanceName),
+		fault: fault,
+	}
+}
+
 // CreateInstance creates a new compute instance in the provider.
 func (l *LXD) CreateInstance(ctx context.Context, bootstrapParams commonParams.BootstrapInstance) (commonParams.ProviderInstance, error) {
 	extraSpecs, err := parseExtraSpecsFromBootstrapParams(bootstrapParams)
 	if err != nil {
 		return commonParams.ProviderInstance{}, errors.Wrap(err, "parsing extra specs")
 	}
-	args, err := l.getCreateInstanceArgs(ctx, bootstrapParams, extraSpecs)
+
+	claimed, err := l.claimWarmInstance(ctx, bootstrapParams, extraSpecs)
 	if err != nil {
-		return commonParams.ProviderInstance{}, errors.Wrap(err, "fetching create args")
+		if !claimed {
+			return commonParams.ProviderInstance{}, errors.Wrap(err, "looking for a warm instance")
+		}
+		return instanceFromFault(bootstrapParams.Name, err), errors.Wrap(err, "starting warm instance")
 	}
 
-	if err := l.launchInstance(ctx, args); err != nil {
-		return commonParams.ProviderInstance{}, errors.Wrap(err, "creating instance")
+	if !claimed {
+		args, err := l.getCreateInstanceArgs(ctx, bootstrapParams, extraSpecs)
+		if err != nil {
+			return commonParams.ProviderInstance{}, errors.Wrap(err, "fetching create args")
+		}
+
+		cli, err := l.getProjectCLI(ctx, extraSpecs.Project)
+		if err != nil {
+			return commonParams.ProviderInstance{}, errors.Wrap(err, "fetching client")
+		}
+		target, err := l.selectClusterMember(ctx, cli, extraSpecs.Target, bootstrapParams.PoolID)
+		if err != nil {
+			return commonParams.ProviderInstance{}, errors.Wrap(err, "selecting cluster member")
+		}
+
+		if err := l.launchInstance(ctx, extraSpecs.Project, target, args); err != nil {
+			return instanceFromFault(args.Name, err), errors.Wrap(err, "creating instance")
+		}
 	}
 
-	ret, err := l.waitInstanceHasIP(ctx, args.Name)
+	readiness := getRunnerReadiness(l.cfg, extraSpecs, bootstrapParams.OSType)
+	ret, err := l.waitInstanceReady(ctx, bootstrapParams.Name, readiness)
 	if err != nil {
-		return commonParams.ProviderInstance{}, errors.Wrap(err, "fetching instance")
+		err = l.rollbackInstance(bootstrapParams.Name, errors.Wrap(err, "fetching instance"))
+		return instanceFromFault(bootstrapParams.Name, err), err
+	}
+
+	if err := l.removeUserData(ctx, bootstrapParams.Name, bootstrapParams.OSType, readiness); err != nil {
+		err = l.rollbackInstance(bootstrapParams.Name, errors.Wrap(err, "removing user-data"))
+		return instanceFromFault(bootstrapParams.Name, err), err
+	}
+
+	if bootstrapParams.OSType == commonParams.Windows && ret.OSName == "" {
+		// Windows images don't set image.os, so we ask the guest. This is best effort,
+		// the runner works without it.
+		if osName, osVersion, err := l.recordGuestOS(ctx, bootstrapParams.Name); err == nil {
+			ret.OSName = strings.ToLower(osName)
+			ret.OSVersion = osVersion
+		}
 	}
 
 	return ret, nil
@@ -306,7 +613,7 @@ func (l *LXD) CreateInstance(ctx context.Context, bootstrapParams commonParams.B
 
 // GetInstance will return details about one instance.
 func (l *LXD) GetInstance(ctx context.Context, instanceName string) (commonParams.ProviderInstance, error) {
-	cli, err := l.getCLI(ctx)
+	cli, err := l.getInstanceCLI(ctx, instanceName)
 	if err != nil {
 		return commonParams.ProviderInstance{}, errors.Wrap(err, "fetching client")
 	}
@@ -318,17 +625,28 @@ func (l *LXD) GetInstance(ctx context.Context, instanceName string) (commonParam
 		return commonParams.ProviderInstance{}, errors.Wrap(err, "fetching instance")
 	}
 
-	return lxdInstanceToAPIInstance(instance), nil
+	ret := lxdInstanceToAPIInstance(instance)
+	if ret.Status == commonParams.InstanceError {
+		ret.ProviderFault = l.getProviderFault(ctx, instanceName, fmt.Errorf("instance %s is in state %s", instanceName, instance.State.Status))
+	}
+	return ret, nil
 }
 
 // Delete instance will delete the instance in a provider.
 func (l *LXD) DeleteInstance(ctx context.Context, instance string) error {
-	cli, err := l.getCLI(ctx)
+	cli, err := l.getInstanceCLI(ctx, instance)
 	if err != nil {
+		if errors.Is(err, runnerErrors.ErrNotFound) {
+			return nil
+		}
 		return errors.Wrap(err, "fetching client")
 	}
 
-	if err := l.setState(ctx, instance, "stop", true); err != nil {
+	// Windows runners get a chance to shut down cleanly, before they are stopped.
+	if _, err := l.shutdownWindowsInstance(ctx, cli, instance); err != nil && isNotFoundError(err) {
+		return nil
+	}
+	if err := l.setState(ctx, cli, instance, "stop", true); err != nil {
 		if isNotFoundError(err) {
 			return nil
 		}
@@ -340,10 +658,12 @@ func (l *LXD) DeleteInstance(ctx context.Context, instance string) error {
 		}
 	}
 
+	// The channel is buffered, so the goroutine doesn't block forever if we stop
+	// waiting for it on timeout or cancellation.
 	opResponse := make(chan struct {
 		op  lxd.Operation
 		err error
-	})
+	}, 1)
 	var op lxd.Operation
 	go func() {
 		op, err := cli.DeleteInstance(instance, false)
@@ -364,9 +684,11 @@ func (l *LXD) DeleteInstance(ctx context.Context, instance string) error {
 		op = resp.op
 	case <-time.After(time.Second * 60):
 		return errors.Wrapf(runnerErrors.ErrTimeout, "removing instance %s", instance)
+	case <-ctx.Done():
+		return errors.Wrapf(ctx.Err(), "removing instance %s", instance)
 	}
 
-	opTimeout, cancel := context.WithTimeout(context.Background(), time.Second*60)
+	opTimeout, cancel := context.WithTimeout(ctx, time.Second*60)
 	defer cancel()
 	err = op.WaitContext(opTimeout)
 	if err != nil {
@@ -384,12 +706,57 @@ type listResponse struct {
 }
 
 // ListInstances will list all instances for a provider.
+// Instances are listed from the default project, as well as from all allowed projects.
 func (l *LXD) ListInstances(ctx context.Context, poolID string) ([]commonParams.ProviderInstance, error) {
-	cli, err := l.getCLI(ctx)
+	instances, err := l.listInstances(ctx, poolID)
 	if err != nil {
-		return []commonParams.ProviderInstance{}, errors.Wrap(err, "fetching client")
+		return []commonParams.ProviderInstance{}, err
 	}
 
+	ret := []commonParams.ProviderInstance{}
+	for _, instance := range instances {
+		if isWarmInstance(&instance) {
+			// Warm instances are not runners yet, so GARM must not see them.
+			continue
+		}
+		ret = append(ret, lxdInstanceToAPIInstance(&instance))
+	}
+	return ret, nil
+}
+
+// listInstances returns the instances created by this controller. If poolID is set,
+// only instances of that pool are returned.
+func (l *LXD) listInstances(ctx context.Context, poolID string) ([]api.InstanceFull, error) {
+	ret := []api.InstanceFull{}
+	for _, project := range managedProjects(l.cfg) {
+		cli, err := l.getProjectCLI(ctx, project)
+		if err != nil {
+			return nil, errors.Wrapf(err, "fetching client for project %s", project)
+		}
+
+		instances, err := listProjectInstances(cli)
+		if err != nil {
+			return nil, errors.Wrapf(err, "listing instances in project %s", project)
+		}
+
+		for _, instance := range instances {
+			if id, ok := instance.ExpandedConfig[controllerIDKeyName]; ok && id == l.controllerID {
+				if poolID != "" {
+					id := instance.ExpandedConfig[poolIDKey]
+					if id != poolID {
+						// Pool ID was specified. Filter out instances belonging to other pools.
+						continue
+					}
+				}
+				ret = append(ret, instance)
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+func listProjectInstances(cli InstanceServerInterface) ([]api.InstanceFull, error) {
 	result := make(chan listResponse, 1)
 
 	go func() {
@@ -405,38 +772,21 @@ func (l *LXD) ListInstances(ctx context.Context, poolID string) ([]commonParams.
 		}
 	}()
 
-	var instances []api.InstanceFull
 	select {
 	case res := <-result:
 		if res.err != nil {
-			return []commonParams.ProviderInstance{}, errors.Wrap(res.err, "fetching instances")
+			return nil, errors.Wrap(res.err, "fetching instances")
 		}
-		instances = res.instances
+		return res.instances, nil
 	case <-time.After(time.Second * 60):
-		return []commonParams.ProviderInstance{}, errors.Wrap(runnerErrors.ErrTimeout, "fetching instances from provider")
-	}
-
-	ret := []commonParams.ProviderInstance{}
-
-	for _, instance := range instances {
-		if id, ok := instance.ExpandedConfig[controllerIDKeyName]; ok && id == l.controllerID {
-			if poolID != "" {
-				id := instance.ExpandedConfig[poolIDKey]
-				if id != poolID {
-					// Pool ID was specified. Filter out instances belonging to other pools.
-					continue
-				}
-			}
-			ret = append(ret, lxdInstanceToAPIInstance(&instance))
-		}
+		return nil, errors.Wrap(runnerErrors.ErrTimeout, "fetching instances from provider")
 	}
-
-	return ret, nil
 }
 
-// RemoveAllInstances will remove all instances created by this provider.
+// RemoveAllInstances will remove all instances created by this provider, including
+// warm instances.
 func (l *LXD) RemoveAllInstances(ctx context.Context) error {
-	instances, err := l.ListInstances(ctx, "")
+	instances, err := l.listInstances(ctx, "")
 	if err != nil {
 		return errors.Wrap(err, "fetching instance list")
 	}
@@ -451,23 +801,18 @@ func (l *LXD) RemoveAllInstances(ctx context.Context) error {
 	return nil
 }
 
-func (l *LXD) setState(ctx context.Context, instance, state string, force bool) error {
+func (l *LXD) setState(ctx context.Context, cli InstanceServerInterface, instance, state string, force bool) error {
 	reqState := api.InstanceStatePut{
 		Action:  state,
 		Timeout: -1,
 		Force:   force,
 	}
 
-	cli, err := l.getCLI(ctx)
-	if err != nil {
-		return errors.Wrap(err, "fetching client")
-	}
-
 	op, err := cli.UpdateInstanceState(instance, reqState, "")
 	if err != nil {
 		return errors.Wrapf(err, "setting state to %s", state)
 	}
-	ctxTimeout, cancel := context.WithTimeout(context.Background(), time.Second*60)
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*60)
 	defer cancel()
 	err = op.WaitContext(ctxTimeout)
 	if err != nil {
@@ -478,15 +823,109 @@ func (l *LXD) setState(ctx context.Context, instance, state string, force bool)
 
 // Stop shuts down the instance.
 func (l *LXD) Stop(ctx context.Context, instance string, force bool) error {
-	return l.setState(ctx, instance, "stop", force)
+	cli, err := l.getInstanceCLI(ctx, instance)
+	if err != nil {
+		return errors.Wrap(err, "fetching client")
+	}
+	if !force {
+		windows, err := l.shutdownWindowsInstance(ctx, cli, instance)
+		if windows && err == nil {
+			return nil
+		}
+		// Windows runners that don't shut down in time are forcefully stopped.
+		force = windows
+	}
+	return l.setState(ctx, cli, instance, "stop", force)
 }
 
 // Start boots up an instance.
 func (l *LXD) Start(ctx context.Context, instance string) error {
-	return l.setState(ctx, instance, "start", false)
+	cli, err := l.getInstanceCLI(ctx, instance)
+	if err != nil {
+		return errors.Wrap(err, "fetching client")
+	}
+	return l.setState(ctx, cli, instance, "start", false)
 }
 
 // GetVersion returns the interface version of the provider.
 func (l *LXD) GetVersion(ctx context.Context) string {
 	return Version
 }
+
+// GetSupportedInterfaceVersions will return the supported interface versions.
+func (l *LXD) GetSupportedInterfaceVersions(ctx context.Context) []string {
+	return []string{
+		commonExecution.Version010,
+		commonExecution.Version011,
+	}
+}
+
+// ValidatePoolInfo will validate the pool info and return an error if it's not valid.
+// The flavor must be an existing profile, the image must be resolvable either through
+// a configured remote or as a local alias and the extra specs must match our schema and
+// request resource limits that are supported by the instance type of the pool. Profiles
+// and images are looked up in the project the pool uses.
+func (l *LXD) ValidatePoolInfo(ctx context.Context, image string, flavor string, _ string, extraspecs string) error {
+	var specs extraSpecs
+	if extraspecs != "" {
+		if err := jsonSchemaValidation(json.RawMessage(extraspecs)); err != nil {
+			return runnerErrors.NewBadRequestError("invalid extra specs: %s", err)
+		}
+		if err := json.Unmarshal([]byte(extraspecs), &specs); err != nil {
+			return runnerErrors.NewBadRequestError("invalid extra specs: %s", err)
+		}
+	}
+
+	instanceType := getInstanceType(l.cfg, specs)
+	if _, err := getResourceLimits(specs, instanceType); err != nil {
+		return errors.Wrap(err, "validating resource limits")
+	}
+
+	cli, err := l.getProjectCLI(ctx, specs.Project)
+	if err != nil {
+		return errors.Wrap(err, "fetching client")
+	}
+
+	if _, err := l.getProfiles(ctx, specs.Project, flavor); err != nil {
+		return errors.Wrap(err, "validating flavor")
+	}
+
+	server, err := l.getServer(cli)
+	if err != nil {
+		return err
+	}
+	if err := l.imageManager.validateImage(image, instanceType, cli, server); err != nil {
+		return errors.Wrap(err, "validating image")
+	}
+
+	if specs.Target != "" {
+		if _, err := clusterMembers(cli, specs.Target); err != nil {
+			return errors.Wrap(err, "validating target")
+		}
+	}
+
+	if specs.VendorData != "" {
+		if _, err := parseCloudConfig(specs.VendorData); err != nil {
+			return runnerErrors.NewBadRequestError("invalid vendor_data: %s", err)
+		}
+	}
+	return nil
+}
+
+// GetConfigJSONSchema will return the JSON schema for the provider's configuration.
+func (l *LXD) GetConfigJSONSchema(ctx context.Context) (string, error) {
+	schema, err := json.Marshal(generateConfigJSONSchema())
+	if err != nil {
+		return "", errors.Wrap(err, "marshaling config schema")
+	}
+	return string(schema), nil
+}
+
+// GetExtraSpecsJSONSchema will return the JSON schema for the provider's extra specs.
+func (l *LXD) GetExtraSpecsJSONSchema(ctx context.Context) (string, error) {
+	schema, err := json.Marshal(generateJSONSchema())
+	if err != nil {
+		return "", errors.Wrap(err, "marshaling extra specs schema")
+	}
+	return string(schema), nil
+}
@@ -7,6 +7,10 @@ package provider
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
 	"testing"
 
 	"github.com/cloudbase/garm-provider-lxd/config"
@@ -16,6 +20,9 @@ import (
 
 	lxd "github.com/canonical/lxd/client"
 	"github.com/canonical/lxd/shared/api"
+	runnerErrors "github.com/cloudbase/garm-provider-common/errors"
+	commonExecution "github.com/cloudbase/garm-provider-common/execution/common"
+	execution "github.com/cloudbase/garm-provider-common/execution/v0.1.1"
 	commonParams "github.com/cloudbase/garm-provider-common/params"
 )
 
@@ -65,11 +72,117 @@ func TestGetProfiles(t *testing.T) {
 	expected := []string{"default", "project"}
 	cli.On("GetProfileNames").Return(expected, nil)
 
-	ret, err := l.getProfiles(ctx, "project")
+	ret, err := l.getProfiles(ctx, "", "project")
 	require.NoError(t, err)
 	assert.Equal(t, expected, ret)
 }
 
+func TestGetProfilesDeclaredFlavor(t *testing.T) {
+	ctx := context.Background()
+	cli := new(MockLXDServer)
+	l := &LXD{
+		cfg: &config.LXD{
+			UnixSocket:            "/var/snap/lxd/common/lxd/unix.socket",
+			IncludeDefaultProfile: true,
+			Flavors: map[string]config.LXDFlavor{
+				"small":   {Config: map[string]string{"limits.cpu": "2"}},
+				"project": {Config: map[string]string{"limits.cpu": "4"}},
+			},
+		},
+		cli:          cli,
+		imageManager: &image{},
+		controllerID: "controller",
+	}
+	cli.On("GetProfileNames").Return([]string{"default", "project"}, nil)
+
+	ret, err := l.getProfiles(ctx, "", "small")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"default"}, ret)
+
+	_, err = l.getProfiles(ctx, "", "project")
+	require.Error(t, err)
+	assert.ErrorIs(t, err, runnerErrors.ErrBadRequest)
+	assert.Contains(t, err.Error(), "flavor project is declared in the provider config and also exists as a profile")
+}
+
+func TestGetCreateInstanceArgsDeclaredFlavor(t *testing.T) {
+	ctx := context.Background()
+	cli := new(MockLXDServer)
+	l := &LXD{
+		cfg: &config.LXD{
+			UnixSocket:   "/var/snap/lxd/common/lxd/unix.socket",
+			InstanceType: config.LXDImageContainer,
+			Flavors: map[string]config.LXDFlavor{
+				"small": {
+					Config: map[string]string{
+						"limits.cpu":     "2",
+						"limits.memory":  "2GiB",
+						"user.user-data": "overridden",
+					},
+					Devices: map[string]map[string]string{
+						"eth0": {"type": "nic", "network": "lxdbr0", "name": "eth0"},
+						"root": {"type": "disk", "path": "/", "pool": "default"},
+					},
+				},
+			},
+		},
+		cli:          cli,
+		imageManager: &image{},
+		controllerID: "controller",
+	}
+
+	DefaultToolFetch = func(_ commonParams.OSType, _ commonParams.OSArch, tools []commonParams.RunnerApplicationDownload) (commonParams.RunnerApplicationDownload, error) {
+		return tools[0], nil
+	}
+	DefaultGetCloudconfig = func(_ commonParams.BootstrapInstance, _ commonParams.RunnerApplicationDownload, _ string) (string, error) {
+		return "#cloud-config", nil
+	}
+
+	aliases := map[string]*api.ImageAliasesEntry{
+		"x86_64": {
+			Name: "ubuntu",
+			Type: config.LXDImageContainer.String(),
+		},
+	}
+	cli.On("GetProfileNames").Return([]string{"default"}, nil)
+	cli.On("GetImageAliasArchitectures", config.LXDImageContainer.String(), "ubuntu").Return(aliases, nil)
+	cli.On("GetImage", aliases["x86_64"].Target).Return(&api.Image{Fingerprint: "123abc"}, "", nil)
+	cli.On("GetServer").Return(&api.Server{
+		ServerUntrusted: api.ServerUntrusted{APIExtensions: []string{cloudInitConfigExtension}},
+		Environment:     api.ServerEnvironment{Architectures: []string{"x86_64", "i686"}},
+	}, "", nil)
+
+	bootstrapParams := commonParams.BootstrapInstance{
+		Name:   "runner",
+		Image:  "ubuntu",
+		Flavor: "small",
+		OSArch: commonParams.Amd64,
+		OSType: commonParams.Linux,
+		Tools: []commonParams.RunnerApplicationDownload{
+			{
+				OS:           ptr("linux"),
+				Architecture: ptr("x64"),
+				DownloadURL:  ptr("https://example.com"),
+				Filename:     ptr("test-app"),
+			},
+		},
+	}
+
+	// Resource limits in the extra specs win over the flavor.
+	args, err := l.getCreateInstanceArgs(ctx, bootstrapParams, extraSpecs{Memory: "4GiB", RootDiskSize: "20GiB"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{}, args.Profiles)
+	assert.Equal(t, "2", args.Config["limits.cpu"])
+	assert.Equal(t, "4GiB", args.Config["limits.memory"])
+	assert.Equal(t, "#cloud-config", args.Config[userDataKeyName])
+	assert.Equal(t, map[string]map[string]string{
+		"eth0": {"type": "nic", "network": "lxdbr0", "name": "eth0"},
+		"root": {"type": "disk", "path": "/", "pool": "default", "size": "20GiB"},
+	}, args.Devices)
+	// The flavor itself is left untouched.
+	assert.NotContains(t, l.cfg.Flavors["small"].Devices["root"], "size")
+}
+
 func TestGetCreateInstanceArgsContainer(t *testing.T) {
 	ctx := context.Background()
 	cli := new(MockLXDServer)
@@ -113,6 +226,10 @@ func TestGetCreateInstanceArgsContainer(t *testing.T) {
 	}
 	cli.On("GetImageAliasArchitectures", config.LXDImageType("container").String(), "ubuntu").Return(aliases, nil)
 	cli.On("GetImage", aliases["x86_64"].Target).Return(&api.Image{Fingerprint: "123abc"}, "", nil)
+	cli.On("GetServer").Return(&api.Server{
+		ServerUntrusted: api.ServerUntrusted{APIExtensions: []string{cloudInitConfigExtension}},
+		Environment:     api.ServerEnvironment{Architectures: []string{"x86_64", "i686"}},
+	}, "", nil)
 	cli.On("GetProfileNames").Return([]string{"default", "container"}, nil)
 	specs := extraSpecs{}
 	tests := []struct {
@@ -157,6 +274,21 @@ func TestGetCreateInstanceArgsContainer(t *testing.T) {
 			expected:  api.InstancesPost{},
 			errString: "architecture bad-arch is not supported",
 		},
+		{
+			name: "architecture not supported by the server",
+			bootstrapParams: commonParams.BootstrapInstance{
+				Name:    "test-instance",
+				Tools:   tools,
+				Image:   "ubuntu",
+				Flavor:  "container",
+				RepoURL: "mock-repo-url",
+				PoolID:  "default",
+				OSArch:  commonParams.Arm64,
+				OSType:  commonParams.Linux,
+			},
+			expected:  api.InstancesPost{},
+			errString: "architecture aarch64 is not supported by the LXD server (supported: x86_64, i686)",
+		},
 		{
 			name: "success container instance",
 			bootstrapParams: commonParams.BootstrapInstance{
@@ -176,11 +308,12 @@ func TestGetCreateInstanceArgsContainer(t *testing.T) {
 					Profiles:     []string{"default", "container"},
 					Description:  "Github runner provisioned by garm",
 					Config: map[string]string{
-						"user.user-data":    `#cloud-config`,
+						userDataKeyName:     `#cloud-config`,
 						osTypeKeyName:       "linux",
 						osArchKeyNAme:       "amd64",
 						controllerIDKeyName: "controller",
 						poolIDKey:           "default",
+						imageFingerprintKey: "123abc",
 					},
 				},
 				Source: api.InstanceSource{
@@ -249,6 +382,10 @@ func TestGetCreateInstanceArgsVM(t *testing.T) {
 	}
 	cli.On("GetImageAliasArchitectures", config.LXDImageType("virtual-machine").String(), "windows").Return(aliases, nil)
 	cli.On("GetImage", aliases["x86_64"].Target).Return(&api.Image{Fingerprint: "123abc"}, "", nil)
+	cli.On("GetServer").Return(&api.Server{
+		ServerUntrusted: api.ServerUntrusted{APIExtensions: []string{cloudInitConfigExtension}},
+		Environment:     api.ServerEnvironment{Architectures: []string{"x86_64", "i686"}},
+	}, "", nil)
 	cli.On("GetProfileNames").Return([]string{"default", "virtual-machine"}, nil)
 	specs := extraSpecs{}
 	tests := []struct {
@@ -282,13 +419,18 @@ func TestGetCreateInstanceArgsVM(t *testing.T) {
 					Profiles:     []string{"default", "virtual-machine"},
 					Description:  "Github runner provisioned by garm",
 					Config: map[string]string{
-						"user.user-data":    "#ps1_sysnative\n" + "#cloud-config",
+						userDataKeyName:     "#ps1_sysnative\n" + "#cloud-config",
 						osTypeKeyName:       "windows",
 						osArchKeyNAme:       "amd64",
 						controllerIDKeyName: "controller",
 						poolIDKey:           "default",
+						imageFingerprintKey: "123abc",
 						"boot.mode":         "uefi-nosecureboot",
 					},
+					Devices: map[string]map[string]string{
+						"cloud-init": {"type": "disk", "source": "cloud-init:config"},
+						"vtpm":       {"type": "tpm"},
+					},
 				},
 				Source: api.InstanceSource{
 					Type:        "image",
@@ -370,7 +512,7 @@ func TestLaunchInstance(t *testing.T) {
 		Timeout: -1,
 	}).Return(mockOp, nil)
 
-	err := l.launchInstance(ctx, createArgs)
+	err := l.launchInstance(ctx, "", "", createArgs)
 	require.NoError(t, err)
 }
 
@@ -440,6 +582,10 @@ func TestCreateInstance(t *testing.T) {
 	}
 	cli.On("GetImageAliasArchitectures", config.LXDImageType("virtual-machine").String(), "windows").Return(aliases, nil)
 	cli.On("GetImage", aliases["x86_64"].Target).Return(&api.Image{Fingerprint: "123abc"}, "", nil)
+	cli.On("GetServer").Return(&api.Server{
+		ServerUntrusted: api.ServerUntrusted{APIExtensions: []string{cloudInitConfigExtension}},
+		Environment:     api.ServerEnvironment{Architectures: []string{"x86_64", "i686"}},
+	}, "", nil)
 	cli.On("GetProfileNames").Return([]string{"default", "virtual-machine"}, nil)
 	mockOp := new(MockOperation)
 	mockOp.On("Wait").Return(nil)
@@ -448,6 +594,8 @@ func TestCreateInstance(t *testing.T) {
 		Action:  "start",
 		Timeout: -1,
 	}).Return(mockOp, nil)
+	cli.On("GetEvents").Return((*lxd.EventListener)(nil), fmt.Errorf("events not available"))
+	cli.On("IsClustered").Return(false)
 	cli.On("GetInstanceFull", "test-instance").Return(&api.InstanceFull{
 		Instance: api.Instance{
 			Name:         "test-instance",
@@ -472,10 +620,21 @@ func TestCreateInstance(t *testing.T) {
 			},
 		},
 	}, "", nil)
+	mockExec(cli, "test-instance", []string{"powershell.exe", "-NoProfile", "-NonInteractive", "-Command", fmt.Sprintf(cloudbaseInitUserDataStatusCommand, "test-instance")}, "1\r\n", 0)
+	cli.On("GetInstance", "test-instance").Return(&api.Instance{
+		Name:   "test-instance",
+		Config: map[string]string{userDataKeyName: "#ps1_sysnative\n#cloud-config"},
+	}, "etag", nil)
+	cli.On("UpdateInstance", "test-instance", api.InstancePut{
+		Config: map[string]string{userDataKeyName: userDataStub},
+	}, "etag").Return(mockOp, nil)
 
 	provider, err := l.CreateInstance(ctx, boostrapParams)
 	require.NoError(t, err)
 	assert.Equal(t, expectedOutput, provider)
+	cli.AssertCalled(t, "UpdateInstance", "test-instance", mock.Anything, "etag")
+	// The server info is fetched once, and reused by every check that needs it.
+	cli.AssertNumberOfCalls(t, "GetServer", 1)
 }
 
 func TestGetInstance(t *testing.T) {
@@ -569,6 +728,7 @@ func TestDeleteInstance(t *testing.T) {
 	mockOp := new(MockOperation)
 	mockOp.On("WaitContext", mock.Anything).Return(nil)
 	cli.On("DeleteInstance", instanceName, false).Return(mockOp, nil)
+	cli.On("GetInstance", instanceName).Return(&api.Instance{Name: instanceName}, "", nil)
 	cli.On("UpdateInstanceState", "test-instance", "", api.InstanceStatePut{
 		Action:  "stop",
 		Timeout: -1,
@@ -688,6 +848,7 @@ func TestRemoveAllInstances(t *testing.T) {
 	mockOp := new(MockOperation)
 	mockOp.On("WaitContext", mock.Anything).Return(nil)
 	cli.On("DeleteInstance", instanceName, false).Return(mockOp, nil)
+	cli.On("GetInstance", instanceName).Return(&api.Instance{Name: instanceName}, "", nil)
 	cli.On("UpdateInstanceState", "test-instance", "", api.InstanceStatePut{
 		Action:  "stop",
 		Timeout: -1,
@@ -742,3 +903,431 @@ func TestStart(t *testing.T) {
 	err := l.Start(ctx, instanceName)
 	require.NoError(t, err)
 }
+
+func TestGetSupportedInterfaceVersions(t *testing.T) {
+	l := &LXD{
+		cfg:          &config.LXD{},
+		imageManager: &image{},
+		controllerID: "controller",
+	}
+
+	versions := l.GetSupportedInterfaceVersions(context.Background())
+	assert.Equal(t, []string{"v0.1.0", "v0.1.1"}, versions)
+}
+
+func TestValidatePoolInfo(t *testing.T) {
+	ctx := context.Background()
+	cli := new(MockLXDServer)
+	l := &LXD{
+		cfg: &config.LXD{
+			InstanceType: config.LXDImageContainer,
+		},
+		cli: cli,
+		imageManager: &image{
+			remotes: map[string]config.LXDImageRemote{
+				"remote": {
+					Address: "mock-address",
+				},
+			},
+		},
+		controllerID: "controller",
+	}
+	cli.On("GetProfileNames").Return([]string{"default", "container"}, nil)
+	cli.On("GetImageAliasArchitectures", config.LXDImageContainer.String(), "ubuntu").Return(map[string]*api.ImageAliasesEntry{
+		"x86_64": {
+			Name: "ubuntu",
+			Type: "container",
+		},
+	}, nil)
+	cli.On("GetImageAliasArchitectures", config.LXDImageContainer.String(), "missing").Return(map[string]*api.ImageAliasesEntry{}, nil)
+	cli.On("GetImageAliasArchitectures", config.LXDImageContainer.String(), "ubuntu-s390x").Return(map[string]*api.ImageAliasesEntry{
+		"s390x": {
+			Name: "ubuntu-s390x",
+			Type: "container",
+		},
+	}, nil)
+	cli.On("GetServer").Return(&api.Server{
+		Environment: api.ServerEnvironment{Architectures: []string{"x86_64", "i686"}},
+	}, "", nil)
+
+	tests := []struct {
+		name       string
+		image      string
+		flavor     string
+		extraSpecs string
+		errString  string
+	}{
+		{
+			name:   "local image",
+			image:  "ubuntu",
+			flavor: "container",
+		},
+		{
+			name:       "remote image with extra specs",
+			image:      "remote:22.04",
+			flavor:     "container",
+			extraSpecs: `{"disable_updates": true}`,
+		},
+		{
+			name:       "invalid extra specs",
+			image:      "ubuntu",
+			flavor:     "container",
+			extraSpecs: `{"disable_updates": "true"}`,
+			errString:  "invalid extra specs",
+		},
+		{
+			name:       "invalid vendor data",
+			image:      "ubuntu",
+			flavor:     "container",
+			extraSpecs: `{"vendor_data": "ntp:\n  enabled: true"}`,
+			errString:  "invalid vendor_data: vendor data must start with #cloud-config",
+		},
+		{
+			name:      "missing profile",
+			image:     "ubuntu",
+			flavor:    "bad-flavor",
+			errString: "looking for profile bad-flavor",
+		},
+		{
+			name:      "missing local image",
+			image:     "missing",
+			flavor:    "container",
+			errString: "no image found for image type container with name missing",
+		},
+		{
+			name:      "image of an unsupported architecture",
+			image:     "ubuntu-s390x",
+			flavor:    "container",
+			errString: "image ubuntu-s390x is not available for any architecture supported by the LXD server (supported: x86_64, i686)",
+		},
+		{
+			name:      "unknown remote",
+			image:     "bogus:22.04",
+			flavor:    "container",
+			errString: "could not find bogus:22.04",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := l.ValidatePoolInfo(ctx, tt.image, tt.flavor, "", tt.extraSpecs)
+			if tt.errString != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.errString)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestGetConfigJSONSchema(t *testing.T) {
+	l := &LXD{
+		cfg:          &config.LXD{},
+		imageManager: &image{},
+		controllerID: "controller",
+	}
+
+	schema, err := l.GetConfigJSONSchema(context.Background())
+	require.NoError(t, err)
+	assert.Contains(t, schema, `"unix_socket_path"`)
+	assert.Contains(t, schema, `"image_remotes"`)
+	assert.NotContains(t, schema, `"required"`)
+}
+
+func TestGetExtraSpecsJSONSchema(t *testing.T) {
+	l := &LXD{
+		cfg:          &config.LXD{},
+		imageManager: &image{},
+		controllerID: "controller",
+	}
+
+	schema, err := l.GetExtraSpecsJSONSchema(context.Background())
+	require.NoError(t, err)
+	assert.Contains(t, schema, `"extra_packages"`)
+	assert.Contains(t, schema, `"disable_updates"`)
+}
+
+func TestCreateInstanceRollback(t *testing.T) {
+	ctx := context.Background()
+	boostrapParams := commonParams.BootstrapInstance{
+		Name: "test-instance",
+		Tools: []commonParams.RunnerApplicationDownload{
+			{
+				OS:           ptr("linux"),
+				Architecture: ptr("x86_64"),
+				DownloadURL:  ptr("https://example.com"),
+				Filename:     ptr("test-app"),
+			},
+		},
+		Image:   "ubuntu",
+		Flavor:  "container",
+		RepoURL: "mock-repo-url",
+		PoolID:  "default",
+		OSArch:  commonParams.Amd64,
+		OSType:  commonParams.Linux,
+	}
+	aliases := map[string]*api.ImageAliasesEntry{
+		"x86_64": {
+			Name: "ubuntu",
+			Type: "container",
+		},
+	}
+	startState := api.InstanceStatePut{
+		Action:  "start",
+		Timeout: -1,
+	}
+	stopState := api.InstanceStatePut{
+		Action:  "stop",
+		Timeout: -1,
+		Force:   true,
+	}
+	DefaultToolFetch = func(_ commonParams.OSType, _ commonParams.OSArch, tools []commonParams.RunnerApplicationDownload) (commonParams.RunnerApplicationDownload, error) {
+		return tools[0], nil
+	}
+	DefaultGetCloudconfig = func(_ commonParams.BootstrapInstance, _ commonParams.RunnerApplicationDownload, _ string) (string, error) {
+		return "#cloud-config", nil
+	}
+
+	tests := []struct {
+		name          string
+		setup         func(cli *MockLXDServer)
+		errString     string
+		expectCleanup bool
+		expectFault   bool
+	}{
+		{
+			name: "create request fails",
+			setup: func(cli *MockLXDServer) {
+				cli.On("CreateInstance", mock.Anything).Return(&MockOperation{}, fmt.Errorf("create failed"))
+			},
+			errString:     "creating instance: create failed",
+			expectCleanup: false,
+			expectFault:   false,
+		},
+		{
+			name: "create operation fails",
+			setup: func(cli *MockLXDServer) {
+				createOp := new(MockOperation)
+				createOp.On("Wait").Return(fmt.Errorf("create op failed"))
+				cli.On("CreateInstance", mock.Anything).Return(createOp, nil)
+			},
+			errString:     "waiting for instance creation: create op failed (instance test-instance was removed)",
+			expectCleanup: true,
+			expectFault:   true,
+		},
+		{
+			name: "start request fails",
+			setup: func(cli *MockLXDServer) {
+				createOp := new(MockOperation)
+				createOp.On("Wait").Return(nil)
+				cli.On("CreateInstance", mock.Anything).Return(createOp, nil)
+				cli.On("UpdateInstanceState", "test-instance", "", startState).Return(&MockOperation{}, fmt.Errorf("start failed"))
+			},
+			errString:     "starting instance: start failed (instance test-instance was removed)",
+			expectCleanup: true,
+			expectFault:   true,
+		},
+		{
+			name: "start operation fails",
+			setup: func(cli *MockLXDServer) {
+				createOp := new(MockOperation)
+				createOp.On("Wait").Return(nil)
+				startOp := new(MockOperation)
+				startOp.On("Wait").Return(fmt.Errorf("start op failed"))
+				cli.On("CreateInstance", mock.Anything).Return(createOp, nil)
+				cli.On("UpdateInstanceState", "test-instance", "", startState).Return(startOp, nil)
+			},
+			errString:     "waiting for instance to start: start op failed (instance test-instance was removed)",
+			expectCleanup: true,
+			expectFault:   true,
+		},
+		{
+			name: "fetching instance fails",
+			setup: func(cli *MockLXDServer) {
+				op := new(MockOperation)
+				op.On("Wait").Return(nil)
+				cli.On("CreateInstance", mock.Anything).Return(op, nil)
+				cli.On("UpdateInstanceState", "test-instance", "", startState).Return(op, nil)
+				cli.On("GetInstanceFull", "test-instance").Return(&api.InstanceFull{}, "", api.StatusErrorf(http.StatusNotFound, "not found"))
+			},
+			errString:     "fetching instance",
+			expectCleanup: true,
+			expectFault:   true,
+		},
+		{
+			name: "cleanup fails",
+			setup: func(cli *MockLXDServer) {
+				createOp := new(MockOperation)
+				createOp.On("Wait").Return(fmt.Errorf("create op failed"))
+				cli.On("CreateInstance", mock.Anything).Return(createOp, nil)
+				cli.On("UpdateInstanceState", "test-instance", "", stopState).Return(&MockOperation{}, fmt.Errorf("stop failed")).Once()
+			},
+			errString:     "waiting for instance creation: create op failed (failed to clean up instance test-instance: stopping instance",
+			expectCleanup: false,
+			expectFault:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cli := new(MockLXDServer)
+			l := &LXD{
+				cfg: &config.LXD{
+					InstanceType: config.LXDImageContainer,
+				},
+				cli: cli,
+				imageManager: &image{
+					remotes: map[string]config.LXDImageRemote{},
+				},
+				controllerID: "controller",
+			}
+			cli.On("GetImageAliasArchitectures", config.LXDImageContainer.String(), "ubuntu").Return(aliases, nil)
+			cli.On("GetImage", aliases["x86_64"].Target).Return(&api.Image{Fingerprint: "123abc"}, "", nil)
+			cli.On("GetServer").Return(&api.Server{
+				ServerUntrusted: api.ServerUntrusted{APIExtensions: []string{cloudInitConfigExtension}},
+				Environment:     api.ServerEnvironment{Architectures: []string{"x86_64", "i686"}},
+			}, "", nil)
+			cli.On("GetProfileNames").Return([]string{"default", "container"}, nil)
+			cli.On("GetEvents").Return((*lxd.EventListener)(nil), fmt.Errorf("events not available"))
+			cli.On("IsClustered").Return(false)
+			cli.On("GetInstanceConsoleLog", "test-instance", mock.Anything).Return(io.NopCloser(strings.NewReader("kernel panic")), nil)
+			cli.On("GetInstanceFile", "test-instance", cloudInitOutputLog).Return(io.NopCloser(strings.NewReader("cloud-init failed")), &lxd.InstanceFileResponse{}, nil)
+			cli.On("GetInstance", "test-instance").Return(&api.Instance{Name: "test-instance"}, "", nil)
+			tt.setup(cli)
+			if tt.expectCleanup {
+				cleanupOp := new(MockOperation)
+				cleanupOp.On("WaitContext", mock.Anything).Return(nil)
+				cli.On("UpdateInstanceState", "test-instance", "", stopState).Return(cleanupOp, nil).Once()
+				cli.On("DeleteInstance", "test-instance", false).Return(cleanupOp, nil).Once()
+				cli.On("GetInstance", "test-instance").Return(&api.Instance{Name: "test-instance"}, "", nil)
+			}
+
+			instance, err := l.CreateInstance(ctx, boostrapParams)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errString)
+			if tt.expectCleanup {
+				cli.AssertCalled(t, "DeleteInstance", "test-instance", false)
+			} else {
+				cli.AssertNotCalled(t, "DeleteInstance", "test-instance", false)
+			}
+			if !tt.expectFault {
+				assert.Empty(t, instance.ProviderFault)
+				return
+			}
+			assert.Equal(t, commonParams.InstanceError, instance.Status)
+			assert.Contains(t, string(instance.ProviderFault), "kernel panic")
+			assert.Contains(t, string(instance.ProviderFault), "cloud-init failed")
+		})
+	}
+}
+
+func TestCreateInstanceFaultReachesGARM(t *testing.T) {
+	ctx := context.Background()
+	cli := new(MockLXDServer)
+	l := &LXD{
+		cfg: &config.LXD{
+			InstanceType: config.LXDImageContainer,
+		},
+		cli: cli,
+		imageManager: &image{
+			remotes: map[string]config.LXDImageRemote{},
+		},
+		controllerID: "controller",
+	}
+	aliases := map[string]*api.ImageAliasesEntry{
+		"x86_64": {
+			Name: "ubuntu",
+			Type: "container",
+		},
+	}
+	DefaultToolFetch = func(_ commonParams.OSType, _ commonParams.OSArch, tools []commonParams.RunnerApplicationDownload) (commonParams.RunnerApplicationDownload, error) {
+		return tools[0], nil
+	}
+	DefaultGetCloudconfig = func(_ commonParams.BootstrapInstance, _ commonParams.RunnerApplicationDownload, _ string) (string, error) {
+		return "#cloud-config", nil
+	}
+	cli.On("GetImageAliasArchitectures", config.LXDImageContainer.String(), "ubuntu").Return(aliases, nil)
+	cli.On("GetImage", aliases["x86_64"].Target).Return(&api.Image{Fingerprint: "123abc"}, "", nil)
+	cli.On("GetServer").Return(&api.Server{
+		ServerUntrusted: api.ServerUntrusted{APIExtensions: []string{cloudInitConfigExtension}},
+		Environment:     api.ServerEnvironment{Architectures: []string{"x86_64", "i686"}},
+	}, "", nil)
+	cli.On("GetProfileNames").Return([]string{"default", "container"}, nil)
+	cli.On("IsClustered").Return(false)
+	createOp := new(MockOperation)
+	createOp.On("Wait").Return(fmt.Errorf("create op failed"))
+	cli.On("CreateInstance", mock.Anything).Return(createOp, nil)
+	cli.On("GetInstanceConsoleLog", "test-instance", mock.Anything).Return(io.NopCloser(strings.NewReader("kernel panic")), nil)
+	cli.On("GetInstanceFile", "test-instance", cloudInitOutputLog).Return(io.NopCloser(strings.NewReader("cloud-init failed")), &lxd.InstanceFileResponse{}, nil)
+	cli.On("GetInstance", "test-instance").Return(&api.Instance{Name: "test-instance"}, "", nil)
+	cleanupOp := new(MockOperation)
+	cleanupOp.On("WaitContext", mock.Anything).Return(nil)
+	cli.On("UpdateInstanceState", "test-instance", "", mock.Anything).Return(cleanupOp, nil)
+	cli.On("DeleteInstance", "test-instance", false).Return(cleanupOp, nil)
+
+	env := execution.EnvironmentV011{
+		Command:      commonExecution.CreateInstanceCommand,
+		ControllerID: "controller",
+		PoolID:       "default",
+		BootstrapParams: commonParams.BootstrapInstance{
+			Name: "test-instance",
+			Tools: []commonParams.RunnerApplicationDownload{
+				{
+					OS:           ptr("linux"),
+					Architecture: ptr("x86_64"),
+					DownloadURL:  ptr("https://example.com"),
+					Filename:     ptr("test-app"),
+				},
+			},
+			Image:  "ubuntu",
+			Flavor: "container",
+			PoolID: "default",
+			OSArch: commonParams.Amd64,
+			OSType: commonParams.Linux,
+		},
+	}
+	// GARM only gets the error back from a failed CreateInstance, so it must carry
+	// the diagnostics.
+	result, err := env.Run(ctx, l)
+	require.Error(t, err)
+	assert.Empty(t, result)
+	assert.Contains(t, err.Error(), "create op failed (instance test-instance was removed)")
+	assert.Contains(t, err.Error(), "kernel panic")
+	assert.Contains(t, err.Error(), "cloud-init failed")
+	cli.AssertCalled(t, "DeleteInstance", "test-instance", false)
+}
+
+func TestGetInstanceInErrorState(t *testing.T) {
+	ctx := context.Background()
+	cli := new(MockLXDServer)
+	l := &LXD{
+		cfg:          &config.LXD{},
+		cli:          cli,
+		imageManager: &image{},
+		controllerID: "controller",
+	}
+	cli.On("GetInstanceFull", "test-instance").Return(&api.InstanceFull{
+		Instance: api.Instance{
+			Name:         "test-instance",
+			Architecture: "x86_64",
+			ExpandedConfig: map[string]string{
+				"image.os": "ubuntu",
+			},
+			Type: "container",
+		},
+		State: &api.InstanceState{
+			Status: "Error",
+		},
+	}, "", nil)
+	cli.On("GetInstanceConsoleLog", "test-instance", mock.Anything).Return(io.NopCloser(strings.NewReader("boot failed")), nil)
+	cli.On("GetInstanceFile", "test-instance", cloudInitOutputLog).Return(io.NopCloser(strings.NewReader("")), (*lxd.InstanceFileResponse)(nil), fmt.Errorf("not running"))
+
+	instance, err := l.GetInstance(ctx, "test-instance")
+	require.NoError(t, err)
+	assert.Equal(t, commonParams.InstanceError, instance.Status)
+	fault := string(instance.ProviderFault)
+	assert.Contains(t, fault, "instance test-instance is in state Error")
+	assert.Contains(t, fault, "boot failed")
+	assert.Contains(t, fault, "failed to fetch /var/log/cloud-init-output.log: not running")
+}
@@ -0,0 +1,104 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+// Copyright 2023 Cloudbase Solutions SRL
+//
+// Licensed under the AGPLv3, see LICENCE file for details
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// endpointProvider is the provider of a single LXD endpoint, used by maintenance
+// commands. The name is empty if the config does not define endpoints.
+type endpointProvider struct {
+	name     string
+	provider *LXD
+}
+
+// loadEndpointProviders returns a provider for every LXD endpoint in the config.
+func loadEndpointProviders(configFile string) ([]endpointProvider, error) {
+	prov, err := NewLXDProvider(configFile, "")
+	if err != nil {
+		return nil, err
+	}
+
+	switch p := prov.(type) {
+	case *LXD:
+		return []endpointProvider{{provider: p}}, nil
+	case *lxdEndpoints:
+		ret := make([]endpointProvider, 0, len(p.names))
+		for _, name := range p.names {
+			ret = append(ret, endpointProvider{name: name, provider: p.endpoints[name]})
+		}
+		return ret, nil
+	default:
+		return nil, fmt.Errorf("unknown provider type %T", prov)
+	}
+}
+
+// forEachEndpoint runs fn for every LXD endpoint in the config. The output of each
+// endpoint is preceded by its name, when endpoints are defined. All endpoints are
+// processed, even if some of them fail.
+func forEachEndpoint(configFile string, w io.Writer, fn func(l *LXD) error) error {
+	providers, err := loadEndpointProviders(configFile)
+	if err != nil {
+		return errors.Wrap(err, "loading providers")
+	}
+
+	if len(providers) == 1 && providers[0].name == "" {
+		return fn(providers[0].provider)
+	}
+
+	errs := endpointErrors{}
+	for _, p := range providers {
+		if p.name != "" {
+			fmt.Fprintf(w, "[%s]\n", p.name)
+		}
+		if err := fn(p.provider); err != nil {
+			errs[p.name] = err
+		}
+	}
+	return errs.asError()
+}
+
+// PrefetchImages copies the images in the image_cache section of the config into the
+// local image store of every LXD endpoint, and refreshes cached copies that are older
+// than the refresh interval. A line is written to w for every image.
+func PrefetchImages(ctx context.Context, configFile string, w io.Writer) error {
+	return forEachEndpoint(configFile, w, func(l *LXD) error {
+		return l.prefetchImages(ctx, w)
+	})
+}
+
+// CollectImages deletes the images of every LXD endpoint that are not used by any
+// instance, are not referenced by an alias, and were not used for longer than the
+// max_age set in the image_cache section of the config. With dryRun, the images are
+// only reported. A line is written to w for every image.
+func CollectImages(ctx context.Context, configFile string, dryRun bool, w io.Writer) error {
+	return forEachEndpoint(configFile, w, func(l *LXD) error {
+		return l.collectImages(ctx, dryRun, w)
+	})
+}
+
+// ReplenishWarmPools creates the missing warm instances of the pools in the warm_pools
+// section of the config, on every LXD endpoint, and removes outdated ones. A line is
+// written to w for every pool.
+func ReplenishWarmPools(ctx context.Context, configFile string, w io.Writer) error {
+	return forEachEndpoint(configFile, w, func(l *LXD) error {
+		return l.replenishWarmPools(ctx, w)
+	})
+}
+
+// PublishImages builds the images in the image_builds section of the config, on every
+// LXD endpoint. If aliases is empty, all images are built. A line is written to w for
+// every image.
+func PublishImages(ctx context.Context, configFile string, aliases []string, w io.Writer) error {
+	return forEachEndpoint(configFile, w, func(l *LXD) error {
+		return l.publishImages(ctx, aliases, w)
+	})
+}
@@ -1,6 +1,8 @@
 package provider
 
 import (
+	"io"
+
 	lxd "github.com/canonical/lxd/client"
 	"github.com/canonical/lxd/shared/api"
 	"github.com/stretchr/testify/mock"
@@ -59,3 +61,154 @@ func (m *MockLXDServer) GetInstancesFull(getArgs lxd.GetInstancesFullArgs) ([]ap
 	args := m.Called(getArgs)
 	return args.Get(0).([]api.InstanceFull), args.Error(1)
 }
+
+func (m *MockLXDServer) GetInstanceConsoleLog(instanceName string, consoleArgs *lxd.InstanceConsoleLogArgs) (io.ReadCloser, error) {
+	args := m.Called(instanceName, consoleArgs)
+	return args.Get(0).(io.ReadCloser), args.Error(1)
+}
+
+func (m *MockLXDServer) GetInstanceFile(instanceName string, path string) (io.ReadCloser, *lxd.InstanceFileResponse, error) {
+	args := m.Called(instanceName, path)
+	return args.Get(0).(io.ReadCloser), args.Get(1).(*lxd.InstanceFileResponse), args.Error(2)
+}
+
+func (m *MockLXDServer) CreateInstanceFile(instanceName string, path string, fileArgs lxd.InstanceFileArgs) error {
+	args := m.Called(instanceName, path, fileArgs)
+	return args.Error(0)
+}
+
+func (m *MockLXDServer) GetEvents() (*lxd.EventListener, error) {
+	args := m.Called()
+	return args.Get(0).(*lxd.EventListener), args.Error(1)
+}
+
+func (m *MockLXDServer) ExecInstance(instanceName string, exec api.InstanceExecPost, execArgs *lxd.InstanceExecArgs) (lxd.Operation, error) {
+	args := m.Called(instanceName, exec, execArgs)
+	return args.Get(0).(lxd.Operation), args.Error(1)
+}
+
+func (m *MockLXDServer) GetProfile(name string) (*api.Profile, string, error) {
+	args := m.Called(name)
+	return args.Get(0).(*api.Profile), args.Get(1).(string), args.Error(2)
+}
+
+func (m *MockLXDServer) GetInstance(name string) (*api.Instance, string, error) {
+	args := m.Called(name)
+	return args.Get(0).(*api.Instance), args.Get(1).(string), args.Error(2)
+}
+
+func (m *MockLXDServer) GetInstanceSnapshot(instanceName string, name string) (*api.InstanceSnapshot, string, error) {
+	args := m.Called(instanceName, name)
+	return args.Get(0).(*api.InstanceSnapshot), args.Get(1).(string), args.Error(2)
+}
+
+func (m *MockLXDServer) UpdateInstance(name string, instance api.InstancePut, ETag string) (lxd.Operation, error) {
+	args := m.Called(name, instance, ETag)
+	return args.Get(0).(lxd.Operation), args.Error(1)
+}
+
+func (m *MockLXDServer) RenameInstance(name string, instance api.InstancePost) (lxd.Operation, error) {
+	args := m.Called(name, instance)
+	return args.Get(0).(lxd.Operation), args.Error(1)
+}
+
+func (m *MockLXDServer) GetServerResources() (*api.Resources, error) {
+	args := m.Called()
+	return args.Get(0).(*api.Resources), args.Error(1)
+}
+
+func (m *MockLXDServer) IsClustered() bool {
+	args := m.Called()
+	return args.Bool(0)
+}
+
+func (m *MockLXDServer) UseTarget(name string) lxd.InstanceServer {
+	args := m.Called(name)
+	return args.Get(0).(lxd.InstanceServer)
+}
+
+func (m *MockLXDServer) GetClusterMembers() ([]api.ClusterMember, error) {
+	args := m.Called()
+	return args.Get(0).([]api.ClusterMember), args.Error(1)
+}
+
+func (m *MockLXDServer) CreateProject(project api.ProjectsPost) error {
+	args := m.Called(project)
+	return args.Error(0)
+}
+
+func (m *MockLXDServer) UpdateProject(name string, project api.ProjectPut, ETag string) error {
+	args := m.Called(name, project, ETag)
+	return args.Error(0)
+}
+
+func (m *MockLXDServer) CreateProfile(profile api.ProfilesPost) error {
+	args := m.Called(profile)
+	return args.Error(0)
+}
+
+func (m *MockLXDServer) UpdateProfile(name string, profile api.ProfilePut, ETag string) (lxd.Operation, error) {
+	args := m.Called(name, profile, ETag)
+	return args.Get(0).(lxd.Operation), args.Error(1)
+}
+
+func (m *MockLXDServer) GetImageSecret(fingerprint string) (string, error) {
+	args := m.Called(fingerprint)
+	return args.String(0), args.Error(1)
+}
+
+func (m *MockLXDServer) GetImageAlias(name string) (*api.ImageAliasesEntry, string, error) {
+	args := m.Called(name)
+	return args.Get(0).(*api.ImageAliasesEntry), args.Get(1).(string), args.Error(2)
+}
+
+func (m *MockLXDServer) CreateImageAlias(alias api.ImageAliasesPost) error {
+	args := m.Called(alias)
+	return args.Error(0)
+}
+
+func (m *MockLXDServer) UpdateImageAlias(name string, alias api.ImageAliasesEntryPut, ETag string) error {
+	args := m.Called(name, alias, ETag)
+	return args.Error(0)
+}
+
+func (m *MockLXDServer) CreateImage(image api.ImagesPost, imageArgs *lxd.ImageCreateArgs) (lxd.Operation, error) {
+	args := m.Called(image, imageArgs)
+	return args.Get(0).(lxd.Operation), args.Error(1)
+}
+
+func (m *MockLXDServer) RefreshImage(fingerprint string) (lxd.Operation, error) {
+	args := m.Called(fingerprint)
+	return args.Get(0).(lxd.Operation), args.Error(1)
+}
+
+func (m *MockLXDServer) GetServer() (*api.Server, string, error) {
+	args := m.Called()
+	return args.Get(0).(*api.Server), args.String(1), args.Error(2)
+}
+
+func (m *MockLXDServer) GetImages() ([]api.Image, error) {
+	args := m.Called()
+	return args.Get(0).([]api.Image), args.Error(1)
+}
+
+func (m *MockLXDServer) DeleteImage(fingerprint string) (lxd.Operation, error) {
+	args := m.Called(fingerprint)
+	return args.Get(0).(lxd.Operation), args.Error(1)
+}
+
+// MockTargetServer is meant to be returned by MockLXDServer.UseTarget. It embeds
+// lxd.InstanceServer to satisfy the interface, and forwards the calls we make on
+// clients that target a cluster member to a MockLXDServer.
+type MockTargetServer struct {
+	lxd.InstanceServer
+	Member *MockLXDServer
+}
+
+func (m *MockTargetServer) GetServerResources() (*api.Resources, error) {
+	return m.Member.GetServerResources()
+}
+
+func (m *MockTargetServer) CreateInstance(instance api.InstancesPost) (lxd.Operation, error) {
+	return m.Member.CreateInstance(instance)
+}
@@ -0,0 +1,49 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+// Copyright 2023 Cloudbase Solutions SRL
+//
+// Licensed under the AGPLv3, see LICENCE file for details
+
+package provider
+
+import (
+	"sync"
+
+	lxd "github.com/canonical/lxd/client"
+	"github.com/canonical/lxd/shared/api"
+	"github.com/stretchr/testify/mock"
+)
+
+type MockEventListener struct {
+	mock.Mock
+
+	mux      sync.Mutex
+	handlers []func(api.Event)
+}
+
+func (m *MockEventListener) AddHandler(types []string, function func(api.Event)) (*lxd.EventTarget, error) {
+	args := m.Called(types, function)
+	if args.Error(1) == nil {
+		m.mux.Lock()
+		m.handlers = append(m.handlers, function)
+		m.mux.Unlock()
+	}
+	return args.Get(0).(*lxd.EventTarget), args.Error(1)
+}
+
+func (m *MockEventListener) RemoveHandler(target *lxd.EventTarget) error {
+	args := m.Called(target)
+	return args.Error(0)
+}
+
+func (m *MockEventListener) Disconnect() {
+	m.Called()
+}
+
+// SendEvent calls all registered handlers with the given event.
+func (m *MockEventListener) SendEvent(event api.Event) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	for _, handler := range m.handlers {
+		handler(event)
+	}
+}
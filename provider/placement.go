@@ -0,0 +1,92 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+// Copyright 2023 Cloudbase Solutions SRL
+//
+// Licensed under the AGPLv3, see LICENCE file for details
+
+package provider
+
+import (
+	"slices"
+	"time"
+
+	"github.com/cloudbase/garm-provider-lxd/config"
+)
+
+// endpointStats holds what we know about an endpoint when placing a new instance.
+type endpointStats struct {
+	name     string
+	endpoint config.LXDEndpoint
+	// instances is the number of instances this controller runs on the endpoint.
+	instances int
+	// lastCreated is the creation time of the newest instance of this controller
+	// on the endpoint.
+	lastCreated time.Time
+	// freeMemory is the share of memory that is not in use on the endpoint, between
+	// 0 and 1. A negative value means we don't know.
+	freeMemory float64
+}
+
+func (e endpointStats) full() bool {
+	return e.endpoint.MaxInstances > 0 && e.instances >= int(e.endpoint.MaxInstances)
+}
+
+// orderEndpoints returns the endpoints in the order in which we should try to create
+// a new instance on them, according to the placement strategy. Endpoints that reached
+// their maximum number of instances are left out. The stats must be sorted by name.
+func orderEndpoints(strategy config.PlacementStrategy, stats []endpointStats) []endpointStats {
+	ordered := slices.Clone(stats)
+	if len(ordered) == 0 {
+		return ordered
+	}
+
+	switch strategy {
+	case config.PlacementLeastInstances:
+		slices.SortStableFunc(ordered, func(a, b endpointStats) int {
+			return a.instances - b.instances
+		})
+	case config.PlacementWeighted:
+		// Place the instance where it brings the number of instances closest to
+		// the share given by the weight of the endpoint.
+		load := func(e endpointStats) float64 {
+			return float64(e.instances+1) / float64(e.endpoint.GetWeight())
+		}
+		slices.SortStableFunc(ordered, func(a, b endpointStats) int {
+			switch la, lb := load(a), load(b); {
+			case la < lb:
+				return -1
+			case la > lb:
+				return 1
+			}
+			return 0
+		})
+	case config.PlacementCapacityAware:
+		slices.SortStableFunc(ordered, func(a, b endpointStats) int {
+			switch {
+			case a.freeMemory > b.freeMemory:
+				return -1
+			case a.freeMemory < b.freeMemory:
+				return 1
+			}
+			return 0
+		})
+	default:
+		// Round robin. Start with the endpoint that follows the one that got the
+		// most recent instance. We look at the instances themselves, so we don't
+		// need to keep any state between runs of the provider.
+		newest := -1
+		for idx, e := range ordered {
+			if e.instances == 0 {
+				continue
+			}
+			if newest == -1 || e.lastCreated.After(ordered[newest].lastCreated) {
+				newest = idx
+			}
+		}
+		start := (newest + 1) % len(ordered)
+		ordered = slices.Concat(ordered[start:], ordered[:start])
+	}
+
+	return slices.DeleteFunc(ordered, func(e endpointStats) bool {
+		return e.full()
+	})
+}
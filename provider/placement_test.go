@@ -0,0 +1,111 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+// Copyright 2023 Cloudbase Solutions SRL
+//
+// Licensed under the AGPLv3, see LICENCE file for details
+
+package provider
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cloudbase/garm-provider-lxd/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrderEndpoints(t *testing.T) {
+	now := time.Now()
+	stats := []endpointStats{
+		{
+			name:        "alpha",
+			endpoint:    config.LXDEndpoint{Weight: 1},
+			instances:   2,
+			lastCreated: now.Add(-time.Hour),
+			freeMemory:  0.2,
+		},
+		{
+			name:        "beta",
+			endpoint:    config.LXDEndpoint{Weight: 4},
+			instances:   4,
+			lastCreated: now,
+			freeMemory:  0.7,
+		},
+		{
+			name:        "gamma",
+			endpoint:    config.LXDEndpoint{},
+			instances:   1,
+			lastCreated: now.Add(-2 * time.Hour),
+			freeMemory:  -1,
+		},
+	}
+
+	names := func(ordered []endpointStats) []string {
+		ret := []string{}
+		for _, stat := range ordered {
+			ret = append(ret, stat.name)
+		}
+		return ret
+	}
+
+	tests := []struct {
+		name     string
+		strategy config.PlacementStrategy
+		stats    []endpointStats
+		expected []string
+	}{
+		{
+			name:     "round robin follows the newest instance",
+			strategy: config.PlacementRoundRobin,
+			stats:    stats,
+			expected: []string{"gamma", "alpha", "beta"},
+		},
+		{
+			name:     "round robin without instances",
+			strategy: config.PlacementRoundRobin,
+			stats: []endpointStats{
+				{name: "alpha"},
+				{name: "beta"},
+			},
+			expected: []string{"alpha", "beta"},
+		},
+		{
+			name:     "least instances",
+			strategy: config.PlacementLeastInstances,
+			stats:    stats,
+			expected: []string{"gamma", "alpha", "beta"},
+		},
+		{
+			name:     "weighted",
+			strategy: config.PlacementWeighted,
+			stats:    stats,
+			expected: []string{"beta", "gamma", "alpha"},
+		},
+		{
+			name:     "capacity aware",
+			strategy: config.PlacementCapacityAware,
+			stats:    stats,
+			expected: []string{"beta", "alpha", "gamma"},
+		},
+		{
+			name:     "full endpoints are left out",
+			strategy: config.PlacementLeastInstances,
+			stats: []endpointStats{
+				{name: "alpha", endpoint: config.LXDEndpoint{MaxInstances: 2}, instances: 2},
+				{name: "beta", endpoint: config.LXDEndpoint{MaxInstances: 5}, instances: 4},
+			},
+			expected: []string{"beta"},
+		},
+		{
+			name:     "no endpoints",
+			strategy: config.PlacementRoundRobin,
+			stats:    []endpointStats{},
+			expected: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, names(orderEndpoints(tt.strategy, tt.stats)))
+		})
+	}
+}
@@ -0,0 +1,199 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+// Copyright 2023 Cloudbase Solutions SRL
+//
+// Licensed under the AGPLv3, see LICENCE file for details
+
+package provider
+
+import (
+	"context"
+	"maps"
+	"slices"
+
+	"github.com/canonical/lxd/shared/api"
+	runnerErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/cloudbase/garm-provider-lxd/config"
+	"github.com/pkg/errors"
+)
+
+// managedProjects returns the projects this provider creates instances in. The project
+// from the provider config is always first, followed by the projects pools are allowed
+// to use instead.
+func managedProjects(cfg *config.LXD) []string {
+	ret := []string{projectName(cfg)}
+	for _, project := range cfg.AllowedProjects {
+		if !slices.Contains(ret, project) {
+			ret = append(ret, project)
+		}
+	}
+	return ret
+}
+
+// getProjectCLI returns a client that uses the given project. An empty project name
+// selects the project from the provider config. Any other project must be in the list
+// of allowed projects.
+func (l *LXD) getProjectCLI(ctx context.Context, project string) (InstanceServerInterface, error) {
+	if project == "" || project == projectName(l.cfg) {
+		return l.getCLI(ctx)
+	}
+
+	if !slices.Contains(l.cfg.AllowedProjects, project) {
+		return nil, runnerErrors.NewBadRequestError("project %s is not in the list of allowed projects", project)
+	}
+
+	cli, err := l.getCLI(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching client")
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if projectCLI, ok := l.projectClients[project]; ok {
+		return projectCLI, nil
+	}
+
+	if err := l.ensureProject(cli, project); err != nil {
+		return nil, err
+	}
+	projectCLI := cli.UseProject(project)
+	if err := l.ensureProfiles(projectCLI); err != nil {
+		return nil, errors.Wrapf(err, "setting up profiles in project %s", project)
+	}
+	if l.projectClients == nil {
+		l.projectClients = map[string]InstanceServerInterface{}
+	}
+	l.projectClients[project] = projectCLI
+
+	return projectCLI, nil
+}
+
+// getInstanceCLI returns a client for the project that holds the instance. If pools
+// are allowed to use other projects than the default one, we look for the instance
+// in each of them.
+func (l *LXD) getInstanceCLI(ctx context.Context, instanceName string) (InstanceServerInterface, error) {
+	projects := managedProjects(l.cfg)
+	if len(projects) == 1 {
+		return l.getCLI(ctx)
+	}
+
+	for _, project := range projects {
+		cli, err := l.getProjectCLI(ctx, project)
+		if err != nil {
+			return nil, errors.Wrapf(err, "fetching client for project %s", project)
+		}
+		if _, _, err := cli.GetInstance(instanceName); err != nil {
+			if isNotFoundError(err) {
+				continue
+			}
+			return nil, errors.Wrapf(err, "looking for instance %s in project %s", instanceName, project)
+		}
+		return cli, nil
+	}
+	return nil, errors.Wrapf(runnerErrors.ErrNotFound, "looking for instance %s", instanceName)
+}
+
+// ensureProject makes sure the project exists. If auto_create_project is enabled, a
+// missing project is created, and the project config from the provider config is
+// applied to existing projects.
+func (l *LXD) ensureProject(cli InstanceServerInterface, project string) error {
+	current, etag, err := cli.GetProject(project)
+	if err != nil {
+		if !l.cfg.AutoCreateProject || !isNotFoundError(err) {
+			return errors.Wrapf(err, "fetching project name: %s", project)
+		}
+		err := cli.CreateProject(api.ProjectsPost{
+			Name: project,
+			ProjectPut: api.ProjectPut{
+				Description: DefaultProjectDescription,
+				Config:      l.cfg.ProjectConfig,
+			},
+		})
+		if err != nil {
+			return errors.Wrapf(err, "creating project %s", project)
+		}
+		return nil
+	}
+
+	if !l.cfg.AutoCreateProject {
+		return nil
+	}
+
+	// Only the keys we manage are reconciled. LXD sets some keys on its own.
+	put := current.Writable()
+	if put.Config == nil {
+		put.Config = map[string]string{}
+	}
+	drifted := false
+	for key, val := range l.cfg.ProjectConfig {
+		if put.Config[key] != val {
+			put.Config[key] = val
+			drifted = true
+		}
+	}
+	if !drifted {
+		return nil
+	}
+	if err := cli.UpdateProject(project, put, etag); err != nil {
+		return errors.Wrapf(err, "updating project %s", project)
+	}
+	return nil
+}
+
+// ensureProfiles creates the profiles defined in the provider config, if they don't
+// exist in the project the client uses. Profiles that drifted from their definition
+// are updated.
+func (l *LXD) ensureProfiles(cli InstanceServerInterface) error {
+	names := slices.Sorted(maps.Keys(l.cfg.Profiles))
+	for _, name := range names {
+		profile := l.cfg.Profiles[name]
+		want := api.ProfilePut{
+			Description: profile.Description,
+			Config:      profile.Config,
+			Devices:     profile.Devices,
+		}
+
+		current, etag, err := cli.GetProfile(name)
+		if err != nil {
+			if !isNotFoundError(err) {
+				return errors.Wrapf(err, "fetching profile %s", name)
+			}
+			if err := cli.CreateProfile(api.ProfilesPost{Name: name, ProfilePut: want}); err != nil {
+				return errors.Wrapf(err, "creating profile %s", name)
+			}
+			continue
+		}
+
+		if !profileDrifted(current.Writable(), want) {
+			continue
+		}
+		op, err := cli.UpdateProfile(name, want, etag)
+		if err != nil {
+			return errors.Wrapf(err, "updating profile %s", name)
+		}
+		if op != nil {
+			if err := op.Wait(); err != nil {
+				return errors.Wrapf(err, "waiting for profile %s to be updated", name)
+			}
+		}
+	}
+	return nil
+}
+
+func profileDrifted(current, want api.ProfilePut) bool {
+	if current.Description != want.Description {
+		return true
+	}
+	if len(current.Config) != len(want.Config) || len(current.Devices) != len(want.Devices) {
+		return true
+	}
+	if !maps.Equal(current.Config, want.Config) {
+		return true
+	}
+	for name, device := range want.Devices {
+		if !maps.Equal(current.Devices[name], device) {
+			return true
+		}
+	}
+	return false
+}
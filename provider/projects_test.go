@@ -0,0 +1,350 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+// Copyright 2023 Cloudbase Solutions SRL
+//
+// Licensed under the AGPLv3, see LICENCE file for details
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	lxd "github.com/canonical/lxd/client"
+	"github.com/canonical/lxd/shared/api"
+	commonParams "github.com/cloudbase/garm-provider-common/params"
+	"github.com/cloudbase/garm-provider-lxd/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func newMultiProjectLXD(defaultCli, otherCli *MockLXDServer) *LXD {
+	return &LXD{
+		cfg: &config.LXD{
+			UnixSocket:      "/var/snap/lxd/common/lxd/unix.socket",
+			InstanceType:    config.LXDImageContainer,
+			AllowedProjects: []string{"garm-vms"},
+		},
+		cli: defaultCli,
+		projectClients: map[string]InstanceServerInterface{
+			"garm-vms": otherCli,
+		},
+		imageManager: &image{},
+		controllerID: "controller",
+	}
+}
+
+func TestManagedProjects(t *testing.T) {
+	assert.Equal(t, []string{DefaultProjectName}, managedProjects(&config.LXD{}))
+	assert.Equal(t, []string{"runners", "garm-vms"}, managedProjects(&config.LXD{
+		ProjectName:     "runners",
+		AllowedProjects: []string{"runners", "garm-vms", "garm-vms"},
+	}))
+}
+
+func TestGetProjectCLI(t *testing.T) {
+	ctx := context.Background()
+	defaultCli := new(MockLXDServer)
+	otherCli := new(MockLXDServer)
+	l := newMultiProjectLXD(defaultCli, otherCli)
+
+	cli, err := l.getProjectCLI(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, defaultCli, cli)
+
+	cli, err = l.getProjectCLI(ctx, DefaultProjectName)
+	require.NoError(t, err)
+	assert.Equal(t, defaultCli, cli)
+
+	cli, err = l.getProjectCLI(ctx, "garm-vms")
+	require.NoError(t, err)
+	assert.Equal(t, otherCli, cli)
+
+	_, err = l.getProjectCLI(ctx, "someone-else")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "project someone-else is not in the list of allowed projects")
+}
+
+func TestGetInstanceCLI(t *testing.T) {
+	ctx := context.Background()
+	defaultCli := new(MockLXDServer)
+	otherCli := new(MockLXDServer)
+	l := newMultiProjectLXD(defaultCli, otherCli)
+
+	notFound := api.StatusErrorf(http.StatusNotFound, "Instance not found")
+	defaultCli.On("GetInstance", "in-default").Return(&api.Instance{Name: "in-default"}, "", nil)
+	defaultCli.On("GetInstance", "in-other").Return((*api.Instance)(nil), "", notFound)
+	defaultCli.On("GetInstance", "missing").Return((*api.Instance)(nil), "", notFound)
+	otherCli.On("GetInstance", "in-other").Return(&api.Instance{Name: "in-other"}, "", nil)
+	otherCli.On("GetInstance", "missing").Return((*api.Instance)(nil), "", notFound)
+
+	cli, err := l.getInstanceCLI(ctx, "in-default")
+	require.NoError(t, err)
+	assert.Equal(t, defaultCli, cli)
+
+	cli, err = l.getInstanceCLI(ctx, "in-other")
+	require.NoError(t, err)
+	assert.Equal(t, otherCli, cli)
+
+	_, err = l.getInstanceCLI(ctx, "missing")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "looking for instance missing")
+}
+
+func TestListInstancesMultipleProjects(t *testing.T) {
+	ctx := context.Background()
+	defaultCli := new(MockLXDServer)
+	otherCli := new(MockLXDServer)
+	l := newMultiProjectLXD(defaultCli, otherCli)
+
+	runner := func(name, controllerID string) api.InstanceFull {
+		return api.InstanceFull{
+			Instance: api.Instance{
+				Name:         name,
+				Architecture: "x86_64",
+				ExpandedConfig: map[string]string{
+					controllerIDKeyName: controllerID,
+					poolIDKey:           "pool",
+				},
+			},
+			State: &api.InstanceState{Status: "Running"},
+		}
+	}
+	listArgs := lxd.GetInstancesFullArgs{InstanceType: api.InstanceTypeAny}
+	defaultCli.On("GetInstancesFull", listArgs).Return([]api.InstanceFull{
+		runner("container-runner", "controller"),
+		runner("not-ours", "other-controller"),
+	}, nil)
+	otherCli.On("GetInstancesFull", listArgs).Return([]api.InstanceFull{
+		runner("vm-runner", "controller"),
+	}, nil)
+
+	instances, err := l.ListInstances(ctx, "pool")
+	require.NoError(t, err)
+	require.Len(t, instances, 2)
+	assert.Equal(t, "container-runner", instances[0].Name)
+	assert.Equal(t, "vm-runner", instances[1].Name)
+}
+
+func TestDeleteInstanceOtherProject(t *testing.T) {
+	ctx := context.Background()
+	defaultCli := new(MockLXDServer)
+	otherCli := new(MockLXDServer)
+	l := newMultiProjectLXD(defaultCli, otherCli)
+
+	notFound := api.StatusErrorf(http.StatusNotFound, "Instance not found")
+	defaultCli.On("GetInstance", "vm-runner").Return((*api.Instance)(nil), "", notFound)
+	defaultCli.On("GetInstance", "gone").Return((*api.Instance)(nil), "", notFound)
+	otherCli.On("GetInstance", "vm-runner").Return(&api.Instance{Name: "vm-runner"}, "", nil)
+	otherCli.On("GetInstance", "gone").Return((*api.Instance)(nil), "", notFound)
+
+	mockOp := new(MockOperation)
+	mockOp.On("WaitContext", mock.Anything).Return(nil)
+	otherCli.On("UpdateInstanceState", "vm-runner", "", api.InstanceStatePut{
+		Action:  "stop",
+		Timeout: -1,
+		Force:   true,
+	}).Return(mockOp, nil)
+	otherCli.On("DeleteInstance", "vm-runner", false).Return(mockOp, nil)
+
+	require.NoError(t, l.DeleteInstance(ctx, "vm-runner"))
+	otherCli.AssertCalled(t, "DeleteInstance", "vm-runner", false)
+	defaultCli.AssertNotCalled(t, "DeleteInstance", mock.Anything, mock.Anything)
+
+	// Instances that can't be found in any project are already gone.
+	require.NoError(t, l.DeleteInstance(ctx, "gone"))
+}
+
+func TestGetCreateInstanceArgsOverrides(t *testing.T) {
+	ctx := context.Background()
+	defaultCli := new(MockLXDServer)
+	otherCli := new(MockLXDServer)
+	l := newMultiProjectLXD(defaultCli, otherCli)
+
+	DefaultToolFetch = func(_ commonParams.OSType, _ commonParams.OSArch, tools []commonParams.RunnerApplicationDownload) (commonParams.RunnerApplicationDownload, error) {
+		return tools[0], nil
+	}
+	DefaultGetCloudconfig = func(_ commonParams.BootstrapInstance, _ commonParams.RunnerApplicationDownload, _ string) (string, error) {
+		return "#cloud-config", nil
+	}
+
+	aliases := map[string]*api.ImageAliasesEntry{
+		"x86_64": {
+			Name: "ubuntu",
+			Type: config.LXDImageVirtualMachine.String(),
+		},
+	}
+	otherCli.On("GetProfileNames").Return([]string{"default", "vm-large"}, nil)
+	otherCli.On("GetImageAliasArchitectures", config.LXDImageVirtualMachine.String(), "ubuntu").Return(aliases, nil)
+	otherCli.On("GetImage", aliases["x86_64"].Target).Return(&api.Image{Fingerprint: "123abc"}, "", nil)
+	otherCli.On("GetServer").Return(&api.Server{
+		ServerUntrusted: api.ServerUntrusted{APIExtensions: []string{cloudInitConfigExtension}},
+		Environment:     api.ServerEnvironment{Architectures: []string{"x86_64", "i686"}},
+	}, "", nil)
+
+	specs, err := json.Marshal(map[string]any{
+		"instance_type": "virtual-machine",
+		"secure_boot":   true,
+		"project":       "garm-vms",
+	})
+	require.NoError(t, err)
+	bootstrapParams := commonParams.BootstrapInstance{
+		Name:       "vm-runner",
+		Image:      "ubuntu",
+		Flavor:     "vm-large",
+		OSArch:     commonParams.Amd64,
+		OSType:     commonParams.Linux,
+		ExtraSpecs: specs,
+		Tools: []commonParams.RunnerApplicationDownload{
+			{
+				OS:           ptr("linux"),
+				Architecture: ptr("x64"),
+				DownloadURL:  ptr("https://example.com"),
+				Filename:     ptr("test-app"),
+			},
+		},
+	}
+	parsedSpecs, err := parseExtraSpecsFromBootstrapParams(bootstrapParams)
+	require.NoError(t, err)
+
+	args, err := l.getCreateInstanceArgs(ctx, bootstrapParams, parsedSpecs)
+	require.NoError(t, err)
+	assert.Equal(t, api.InstanceTypeVM, args.Type)
+	assert.Equal(t, "uefi-secureboot", args.Config["boot.mode"])
+	assert.Equal(t, []string{"vm-large"}, args.Profiles)
+	assert.Equal(t, "123abc", args.Source.Fingerprint)
+	defaultCli.AssertNotCalled(t, "GetProfileNames")
+
+	parsedSpecs.Project = "someone-else"
+	_, err = l.getCreateInstanceArgs(ctx, bootstrapParams, parsedSpecs)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not in the list of allowed projects")
+}
+
+func TestEnsureProject(t *testing.T) {
+	projectConfig := map[string]string{"features.images": "false"}
+	notFound := api.StatusErrorf(http.StatusNotFound, "not found")
+
+	t.Run("missing project without auto create", func(t *testing.T) {
+		cli := new(MockLXDServer)
+		l := &LXD{cfg: &config.LXD{}}
+		cli.On("GetProject", "runners").Return((*api.Project)(nil), "", notFound)
+
+		err := l.ensureProject(cli, "runners")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "fetching project name: runners")
+		cli.AssertNotCalled(t, "CreateProject", mock.Anything)
+	})
+
+	t.Run("missing project is created", func(t *testing.T) {
+		cli := new(MockLXDServer)
+		l := &LXD{cfg: &config.LXD{AutoCreateProject: true, ProjectConfig: projectConfig}}
+		cli.On("GetProject", "runners").Return((*api.Project)(nil), "", notFound)
+		cli.On("CreateProject", api.ProjectsPost{
+			Name: "runners",
+			ProjectPut: api.ProjectPut{
+				Description: DefaultProjectDescription,
+				Config:      projectConfig,
+			},
+		}).Return(nil)
+
+		require.NoError(t, l.ensureProject(cli, "runners"))
+		cli.AssertExpectations(t)
+	})
+
+	t.Run("drifted project config is reconciled", func(t *testing.T) {
+		cli := new(MockLXDServer)
+		l := &LXD{cfg: &config.LXD{AutoCreateProject: true, ProjectConfig: projectConfig}}
+		current := &api.Project{
+			Name:   "runners",
+			Config: map[string]string{"features.images": "true", "features.profiles": "true"},
+		}
+		cli.On("GetProject", "runners").Return(current, "etag", nil)
+		cli.On("UpdateProject", "runners", api.ProjectPut{
+			Config: map[string]string{"features.images": "false", "features.profiles": "true"},
+		}, "etag").Return(nil)
+
+		require.NoError(t, l.ensureProject(cli, "runners"))
+		cli.AssertExpectations(t)
+	})
+
+	t.Run("project in sync", func(t *testing.T) {
+		cli := new(MockLXDServer)
+		l := &LXD{cfg: &config.LXD{AutoCreateProject: true, ProjectConfig: projectConfig}}
+		current := &api.Project{
+			Name:   "runners",
+			Config: map[string]string{"features.images": "false"},
+		}
+		cli.On("GetProject", "runners").Return(current, "etag", nil)
+
+		require.NoError(t, l.ensureProject(cli, "runners"))
+		cli.AssertNotCalled(t, "UpdateProject", mock.Anything, mock.Anything, mock.Anything)
+	})
+}
+
+func TestEnsureProfiles(t *testing.T) {
+	notFound := api.StatusErrorf(http.StatusNotFound, "not found")
+	l := &LXD{
+		cfg: &config.LXD{
+			Profiles: map[string]config.LXDProfile{
+				"small": {
+					Config: map[string]string{"limits.cpu": "2"},
+				},
+				"net": {
+					Description: "runner network",
+					Devices: map[string]map[string]string{
+						"eth0": {"type": "nic", "network": "lxdbr0", "name": "eth0"},
+					},
+				},
+			},
+		},
+	}
+
+	cli := new(MockLXDServer)
+	mockOp := new(MockOperation)
+	// "net" is missing and gets created.
+	cli.On("GetProfile", "net").Return((*api.Profile)(nil), "", notFound)
+	cli.On("CreateProfile", api.ProfilesPost{
+		Name: "net",
+		ProfilePut: api.ProfilePut{
+			Description: "runner network",
+			Devices: map[string]map[string]string{
+				"eth0": {"type": "nic", "network": "lxdbr0", "name": "eth0"},
+			},
+		},
+	}).Return(nil)
+	// "small" drifted and gets updated.
+	cli.On("GetProfile", "small").Return(&api.Profile{
+		Name:   "small",
+		Config: map[string]string{"limits.cpu": "4"},
+	}, "etag", nil)
+	cli.On("UpdateProfile", "small", api.ProfilePut{
+		Config: map[string]string{"limits.cpu": "2"},
+	}, "etag").Return(mockOp, nil)
+	mockOp.On("Wait").Return(nil)
+
+	require.NoError(t, l.ensureProfiles(cli))
+	cli.AssertExpectations(t)
+	mockOp.AssertExpectations(t)
+
+	// Profiles that match their definition are left alone.
+	cli = new(MockLXDServer)
+	cli.On("GetProfile", "net").Return(&api.Profile{
+		Name:        "net",
+		Description: "runner network",
+		Devices: map[string]map[string]string{
+			"eth0": {"type": "nic", "network": "lxdbr0", "name": "eth0"},
+		},
+		Config: map[string]string{},
+	}, "etag", nil)
+	cli.On("GetProfile", "small").Return(&api.Profile{
+		Name:   "small",
+		Config: map[string]string{"limits.cpu": "2"},
+	}, "etag", nil)
+
+	require.NoError(t, l.ensureProfiles(cli))
+	cli.AssertNotCalled(t, "CreateProfile", mock.Anything)
+	cli.AssertNotCalled(t, "UpdateProfile", mock.Anything, mock.Anything, mock.Anything)
+}
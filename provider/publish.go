@@ -0,0 +1,250 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+// Copyright 2023 Cloudbase Solutions SRL
+//
+// Licensed under the AGPLv3, see LICENCE file for details
+
+package provider
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	lxd "github.com/canonical/lxd/client"
+	"github.com/canonical/lxd/shared/api"
+	commonParams "github.com/cloudbase/garm-provider-common/params"
+	"github.com/cloudbase/garm-provider-lxd/config"
+	"github.com/pkg/errors"
+)
+
+const (
+	imageBuilderPrefix = "garm-build-"
+
+	// provisionScriptPath is where the provisioning script is copied inside the
+	// builder instance.
+	provisionScriptPath = "/root/garm-provision"
+
+	// builderCleanupCommand removes the provisioning script, and resets cloud-init, so
+	// instances created from the image run cloud-init as if it was their first boot.
+	// Older versions of cloud-init don't know about --machine-id.
+	builderCleanupCommand = "rm -f " + provisionScriptPath + " && (cloud-init clean --logs --machine-id || cloud-init clean --logs)"
+)
+
+// publishImages builds the images in the image_builds section of the config, and
+// writes a line for each of them to w. If aliases is empty, all images are built.
+func (l *LXD) publishImages(ctx context.Context, aliases []string, w io.Writer) error {
+	if len(aliases) == 0 {
+		aliases = slices.Sorted(maps.Keys(l.cfg.ImageBuilds))
+	}
+	for _, alias := range aliases {
+		if _, ok := l.cfg.ImageBuilds[alias]; !ok {
+			return fmt.Errorf("image %s is not defined in image_builds", alias)
+		}
+	}
+
+	var failed bool
+	for _, alias := range aliases {
+		fingerprint, err := l.publishImage(ctx, alias, l.cfg.ImageBuilds[alias])
+		if err != nil {
+			failed = true
+			fmt.Fprintf(w, "%s: failed: %s\n", alias, err)
+			continue
+		}
+		fmt.Fprintf(w, "%s: published %s\n", alias, shortFingerprint(fingerprint))
+	}
+
+	if failed {
+		return fmt.Errorf("failed to publish some images")
+	}
+	return nil
+}
+
+// publishImage launches a builder instance from the base image, provisions it, and
+// publishes it as an image with the given alias. If the alias already exists, it is
+// moved to the new image. The builder is always removed. It returns the fingerprint of
+// the new image.
+func (l *LXD) publishImage(ctx context.Context, alias string, build config.ImageBuild) (fingerprint string, err error) {
+	cli, err := l.getCLI(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "fetching client")
+	}
+
+	imageType := build.InstanceType
+	if imageType == "" {
+		imageType = getInstanceType(l.cfg, extraSpecs{})
+	}
+
+	server, err := l.getServer(cli)
+	if err != nil {
+		return "", err
+	}
+	var arch string
+	if build.Architecture != "" {
+		arch, err = resolveArchitecture(commonParams.OSArch(build.Architecture))
+	} else {
+		arch, err = getNativeArchitecture(server)
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "resolving architecture")
+	}
+	if err := validateServerArchitecture(server, imageType, arch); err != nil {
+		return "", errors.Wrap(err, "validating architecture")
+	}
+
+	script, err := os.ReadFile(build.Script)
+	if err != nil {
+		return "", errors.Wrap(err, "reading provisioning script")
+	}
+
+	source, err := l.imageManager.getInstanceSource(build.BaseImage, imageType, arch, cli)
+	if err != nil {
+		return "", errors.Wrap(err, "getting instance source")
+	}
+
+	name, err := randomInstanceName(imageBuilderPrefix)
+	if err != nil {
+		return "", err
+	}
+
+	profiles := build.Profiles
+	if len(profiles) == 0 {
+		profiles = []string{"default"}
+	}
+	configMap := map[string]string{}
+	if imageType == config.LXDImageVirtualMachine {
+		configMap["boot.mode"] = l.secureBootEnabled(extraSpecs{})
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, build.GetTimeout())
+	defer cancel()
+
+	args := api.InstancesPost{
+		InstancePut: api.InstancePut{
+			Architecture: arch,
+			Profiles:     profiles,
+			Description:  fmt.Sprintf("Builder of the %s image, provisioned by garm", alias),
+			Config:       configMap,
+		},
+		Source: source,
+		Name:   name,
+		Type:   api.InstanceType(imageType),
+	}
+	if err := l.launchInstance(ctx, "", "", args); err != nil {
+		return "", errors.Wrap(err, "launching builder")
+	}
+	defer func() {
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), instanceCleanupTimeout)
+		defer cancel()
+		if cleanupErr := l.DeleteInstance(cleanupCtx, name); cleanupErr != nil && err == nil {
+			err = errors.Wrapf(cleanupErr, "removing builder %s", name)
+		}
+	}()
+
+	if err := l.provisionBuilder(ctx, cli, name, build, script); err != nil {
+		return "", err
+	}
+
+	if err := l.setState(ctx, cli, name, "stop", false); err != nil {
+		return "", errors.Wrap(err, "stopping builder")
+	}
+
+	op, err := cli.CreateImage(api.ImagesPost{
+		ImagePut: api.ImagePut{
+			Properties: map[string]string{
+				"os":           build.OS,
+				"release":      build.Release,
+				"architecture": string(lxdArchToOSArch(arch)),
+				"description":  imageDescription(alias, build),
+			},
+		},
+		Source: &api.ImagesPostSource{
+			Type: "instance",
+			Name: name,
+		},
+	}, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "publishing image")
+	}
+	if err := op.Wait(); err != nil {
+		return "", errors.Wrap(err, "waiting for image to be published")
+	}
+
+	fingerprint, ok := op.Get().Metadata["fingerprint"].(string)
+	if !ok || fingerprint == "" {
+		return "", fmt.Errorf("published image has no fingerprint")
+	}
+	if err := setImageAlias(cli, alias, fingerprint, imageDescription(alias, build)); err != nil {
+		return "", errors.Wrapf(err, "setting alias %s", alias)
+	}
+	return fingerprint, nil
+}
+
+// provisionBuilder waits for the builder to boot, runs the provisioning script inside
+// it, and cleans up after it.
+func (l *LXD) provisionBuilder(ctx context.Context, cli InstanceServerInterface, name string, build config.ImageBuild, script []byte) error {
+	readiness := config.Readiness{
+		Condition: config.ReadinessCloudInit,
+		Timeout:   uint(build.GetTimeout().Seconds()),
+	}
+	if _, err := l.waitInstanceReady(ctx, name, readiness); err != nil {
+		return errors.Wrap(err, "waiting for builder to boot")
+	}
+
+	err := cli.CreateInstanceFile(name, provisionScriptPath, lxd.InstanceFileArgs{
+		Content:   bytes.NewReader(script),
+		Mode:      0o700,
+		Type:      "file",
+		WriteMode: "overwrite",
+	})
+	if err != nil {
+		return errors.Wrap(err, "copying provisioning script")
+	}
+
+	for _, command := range [][]string{
+		{provisionScriptPath},
+		{"sh", "-c", builderCleanupCommand},
+	} {
+		result, err := execInstance(ctx, cli, name, command)
+		if err != nil {
+			return errors.Wrap(err, "running command in builder")
+		}
+		if result.exitCode != 0 {
+			return fmt.Errorf("%q failed with exit code %d: %s", command[0], result.exitCode, strings.TrimSpace(result.stderr))
+		}
+	}
+	return nil
+}
+
+// setImageAlias points the alias to the image, creating the alias if needed.
+func setImageAlias(cli InstanceServerInterface, alias, fingerprint, description string) error {
+	current, etag, err := cli.GetImageAlias(alias)
+	if err != nil {
+		if !isNotFoundError(err) {
+			return errors.Wrap(err, "fetching alias")
+		}
+		return cli.CreateImageAlias(api.ImageAliasesPost{
+			ImageAliasesEntry: api.ImageAliasesEntry{
+				Name:        alias,
+				Description: description,
+				Target:      fingerprint,
+			},
+		})
+	}
+
+	return cli.UpdateImageAlias(alias, api.ImageAliasesEntryPut{
+		Description: current.Description,
+		Target:      fingerprint,
+	}, etag)
+}
+
+func imageDescription(alias string, build config.ImageBuild) string {
+	if build.Description != "" {
+		return build.Description
+	}
+	return fmt.Sprintf("%s %s runner image (%s)", build.OS, build.Release, alias)
+}
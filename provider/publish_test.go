@@ -0,0 +1,154 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+// Copyright 2023 Cloudbase Solutions SRL
+//
+// Licensed under the AGPLv3, see LICENCE file for details
+
+package provider
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	lxd "github.com/canonical/lxd/client"
+	"github.com/canonical/lxd/shared/api"
+	"github.com/cloudbase/garm-provider-lxd/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func isBuilder(name string) bool {
+	return strings.HasPrefix(name, imageBuilderPrefix)
+}
+
+func newPublishTestLXD(t *testing.T) (*LXD, *MockLXDServer) {
+	script := filepath.Join(t.TempDir(), "provision.sh")
+	require.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\napt-get install -y docker.io\n"), 0o600))
+
+	cli := new(MockLXDServer)
+	l := &LXD{
+		cfg: &config.LXD{
+			InstanceType: config.LXDImageContainer,
+			ImageBuilds: map[string]config.ImageBuild{
+				"runner-noble": {
+					BaseImage: "base",
+					Script:    script,
+					OS:        "ubuntu",
+					Release:   "noble",
+				},
+			},
+		},
+		cli:          cli,
+		imageManager: &image{},
+	}
+
+	mockOp := new(MockOperation)
+	mockOp.On("Wait").Return(nil)
+	mockOp.On("WaitContext", mock.Anything).Return(nil)
+
+	cli.On("GetServer").Return(&api.Server{
+		Environment: api.ServerEnvironment{Architectures: []string{"x86_64"}},
+	}, "", nil)
+	cli.On("GetImageAliasArchitectures", "container", "base").Return(map[string]*api.ImageAliasesEntry{
+		"x86_64": {Name: "base", Target: "basefp"},
+	}, nil)
+	cli.On("GetImage", "basefp").Return(&api.Image{Fingerprint: "basefp"}, "", nil)
+	cli.On("CreateInstance", mock.MatchedBy(func(args api.InstancesPost) bool {
+		return isBuilder(args.Name) &&
+			args.Architecture == "x86_64" &&
+			args.Source.Fingerprint == "basefp" &&
+			assert.ObjectsAreEqual([]string{"default"}, args.Profiles)
+	})).Return(mockOp, nil)
+	for _, state := range []api.InstanceStatePut{
+		{Action: "start", Timeout: -1},
+		{Action: "stop", Timeout: -1},
+		{Action: "stop", Timeout: -1, Force: true},
+	} {
+		cli.On("UpdateInstanceState", mock.MatchedBy(isBuilder), "", state).Return(mockOp, nil)
+	}
+	cli.On("GetEvents").Return((*lxd.EventListener)(nil), fmt.Errorf("events not available"))
+	cli.On("GetInstanceFull", mock.MatchedBy(isBuilder)).Return(&api.InstanceFull{
+		Instance: api.Instance{Type: "container"},
+		State:    &api.InstanceState{Status: "Running"},
+	}, "", nil)
+	mockExec(cli, mock.MatchedBy(isBuilder), []string{"cloud-init", "status"}, "status: done\n", 0)
+	cli.On("CreateInstanceFile", mock.MatchedBy(isBuilder), provisionScriptPath, mock.Anything).Return(nil)
+	cli.On("DeleteInstance", mock.MatchedBy(isBuilder), false).Return(mockOp, nil)
+	cli.On("GetInstance", mock.MatchedBy(isBuilder)).Return(&api.Instance{}, "", nil)
+	return l, cli
+}
+
+func TestPublishImages(t *testing.T) {
+	l, cli := newPublishTestLXD(t)
+	mockExec(cli, mock.MatchedBy(isBuilder), []string{provisionScriptPath}, "", 0)
+	mockExec(cli, mock.MatchedBy(isBuilder), []string{"sh", "-c", builderCleanupCommand}, "", 0)
+
+	publishOp := new(MockOperation)
+	publishOp.On("Wait").Return(nil)
+	publishOp.On("Get").Return(api.Operation{
+		Metadata: map[string]any{"fingerprint": "0123456789abcdef"},
+	})
+	cli.On("CreateImage", mock.MatchedBy(func(image api.ImagesPost) bool {
+		return isBuilder(image.Source.Name) &&
+			image.Source.Type == "instance" &&
+			assert.ObjectsAreEqual(map[string]string{
+				"os":           "ubuntu",
+				"release":      "noble",
+				"architecture": "amd64",
+				"description":  "ubuntu noble runner image (runner-noble)",
+			}, image.Properties)
+	}), (*lxd.ImageCreateArgs)(nil)).Return(publishOp, nil)
+	cli.On("GetImageAlias", "runner-noble").Return((*api.ImageAliasesEntry)(nil), "", api.StatusErrorf(http.StatusNotFound, "not found"))
+	cli.On("CreateImageAlias", api.ImageAliasesPost{
+		ImageAliasesEntry: api.ImageAliasesEntry{
+			Name:        "runner-noble",
+			Description: "ubuntu noble runner image (runner-noble)",
+			Target:      "0123456789abcdef",
+		},
+	}).Return(nil)
+
+	out := &bytes.Buffer{}
+	require.NoError(t, l.publishImages(context.Background(), nil, out))
+	assert.Equal(t, "runner-noble: published 0123456789ab\n", out.String())
+	cli.AssertCalled(t, "DeleteInstance", mock.MatchedBy(isBuilder), false)
+}
+
+func TestPublishImagesProvisioningFails(t *testing.T) {
+	l, cli := newPublishTestLXD(t)
+	mockExec(cli, mock.MatchedBy(isBuilder), []string{provisionScriptPath}, "", 100)
+
+	out := &bytes.Buffer{}
+	err := l.publishImages(context.Background(), []string{"runner-noble"}, out)
+	require.EqualError(t, err, "failed to publish some images")
+	assert.Contains(t, out.String(), `runner-noble: failed: "/root/garm-provision" failed with exit code 100`)
+	cli.AssertCalled(t, "DeleteInstance", mock.MatchedBy(isBuilder), false)
+	cli.AssertNotCalled(t, "CreateImage", mock.Anything, mock.Anything)
+}
+
+func TestPublishImagesUnknownAlias(t *testing.T) {
+	l, _ := newPublishTestLXD(t)
+	err := l.publishImages(context.Background(), []string{"missing"}, &bytes.Buffer{})
+	require.EqualError(t, err, "image missing is not defined in image_builds")
+}
+
+func TestSetImageAliasMovesExistingAlias(t *testing.T) {
+	cli := new(MockLXDServer)
+	cli.On("GetImageAlias", "runner-noble").Return(&api.ImageAliasesEntry{
+		Name:        "runner-noble",
+		Description: "custom description",
+		Target:      "oldfp",
+	}, "etag", nil)
+	cli.On("UpdateImageAlias", "runner-noble", api.ImageAliasesEntryPut{
+		Description: "custom description",
+		Target:      "newfp",
+	}, "etag").Return(nil)
+
+	require.NoError(t, setImageAlias(cli, "runner-noble", "newfp", "new description"))
+	cli.AssertExpectations(t)
+}
@@ -0,0 +1,197 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+// Copyright 2023 Cloudbase Solutions SRL
+//
+// Licensed under the AGPLv3, see LICENCE file for details
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/canonical/lxd/shared/api"
+	runnerErrors "github.com/cloudbase/garm-provider-common/errors"
+	commonParams "github.com/cloudbase/garm-provider-common/params"
+	"github.com/cloudbase/garm-provider-lxd/config"
+	"github.com/pkg/errors"
+)
+
+var (
+	// errInstanceFailed is returned by readiness checks when the instance will never
+	// become ready.
+	errInstanceFailed = fmt.Errorf("instance failed")
+)
+
+// getReadiness returns the readiness settings for an instance. Settings in the extra
+// specs of the pool take precedence over the ones in the provider config.
+func getReadiness(cfg *config.LXD, specs extraSpecs) config.Readiness {
+	readiness := cfg.GetReadiness()
+	if specs.Readiness == nil {
+		return readiness
+	}
+	if specs.Readiness.Condition != "" {
+		readiness.Condition = specs.Readiness.Condition
+	}
+	if specs.Readiness.Timeout != 0 {
+		readiness.Timeout = specs.Readiness.Timeout
+	}
+	return readiness
+}
+
+// getRunnerReadiness returns the readiness settings for a runner instance. We talk to
+// Windows runners through the LXD agent, so they are not ready until it is running.
+func getRunnerReadiness(cfg *config.LXD, specs extraSpecs, osType commonParams.OSType) config.Readiness {
+	readiness := getReadiness(cfg, specs)
+	if osType == commonParams.Windows {
+		readiness.Condition = config.ReadinessAgent
+	}
+	return readiness
+}
+
+// waitInstanceReady waits until the instance satisfies the readiness condition. We watch
+// the LXD event stream for the instance and check it as soon as something happens to it
+// (see watchInstance). That makes the state of the instance and the agent condition
+// event driven, as LXD sends an instance-ready event once the LXD agent of a virtual
+// machine is up. LXD does not emit events when an instance gets an address from DHCP,
+// or when cloud-init finishes, so the address and cloud-init conditions are satisfied
+// by the periodic check. If the events stream is not available, we only poll.
+func (l *LXD) waitInstanceReady(ctx context.Context, instanceName string, readiness config.Readiness) (commonParams.ProviderInstance, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(readiness.Timeout)*time.Second)
+	defer cancel()
+
+	cli, err := l.getInstanceCLI(ctx, instanceName)
+	if err != nil {
+		return commonParams.ProviderInstance{}, errors.Wrap(err, "fetching client")
+	}
+
+	changed, stopWatching, err := watchInstance(cli, instanceName)
+	if err == nil {
+		defer stopWatching()
+	}
+
+	ticker := time.NewTicker(instanceReadyPollInterval)
+	defer ticker.Stop()
+
+	var lastErr error
+	for {
+		ready, instance, err := l.checkInstanceReady(ctx, cli, instanceName, readiness.Condition)
+		if err != nil {
+			// An instance that disappeared or failed will never become ready.
+			if errors.Is(err, runnerErrors.ErrNotFound) || errors.Is(err, errInstanceFailed) {
+				return commonParams.ProviderInstance{}, err
+			}
+			lastErr = err
+		} else {
+			lastErr = nil
+			if ready {
+				return lxdInstanceToAPIInstance(instance), nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return commonParams.ProviderInstance{}, errors.Wrap(ctx.Err(), "waiting for instance to become ready")
+			}
+			if lastErr != nil {
+				return commonParams.ProviderInstance{}, errors.Wrapf(runnerErrors.ErrTimeout, "waiting for instance %s to satisfy readiness condition %s: %s", instanceName, readiness.Condition, lastErr)
+			}
+			return commonParams.ProviderInstance{}, errors.Wrapf(runnerErrors.ErrTimeout, "waiting for instance %s to satisfy readiness condition %s", instanceName, readiness.Condition)
+		case <-changed:
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkInstanceReady fetches the instance and checks if it satisfies the readiness
+// condition.
+func (l *LXD) checkInstanceReady(ctx context.Context, cli InstanceServerInterface, instanceName string, condition config.ReadinessCondition) (bool, *api.InstanceFull, error) {
+	instance, _, err := cli.GetInstanceFull(instanceName)
+	if err != nil {
+		if isNotFoundError(err) {
+			return false, nil, errors.Wrapf(runnerErrors.ErrNotFound, "fetching instance: %q", err)
+		}
+		return false, nil, errors.Wrap(err, "fetching instance")
+	}
+
+	if instance.State == nil {
+		return false, instance, nil
+	}
+
+	switch instance.State.Status {
+	case "Running":
+	case "Error":
+		return false, instance, errors.Wrapf(errInstanceFailed, "instance %s is in state %s", instanceName, instance.State.Status)
+	default:
+		return false, instance, nil
+	}
+
+	switch condition {
+	case config.ReadinessIPv4:
+		return hasAddress(instance, func(ip net.IP) bool { return ip.To4() != nil }), instance, nil
+	case config.ReadinessIPv6:
+		return hasAddress(instance, func(ip net.IP) bool { return ip.To4() == nil }), instance, nil
+	case config.ReadinessAnyIP:
+		return hasAddress(instance, func(ip net.IP) bool { return true }), instance, nil
+	case config.ReadinessAgent:
+		// The process count is only reported for virtual machines if the LXD agent
+		// is running.
+		if instance.Type != string(api.InstanceTypeVM) {
+			return true, instance, nil
+		}
+		return instance.State.Processes > 0, instance, nil
+	case config.ReadinessCloudInit:
+		ready, err := cloudInitDone(ctx, cli, instanceName)
+		return ready, instance, err
+	default:
+		return false, instance, runnerErrors.NewBadRequestError("invalid readiness condition %s", condition)
+	}
+}
+
+// hasAddress returns true if the instance has a global address that matches the filter.
+func hasAddress(instance *api.InstanceFull, filter func(net.IP) bool) bool {
+	for _, details := range instance.State.Network {
+		for _, addr := range details.Addresses {
+			if addr.Scope != "global" {
+				continue
+			}
+			ip := net.ParseIP(addr.Address)
+			if ip == nil {
+				continue
+			}
+			if filter(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cloudInitDone runs "cloud-init status" inside the instance and returns true once
+// cloud-init has finished. If cloud-init reports an error, the instance will never
+// become ready.
+func cloudInitDone(ctx context.Context, cli InstanceServerInterface, instanceName string) (bool, error) {
+	result, err := execInstance(ctx, cli, instanceName, []string{"cloud-init", "status"})
+	if err != nil {
+		return false, errors.Wrap(err, "fetching cloud-init status")
+	}
+
+	for _, line := range strings.Split(result.stdout, "\n") {
+		status, found := strings.CutPrefix(strings.TrimSpace(line), "status:")
+		if !found {
+			continue
+		}
+		switch strings.TrimSpace(status) {
+		case "done":
+			return true, nil
+		case "error":
+			return false, errors.Wrapf(errInstanceFailed, "cloud-init failed: %s", strings.TrimSpace(result.stdout+result.stderr))
+		default:
+			return false, nil
+		}
+	}
+	return false, fmt.Errorf("unexpected cloud-init status output (exit code %d): %s", result.exitCode, strings.TrimSpace(result.stdout+result.stderr))
+}
@@ -0,0 +1,350 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+// Copyright 2023 Cloudbase Solutions SRL
+//
+// Licensed under the AGPLv3, see LICENCE file for details
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	lxd "github.com/canonical/lxd/client"
+	"github.com/canonical/lxd/shared/api"
+	runnerErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/cloudbase/garm-provider-lxd/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func instanceWithAddress(address string) *api.InstanceFull {
+	instance := &api.InstanceFull{
+		Instance: api.Instance{
+			Name:         "test-instance",
+			Architecture: "x86_64",
+			ExpandedConfig: map[string]string{
+				"image.os": "ubuntu",
+			},
+			Type: "container",
+		},
+		State: &api.InstanceState{
+			Status: "Running",
+		},
+	}
+	if address != "" {
+		instance.State.Network = map[string]api.InstanceStateNetwork{
+			"eth0": {
+				Addresses: []api.InstanceStateNetworkAddress{
+					{
+						Address: address,
+						Scope:   "global",
+					},
+				},
+			},
+		}
+	}
+	return instance
+}
+
+// mockExec sets up the mock server to run a command inside an instance and return
+// the given output.
+func mockExec(cli *MockLXDServer, instanceName any, command []string, stdout string, exitCode int) {
+	op := new(MockOperation)
+	op.On("WaitContext", mock.Anything).Return(nil)
+	op.On("Get").Return(api.Operation{
+		Metadata: map[string]any{
+			"return": float64(exitCode),
+		},
+	})
+	cli.On("ExecInstance", instanceName, api.InstanceExecPost{Command: command, WaitForWS: true}, mock.Anything).Return(op, nil).Run(func(args mock.Arguments) {
+		execArgs := args.Get(2).(*lxd.InstanceExecArgs)
+		_, _ = execArgs.Stdout.Write([]byte(stdout))
+		close(execArgs.DataDone)
+	})
+}
+
+func TestGetReadiness(t *testing.T) {
+	cfg := &config.LXD{
+		Readiness: config.Readiness{
+			Condition: config.ReadinessAgent,
+		},
+	}
+
+	assert.Equal(t, config.Readiness{
+		Condition: config.ReadinessAgent,
+		Timeout:   config.DefaultReadinessTimeout,
+	}, getReadiness(cfg, extraSpecs{}))
+
+	assert.Equal(t, config.Readiness{
+		Condition: config.ReadinessAgent,
+		Timeout:   600,
+	}, getReadiness(cfg, extraSpecs{Readiness: &config.Readiness{Timeout: 600}}))
+
+	assert.Equal(t, config.Readiness{
+		Condition: config.ReadinessCloudInit,
+		Timeout:   30,
+	}, getReadiness(cfg, extraSpecs{Readiness: &config.Readiness{Condition: config.ReadinessCloudInit, Timeout: 30}}))
+}
+
+func TestCheckInstanceReady(t *testing.T) {
+	vmWithoutAgent := instanceWithAddress("")
+	vmWithoutAgent.Type = string(api.InstanceTypeVM)
+	vmWithoutAgent.State.Processes = -1
+	vmWithAgent := instanceWithAddress("")
+	vmWithAgent.Type = string(api.InstanceTypeVM)
+	vmWithAgent.State.Processes = 12
+	stopped := instanceWithAddress("10.10.0.1")
+	stopped.State.Status = "Stopped"
+	failed := instanceWithAddress("")
+	failed.State.Status = "Error"
+
+	tests := []struct {
+		name      string
+		instance  *api.InstanceFull
+		condition config.ReadinessCondition
+		setup     func(cli *MockLXDServer)
+		ready     bool
+		errIs     error
+	}{
+		{
+			name:      "ipv4 with ipv4 address",
+			instance:  instanceWithAddress("10.10.0.1"),
+			condition: config.ReadinessIPv4,
+			ready:     true,
+		},
+		{
+			name:      "ipv4 with ipv6 address",
+			instance:  instanceWithAddress("fd42::1"),
+			condition: config.ReadinessIPv4,
+			ready:     false,
+		},
+		{
+			name:      "ipv6 with ipv6 address",
+			instance:  instanceWithAddress("fd42::1"),
+			condition: config.ReadinessIPv6,
+			ready:     true,
+		},
+		{
+			name:      "ipv6 with ipv4 address",
+			instance:  instanceWithAddress("10.10.0.1"),
+			condition: config.ReadinessIPv6,
+			ready:     false,
+		},
+		{
+			name:      "any ip",
+			instance:  instanceWithAddress("fd42::1"),
+			condition: config.ReadinessAnyIP,
+			ready:     true,
+		},
+		{
+			name:      "any ip without address",
+			instance:  instanceWithAddress(""),
+			condition: config.ReadinessAnyIP,
+			ready:     false,
+		},
+		{
+			name:      "stopped instance",
+			instance:  stopped,
+			condition: config.ReadinessIPv4,
+			ready:     false,
+		},
+		{
+			name:      "instance in error state",
+			instance:  failed,
+			condition: config.ReadinessIPv4,
+			errIs:     errInstanceFailed,
+		},
+		{
+			name:      "agent on container",
+			instance:  instanceWithAddress(""),
+			condition: config.ReadinessAgent,
+			ready:     true,
+		},
+		{
+			name:      "agent on VM without agent",
+			instance:  vmWithoutAgent,
+			condition: config.ReadinessAgent,
+			ready:     false,
+		},
+		{
+			name:      "agent on VM with agent",
+			instance:  vmWithAgent,
+			condition: config.ReadinessAgent,
+			ready:     true,
+		},
+		{
+			name:      "cloud-init running",
+			instance:  instanceWithAddress("10.10.0.1"),
+			condition: config.ReadinessCloudInit,
+			setup: func(cli *MockLXDServer) {
+				mockExec(cli, "test-instance", []string{"cloud-init", "status"}, "status: running\n", 0)
+			},
+			ready: false,
+		},
+		{
+			name:      "cloud-init done",
+			instance:  instanceWithAddress("10.10.0.1"),
+			condition: config.ReadinessCloudInit,
+			setup: func(cli *MockLXDServer) {
+				mockExec(cli, "test-instance", []string{"cloud-init", "status"}, "status: done\n", 0)
+			},
+			ready: true,
+		},
+		{
+			name:      "cloud-init error",
+			instance:  instanceWithAddress("10.10.0.1"),
+			condition: config.ReadinessCloudInit,
+			setup: func(cli *MockLXDServer) {
+				mockExec(cli, "test-instance", []string{"cloud-init", "status"}, "status: error\n", 1)
+			},
+			errIs: errInstanceFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cli := new(MockLXDServer)
+			l := &LXD{
+				cfg:          &config.LXD{},
+				cli:          cli,
+				imageManager: &image{},
+				controllerID: "controller",
+			}
+			cli.On("GetInstanceFull", "test-instance").Return(tt.instance, "", nil)
+			if tt.setup != nil {
+				tt.setup(cli)
+			}
+
+			ready, _, err := l.checkInstanceReady(context.Background(), cli, "test-instance", tt.condition)
+			if tt.errIs != nil {
+				require.Error(t, err)
+				assert.ErrorIs(t, err, tt.errIs)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.ready, ready)
+		})
+	}
+}
+
+func TestWaitInstanceReadyOnEvent(t *testing.T) {
+	cli := new(MockLXDServer)
+	listener := new(MockEventListener)
+	l := &LXD{
+		cfg:          &config.LXD{},
+		cli:          cli,
+		imageManager: &image{},
+		controllerID: "controller",
+	}
+	getEventListener := DefaultGetEventListener
+	t.Cleanup(func() {
+		DefaultGetEventListener = getEventListener
+	})
+	DefaultGetEventListener = func(_ InstanceServerInterface) (EventListenerInterface, error) {
+		return listener, nil
+	}
+	listener.On("AddHandler", mock.Anything, mock.Anything).Return(&lxd.EventTarget{}, nil)
+	listener.On("Disconnect").Return()
+
+	metadata, err := json.Marshal(api.EventLifecycle{
+		Action: api.EventLifecycleInstanceUpdated,
+		Name:   "test-instance",
+	})
+	require.NoError(t, err)
+	cli.On("GetInstanceFull", "test-instance").Return(instanceWithAddress(""), "", nil).Once().Run(func(_ mock.Arguments) {
+		listener.SendEvent(api.Event{
+			Type:     api.EventTypeLifecycle,
+			Metadata: metadata,
+		})
+	})
+	cli.On("GetInstanceFull", "test-instance").Return(instanceWithAddress("10.10.0.1"), "", nil).Once()
+
+	start := time.Now()
+	instance, err := l.waitInstanceReady(context.Background(), "test-instance", l.cfg.GetReadiness())
+	require.NoError(t, err)
+	assert.Less(t, time.Since(start), instanceReadyPollInterval)
+	assert.Equal(t, "10.10.0.1", instance.Addresses[0].Address)
+	listener.AssertCalled(t, "Disconnect")
+}
+
+func TestWaitInstanceReadyErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		ctx       func() (context.Context, context.CancelFunc)
+		readiness config.Readiness
+		instance  *api.InstanceFull
+		err       error
+		errIs     error
+		errString string
+	}{
+		{
+			name: "context deadline",
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), 100*time.Millisecond)
+			},
+			readiness: config.Readiness{Condition: config.ReadinessIPv4, Timeout: 60},
+			instance:  instanceWithAddress("fd42::1"),
+			errIs:     runnerErrors.ErrTimeout,
+			errString: "waiting for instance test-instance to satisfy readiness condition ipv4",
+		},
+		{
+			name: "readiness timeout",
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithCancel(context.Background())
+			},
+			readiness: config.Readiness{Condition: config.ReadinessIPv6, Timeout: 1},
+			instance:  instanceWithAddress("10.10.0.1"),
+			errIs:     runnerErrors.ErrTimeout,
+			errString: "waiting for instance test-instance to satisfy readiness condition ipv6",
+		},
+		{
+			name: "canceled",
+			ctx: func() (context.Context, context.CancelFunc) {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				return ctx, cancel
+			},
+			readiness: config.Readiness{Condition: config.ReadinessIPv4, Timeout: 60},
+			instance:  instanceWithAddress(""),
+			errIs:     context.Canceled,
+			errString: "waiting for instance to become ready",
+		},
+		{
+			name: "instance not found",
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithCancel(context.Background())
+			},
+			readiness: config.Readiness{Condition: config.ReadinessIPv4, Timeout: 60},
+			instance:  &api.InstanceFull{},
+			err:       api.StatusErrorf(http.StatusNotFound, "not found"),
+			errIs:     runnerErrors.ErrNotFound,
+			errString: "fetching instance",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cli := new(MockLXDServer)
+			l := &LXD{
+				cfg:          &config.LXD{},
+				cli:          cli,
+				imageManager: &image{},
+				controllerID: "controller",
+			}
+			cli.On("GetEvents").Return((*lxd.EventListener)(nil), fmt.Errorf("events not available"))
+			cli.On("GetInstanceFull", "test-instance").Return(tt.instance, "", tt.err)
+
+			ctx, cancel := tt.ctx()
+			defer cancel()
+			_, err := l.waitInstanceReady(ctx, "test-instance", tt.readiness)
+			require.Error(t, err)
+			assert.ErrorIs(t, err, tt.errIs)
+			assert.Contains(t, err.Error(), tt.errString)
+		})
+	}
+}
@@ -11,6 +11,7 @@ import (
 
 	cloudconfig "github.com/cloudbase/garm-provider-common/cloudconfig"
 	commonParams "github.com/cloudbase/garm-provider-common/params"
+	"github.com/cloudbase/garm-provider-lxd/config"
 	"github.com/pkg/errors"
 	"github.com/xeipuuv/gojsonschema"
 )
@@ -19,6 +20,24 @@ type extraSpecs struct {
 	ExtraPackages   []string `json:"extra_packages,omitempty" jsonschema:"title=extra packages,description=A list of packages that cloud-init should install on the instance."`
 	DisableUpdates  bool     `json:"disable_updates,omitempty" jsonschema:"title=disable updates,description=Whether to disable updates when cloud-init comes online."`
 	EnableBootDebug bool     `json:"enable_boot_debug,omitempty" jsonschema:"title=enable boot debug,description=Allows providers to set the -x flag in the runner install script."`
+	// Overrides of the provider config.
+	InstanceType config.LXDImageType `json:"instance_type,omitempty" jsonschema:"title=instance type,description=Overrides the instance type from the provider config.,enum=container,enum=virtual-machine"`
+	SecureBoot   *bool               `json:"secure_boot,omitempty" jsonschema:"title=secure boot,description=Overrides the secure boot setting from the provider config. Only used for virtual machines."`
+	TPM          *bool               `json:"tpm,omitempty" jsonschema:"title=tpm,description=Whether to add a virtual TPM to Windows runners. Defaults to true."`
+	Project      string              `json:"project,omitempty" jsonschema:"title=project,description=Overrides the project from the provider config. The project must be in the list of allowed projects."`
+	// Target is the cluster member, or cluster group prefixed with @, to create instances on.
+	Target string `json:"target,omitempty" jsonschema:"title=target,description=Cluster member or cluster group (prefixed with @) to create instances on. Only valid when connected to an LXD cluster."`
+	// Resource limits. These are applied on top of the flavor profile.
+	CPU          uint   `json:"cpu,omitempty" jsonschema:"title=cpu,description=Number of CPUs to expose to the instance (limits.cpu).,minimum=1"`
+	Memory       string `json:"memory,omitempty" jsonschema:"title=memory,description=Memory limit of the instance (limits.memory). Can be an absolute value (2GiB) or a percentage of the host memory (50%).,pattern=^[0-9]+(%|B|kB|MB|GB|TB|PB|EB|KiB|MiB|GiB|TiB|PiB|EiB)?$"`
+	RootDiskSize string `json:"root_disk_size,omitempty" jsonschema:"title=root disk size,description=Size of the root disk of the instance (10GiB). Overrides the size of the root disk inherited from the profiles.,pattern=^[0-9]+(B|kB|MB|GB|TB|PB|EB|KiB|MiB|GiB|TiB|PiB|EiB)?$"`
+	Processes    uint   `json:"processes,omitempty" jsonschema:"title=processes,description=Maximum number of processes that can run in the instance (limits.processes). Only supported for containers.,minimum=1"`
+	CPUAllowance string `json:"cpu_allowance,omitempty" jsonschema:"title=cpu allowance,description=CPU time available to the instance (limits.cpu.allowance). Can be a percentage (50%) or a time slice (25ms/100ms). Only supported for containers.,pattern=^([0-9]+%|[0-9]+ms/[0-9]+ms)$"`
+	// VendorData is merged into the vendor-data of the runners, after the vendor-data
+	// from the provider config.
+	VendorData string `json:"vendor_data,omitempty" jsonschema:"title=vendor data,description=Cloud-config merged into the vendor-data of the runners of the pool. Must start with #cloud-config. Not used for Windows runners."`
+	// Readiness overrides the readiness settings from the provider config.
+	Readiness *config.Readiness `json:"readiness,omitempty" jsonschema:"title=readiness,description=Overrides the conditions a new instance needs to satisfy to be considered ready."`
 	// The Cloudconfig struct from common package
 	cloudconfig.CloudConfigSpec
 }
@@ -11,6 +11,7 @@ import (
 
 	"github.com/cloudbase/garm-provider-common/cloudconfig"
 	"github.com/cloudbase/garm-provider-common/params"
+	"github.com/cloudbase/garm-provider-lxd/config"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -94,6 +95,47 @@ var testCases = []struct {
 		},
 		errString: "",
 	},
+	{
+		name:  "specs just with readiness",
+		input: json.RawMessage(`{"readiness": {"condition": "cloud-init", "timeout": 600}}`),
+		expectedOutput: extraSpecs{
+			Readiness: &config.Readiness{
+				Condition: config.ReadinessCloudInit,
+				Timeout:   600,
+			},
+		},
+		errString: "",
+	},
+	{
+		name:  "specs just with config overrides",
+		input: json.RawMessage(`{"instance_type": "virtual-machine", "secure_boot": false, "project": "garm-vms"}`),
+		expectedOutput: extraSpecs{
+			InstanceType: config.LXDImageVirtualMachine,
+			SecureBoot:   ptr(false),
+			Project:      "garm-vms",
+		},
+		errString: "",
+	},
+	{
+		name:  "specs just with target",
+		input: json.RawMessage(`{"target": "@gpu"}`),
+		expectedOutput: extraSpecs{
+			Target: "@gpu",
+		},
+		errString: "",
+	},
+	{
+		name:  "specs just with resource limits",
+		input: json.RawMessage(`{"cpu": 4, "memory": "8GiB", "root_disk_size": "20GiB", "processes": 1000, "cpu_allowance": "25ms/100ms"}`),
+		expectedOutput: extraSpecs{
+			CPU:          4,
+			Memory:       "8GiB",
+			RootDiskSize: "20GiB",
+			Processes:    1000,
+			CPUAllowance: "25ms/100ms",
+		},
+		errString: "",
+	},
 	{
 		name:           "empty specs",
 		input:          json.RawMessage(`{}`),
@@ -142,6 +184,42 @@ var testCases = []struct {
 		expectedOutput: extraSpecs{},
 		errString:      "schema validation failed: [extra_context: Invalid type. Expected: object, given: array]",
 	},
+	{
+		name:           "invalid input for readiness - unknown condition",
+		input:          json.RawMessage(`{"readiness": {"condition": "bogus"}}`),
+		expectedOutput: extraSpecs{},
+		errString:      "readiness.condition: readiness.condition must be one of the following",
+	},
+	{
+		name:           "invalid input for instance_type - unknown type",
+		input:          json.RawMessage(`{"instance_type": "vm"}`),
+		expectedOutput: extraSpecs{},
+		errString:      "instance_type: instance_type must be one of the following",
+	},
+	{
+		name:           "invalid input for cpu - zero",
+		input:          json.RawMessage(`{"cpu": 0}`),
+		expectedOutput: extraSpecs{},
+		errString:      "cpu: Must be greater than or equal to 1",
+	},
+	{
+		name:           "invalid input for memory - unknown unit",
+		input:          json.RawMessage(`{"memory": "8 gigs"}`),
+		expectedOutput: extraSpecs{},
+		errString:      "memory: Does not match pattern",
+	},
+	{
+		name:           "invalid input for root_disk_size - percentage",
+		input:          json.RawMessage(`{"root_disk_size": "50%"}`),
+		expectedOutput: extraSpecs{},
+		errString:      "root_disk_size: Does not match pattern",
+	},
+	{
+		name:           "invalid input for cpu_allowance - wrong format",
+		input:          json.RawMessage(`{"cpu_allowance": "2"}`),
+		expectedOutput: extraSpecs{},
+		errString:      "cpu_allowance: Does not match pattern",
+	},
 	{
 		name:           "invalid input - additional property",
 		input:          json.RawMessage(`{"additional_property": true}`),
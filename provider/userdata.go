@@ -0,0 +1,345 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+// Copyright 2023 Cloudbase Solutions SRL
+//
+// Licensed under the AGPLv3, see LICENCE file for details
+
+package provider
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/canonical/lxd/shared/api"
+	"github.com/cloudbase/garm-provider-common/defaults"
+	commonParams "github.com/cloudbase/garm-provider-common/params"
+	"github.com/cloudbase/garm-provider-lxd/config"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// sshKeysExtension is the LXD API extension that adds the cloud-init.ssh-keys.*
+	// instance config keys.
+	sshKeysExtension = "cloud_init_ssh_keys"
+	// sshKeyConfigPrefix is the prefix of the instance config keys LXD uses to
+	// pass SSH keys to cloud-init.
+	sshKeyConfigPrefix = "cloud-init.ssh-keys."
+	// cloudInitConfigExtension is the LXD API extension that adds the cloud-init.*
+	// instance config keys, which replace the user.user-data and user.vendor-data keys.
+	cloudInitConfigExtension = "instance_config_cloud_init"
+	// userDataKeyName is the instance config key holding the cloud-init user-data.
+	userDataKeyName = "cloud-init.user-data"
+	// vendorDataKeyName is the instance config key holding the cloud-init vendor-data.
+	// Cloud-init merges the vendor-data with the user-data, so settings we add here
+	// are applied regardless of the runner install template used in the user-data.
+	vendorDataKeyName = "cloud-init.vendor-data"
+	// legacyUserDataKeyName and legacyVendorDataKeyName are the keys used instead of
+	// the cloud-init.* keys on LXD servers that don't support them.
+	legacyUserDataKeyName   = "user.user-data"
+	legacyVendorDataKeyName = "user.vendor-data"
+
+	cloudConfigHeader = "#cloud-config"
+
+	// userDataStub replaces the user-data of runners once they are ready. The user-data
+	// holds the credentials the runner registers with, which should not stay in the
+	// instance config, where anyone with access to the project can read them.
+	userDataStub = cloudConfigHeader + "\n# The user-data of this runner was removed by garm once it was read, as it holds the credentials of the runner.\n"
+	// cloudInitInstanceIDPath is where cloud-init stores the ID of the instance it last
+	// ran for. It is written once the datasource, with the user-data, was read.
+	cloudInitInstanceIDPath = "/var/lib/cloud/data/instance-id"
+	// cloudInitInstanceIDKeyName is the instance config key holding the instance ID LXD
+	// gives to cloud-init. LXD changes it when the instance is renamed, or its cloud-init
+	// config changes, so cloud-init runs again for claimed warm instances.
+	cloudInitInstanceIDKeyName = "volatile.cloud-init.instance-id"
+	// cloudbaseInitUserDataStatusCommand prints the status cloudbase-init recorded for
+	// the user-data plugin of an instance ID. The status is 1 once the plugin ran, and
+	// the user-data won't be read again for that instance ID.
+	cloudbaseInitUserDataStatusCommand = `(Get-ItemProperty -Path 'HKLM:\SOFTWARE\Cloudbase Solutions\Cloudbase-Init\%s\Plugins' -Name UserDataPlugin -ErrorAction Stop).UserDataPlugin`
+	// cloudbaseInitUserDataDone is the status of a cloudbase-init plugin that ran.
+	cloudbaseInitUserDataDone = "1"
+
+	// windowsAdminKeysPath is the file OpenSSH for Windows reads the authorized keys
+	// of administrators from.
+	windowsAdminKeysPath = `C:\ProgramData\ssh\administrators_authorized_keys`
+)
+
+type vendorDataCACerts struct {
+	Trusted []string `yaml:"trusted"`
+}
+
+// vendorData is the cloud-config we send as vendor-data to Linux instances.
+type vendorData struct {
+	SSHAuthorizedKeys []string           `yaml:"ssh_authorized_keys,omitempty"`
+	CACerts           *vendorDataCACerts `yaml:"ca_certs,omitempty"`
+}
+
+func getSSHKeys(bootstrapParams commonParams.BootstrapInstance) []string {
+	keys := []string{}
+	for _, key := range bootstrapParams.SSHKeys {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func validateCACertBundle(bundle []byte) error {
+	roots := x509.NewCertPool()
+	if ok := roots.AppendCertsFromPEM(bundle); !ok {
+		return fmt.Errorf("failed to parse CA cert bundle")
+	}
+	return nil
+}
+
+// getCloudInitKeys returns the instance config keys the user-data and the vendor-data
+// are set in. Older LXD servers only know about the user.* keys.
+func getCloudInitKeys(server *api.Server) (string, string) {
+	if hasServerExtension(server, cloudInitConfigExtension) {
+		return userDataKeyName, vendorDataKeyName
+	}
+	return legacyUserDataKeyName, legacyVendorDataKeyName
+}
+
+// parseCloudConfig parses a cloud-config document. Only cloud-config is supported, as
+// the documents are merged into a single one.
+func parseCloudConfig(doc string) (map[string]any, error) {
+	header, _, _ := strings.Cut(doc, "\n")
+	if strings.TrimSpace(header) != cloudConfigHeader {
+		return nil, fmt.Errorf("vendor data must start with %s", cloudConfigHeader)
+	}
+	ret := map[string]any{}
+	if err := yaml.Unmarshal([]byte(doc), &ret); err != nil {
+		return nil, errors.Wrap(err, "parsing cloud-config")
+	}
+	return ret, nil
+}
+
+// mergeCloudConfig merges src into dst. Mappings are merged recursively, lists are
+// concatenated, and any other value in src replaces the one in dst.
+func mergeCloudConfig(dst, src map[string]any) {
+	for key, value := range src {
+		switch srcValue := value.(type) {
+		case map[string]any:
+			if dstValue, ok := dst[key].(map[string]any); ok {
+				mergeCloudConfig(dstValue, srcValue)
+				continue
+			}
+		case []any:
+			if dstValue, ok := dst[key].([]any); ok {
+				dst[key] = append(dstValue, srcValue...)
+				continue
+			}
+		}
+		dst[key] = value
+	}
+}
+
+// getLinuxAccessConfig returns the instance config keys that install the SSH keys and
+// the CA bundle from the bootstrap params on Linux instances, through cloud-init.
+// If the server supports it, SSH keys are set using the cloud-init.ssh-keys.* config
+// keys. Otherwise they are added to the vendor-data, along with the CA bundle. The
+// extra vendor-data documents are merged, in order, into the vendor-data before them.
+func getLinuxAccessConfig(server *api.Server, bootstrapParams commonParams.BootstrapInstance, extraVendorData ...string) (map[string]string, error) {
+	ret := map[string]string{}
+	data := vendorData{}
+
+	keys := getSSHKeys(bootstrapParams)
+	if len(keys) > 0 {
+		if hasServerExtension(server, sshKeysExtension) {
+			for idx, key := range keys {
+				ret[fmt.Sprintf("%sgarm-%d", sshKeyConfigPrefix, idx)] = fmt.Sprintf("%s:%s", defaults.DefaultUser, key)
+			}
+		} else {
+			data.SSHAuthorizedKeys = keys
+		}
+	}
+
+	if len(bootstrapParams.CACertBundle) > 0 {
+		if err := validateCACertBundle(bootstrapParams.CACertBundle); err != nil {
+			return nil, errors.Wrap(err, "validating CA bundle")
+		}
+		data.CACerts = &vendorDataCACerts{
+			Trusted: []string{string(bootstrapParams.CACertBundle)},
+		}
+	}
+
+	docs := slices.Clone(extraVendorData)
+	if data.SSHAuthorizedKeys != nil || data.CACerts != nil {
+		asYaml, err := yaml.Marshal(data)
+		if err != nil {
+			return nil, errors.Wrap(err, "marshaling vendor data")
+		}
+		docs = append(docs, fmt.Sprintf("%s\n%s", cloudConfigHeader, asYaml))
+	}
+	if len(docs) == 0 {
+		return ret, nil
+	}
+
+	merged := map[string]any{}
+	for _, doc := range docs {
+		cloudConfig, err := parseCloudConfig(doc)
+		if err != nil {
+			return nil, err
+		}
+		mergeCloudConfig(merged, cloudConfig)
+	}
+	asYaml, err := yaml.Marshal(merged)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshaling vendor data")
+	}
+	_, vendorDataKey := getCloudInitKeys(server)
+	ret[vendorDataKey] = fmt.Sprintf("%s\n%s", cloudConfigHeader, asYaml)
+	return ret, nil
+}
+
+// getWindowsBootstrapScript wraps the runner install script in a script that first
+// installs the SSH keys and the CA bundle from the bootstrap params. Windows images use
+// cloudbase-init, which does not handle vendor-data, so we need to do this ourselves.
+// The install script is passed in base64 encoded and run as a separate script, as it
+// may have its own param block.
+func getWindowsBootstrapScript(bootstrapParams commonParams.BootstrapInstance, installScript string) (string, error) {
+	keys := getSSHKeys(bootstrapParams)
+	if len(keys) == 0 && len(bootstrapParams.CACertBundle) == 0 {
+		return fmt.Sprintf("#ps1_sysnative\n%s", installScript), nil
+	}
+
+	var script strings.Builder
+	script.WriteString("#ps1_sysnative\n")
+	script.WriteString("$ErrorActionPreference=\"Stop\"\n\n")
+
+	if len(bootstrapParams.CACertBundle) > 0 {
+		if err := validateCACertBundle(bootstrapParams.CACertBundle); err != nil {
+			return "", errors.Wrap(err, "validating CA bundle")
+		}
+		fmt.Fprintf(&script, `$caBundle = [System.Text.Encoding]::UTF8.GetString([System.Convert]::FromBase64String("%s"))
+$store = New-Object System.Security.Cryptography.X509Certificates.X509Store("Root", "LocalMachine")
+$store.Open([System.Security.Cryptography.X509Certificates.OpenFlags]::ReadWrite)
+foreach ($match in [regex]::Matches($caBundle, "-----BEGIN CERTIFICATE-----[\s\S]+?-----END CERTIFICATE-----")) {
+	$cert = [System.Security.Cryptography.X509Certificates.X509Certificate2]::new([System.Text.Encoding]::ASCII.GetBytes($match.Value))
+	$store.Add($cert)
+}
+$store.Close()
+
+`, base64.StdEncoding.EncodeToString(bootstrapParams.CACertBundle))
+	}
+
+	if len(keys) > 0 {
+		fmt.Fprintf(&script, `$sshKeys = [System.Text.Encoding]::UTF8.GetString([System.Convert]::FromBase64String("%s"))
+$keysFile = "%s"
+New-Item -ItemType Directory -Force -Path (Split-Path $keysFile) | Out-Null
+Add-Content -Path $keysFile -Value $sshKeys -Encoding UTF8
+icacls.exe $keysFile /inheritance:r /grant "Administrators:F" /grant "SYSTEM:F" | Out-Null
+
+`, base64.StdEncoding.EncodeToString([]byte(strings.Join(keys, "\n"))), windowsAdminKeysPath)
+	}
+
+	fmt.Fprintf(&script, `$installScript = Join-Path $env:TEMP "garm-install-runner.ps1"
+$contents = [System.Text.Encoding]::UTF8.GetString([System.Convert]::FromBase64String("%s"))
+Set-Content -Path $installScript -Value $contents -Encoding UTF8
+try {
+	& $installScript
+} finally {
+	Remove-Item -Force $installScript
+}
+`, base64.StdEncoding.EncodeToString([]byte(installScript)))
+
+	return script.String(), nil
+}
+
+// removeUserData replaces the user-data of a runner that is ready with a stub, so the
+// credentials of the runner don't persist in the instance config. Cloud-init and
+// cloudbase-init read the user-data once, on the first boot of the instance.
+func (l *LXD) removeUserData(ctx context.Context, instanceName string, osType commonParams.OSType, readiness config.Readiness) error {
+	cli, err := l.getInstanceCLI(ctx, instanceName)
+	if err != nil {
+		return errors.Wrap(err, "fetching client")
+	}
+
+	// The LXD agent may come online before the user-data was read. Every other
+	// readiness condition is only satisfied once cloud-init read it. Windows runners
+	// always use the agent condition.
+	if readiness.Condition == config.ReadinessAgent {
+		if err := waitUserDataRead(ctx, cli, instanceName, osType, time.Duration(readiness.Timeout)*time.Second); err != nil {
+			return err
+		}
+	}
+
+	instance, etag, err := cli.GetInstance(instanceName)
+	if err != nil {
+		return errors.Wrap(err, "fetching instance")
+	}
+	instancePut := instance.Writable()
+	instancePut.Config = maps.Clone(instance.Config)
+	var changed bool
+	for _, key := range []string{userDataKeyName, legacyUserDataKeyName} {
+		if value, ok := instancePut.Config[key]; ok && value != userDataStub {
+			instancePut.Config[key] = userDataStub
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	op, err := cli.UpdateInstance(instanceName, instancePut, etag)
+	if err != nil {
+		return errors.Wrap(err, "updating instance config")
+	}
+	if err := op.Wait(); err != nil {
+		return errors.Wrap(err, "waiting for instance config update")
+	}
+	return nil
+}
+
+// waitUserDataRead waits for cloud-init to read the user-data of the current instance
+// ID. Warm instances already booted once, so cloud-init has the data of that boot
+// around, until it runs for the instance ID the runner was started with.
+//
+// On Windows, we wait for cloudbase-init to run the user-data. Replacing the user-data
+// changes the instance ID, and LXD rebuilds the config drive on the next boot. If
+// cloudbase-init reboots the instance before it ran the user-data, it would run the
+// stub for the new instance ID instead.
+func waitUserDataRead(ctx context.Context, cli InstanceServerInterface, instanceName string, osType commonParams.OSType, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	instance, _, err := cli.GetInstance(instanceName)
+	if err != nil {
+		return errors.Wrap(err, "fetching instance")
+	}
+	// Older LXD servers use the name of the instance as its ID.
+	instanceID := instance.Config[cloudInitInstanceIDKeyName]
+	if instanceID == "" {
+		instanceID = instanceName
+	}
+
+	command := []string{"cat", cloudInitInstanceIDPath}
+	expected := instanceID
+	if osType == commonParams.Windows {
+		command = []string{"powershell.exe", "-NoProfile", "-NonInteractive", "-Command", fmt.Sprintf(cloudbaseInitUserDataStatusCommand, instanceID)}
+		expected = cloudbaseInitUserDataDone
+	}
+
+	ticker := time.NewTicker(instanceReadyPollInterval)
+	defer ticker.Stop()
+	for {
+		result, err := execInstance(ctx, cli, instanceName, command)
+		if err == nil && result.exitCode == 0 && strings.TrimSpace(result.stdout) == expected {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "waiting for the user-data to be read")
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,534 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+// Copyright 2023 Cloudbase Solutions SRL
+//
+// Licensed under the AGPLv3, see LICENCE file for details
+
+package provider
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"maps"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	lxd "github.com/canonical/lxd/client"
+	"github.com/canonical/lxd/shared/api"
+	commonParams "github.com/cloudbase/garm-provider-common/params"
+	"github.com/cloudbase/garm-provider-lxd/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func generateTestCACert(t *testing.T) []byte {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "garm-test-ca"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestGetLinuxAccessConfig(t *testing.T) {
+	caBundle := generateTestCACert(t)
+	keys := []string{"ssh-ed25519 AAAA1 first", " ", "ssh-ed25519 AAAA2 second"}
+
+	tests := []struct {
+		name              string
+		hasExtension      bool
+		bootstrapParams   commonParams.BootstrapInstance
+		expectedKeys      map[string]string
+		expectedVendorKey []string
+		expectCA          bool
+		errString         string
+	}{
+		{
+			name:            "nothing to inject",
+			hasExtension:    true,
+			bootstrapParams: commonParams.BootstrapInstance{},
+			expectedKeys:    map[string]string{},
+		},
+		{
+			name:         "ssh keys with extension",
+			hasExtension: true,
+			bootstrapParams: commonParams.BootstrapInstance{
+				SSHKeys: keys,
+			},
+			expectedKeys: map[string]string{
+				"cloud-init.ssh-keys.garm-0": "runner:ssh-ed25519 AAAA1 first",
+				"cloud-init.ssh-keys.garm-1": "runner:ssh-ed25519 AAAA2 second",
+			},
+		},
+		{
+			name:         "ssh keys without extension",
+			hasExtension: false,
+			bootstrapParams: commonParams.BootstrapInstance{
+				SSHKeys: keys,
+			},
+			expectedKeys:      map[string]string{},
+			expectedVendorKey: []string{"ssh-ed25519 AAAA1 first", "ssh-ed25519 AAAA2 second"},
+		},
+		{
+			name:         "ca bundle",
+			hasExtension: true,
+			bootstrapParams: commonParams.BootstrapInstance{
+				CACertBundle: caBundle,
+			},
+			expectedKeys: map[string]string{},
+			expectCA:     true,
+		},
+		{
+			name:         "invalid ca bundle",
+			hasExtension: true,
+			bootstrapParams: commonParams.BootstrapInstance{
+				CACertBundle: []byte("not a certificate"),
+			},
+			errString: "validating CA bundle",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &api.Server{}
+			if tt.hasExtension {
+				server.APIExtensions = []string{sshKeysExtension, cloudInitConfigExtension}
+			}
+			vendorDataKey := legacyVendorDataKeyName
+			if tt.hasExtension {
+				vendorDataKey = vendorDataKeyName
+			}
+
+			ret, err := getLinuxAccessConfig(server, tt.bootstrapParams)
+			if tt.errString != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.errString)
+				return
+			}
+			require.NoError(t, err)
+
+			vendorDataRaw, hasVendorData := ret[vendorDataKey]
+			delete(ret, vendorDataKey)
+			assert.Equal(t, tt.expectedKeys, ret)
+			if tt.expectedVendorKey == nil && !tt.expectCA {
+				assert.False(t, hasVendorData)
+				return
+			}
+
+			require.True(t, strings.HasPrefix(vendorDataRaw, "#cloud-config\n"))
+			var data vendorData
+			require.NoError(t, yaml.Unmarshal([]byte(vendorDataRaw), &data))
+			assert.Equal(t, tt.expectedVendorKey, data.SSHAuthorizedKeys)
+			if tt.expectCA {
+				require.NotNil(t, data.CACerts)
+				assert.Equal(t, []string{string(caBundle)}, data.CACerts.Trusted)
+			} else {
+				assert.Nil(t, data.CACerts)
+			}
+		})
+	}
+}
+
+func TestGetLinuxAccessConfigVendorData(t *testing.T) {
+	caBundle := generateTestCACert(t)
+	server := &api.Server{
+		ServerUntrusted: api.ServerUntrusted{APIExtensions: []string{cloudInitConfigExtension}},
+	}
+
+	providerVendorData := "#cloud-config\nntp:\n  servers: [ntp.example.com]\nca_certs:\n  trusted: [provider-ca]\n"
+	poolVendorData := "#cloud-config\nntp:\n  enabled: true\napt:\n  primary:\n    - arches: [default]\n      uri: http://mirror.example.com/ubuntu\n"
+	ret, err := getLinuxAccessConfig(server, commonParams.BootstrapInstance{
+		SSHKeys:      []string{"ssh-ed25519 AAAA1 first"},
+		CACertBundle: caBundle,
+	}, providerVendorData, poolVendorData)
+	require.NoError(t, err)
+
+	require.Contains(t, ret, vendorDataKeyName)
+	require.True(t, strings.HasPrefix(ret[vendorDataKeyName], "#cloud-config\n"))
+	var merged map[string]any
+	require.NoError(t, yaml.Unmarshal([]byte(ret[vendorDataKeyName]), &merged))
+	assert.Equal(t, map[string]any{
+		"servers": []any{"ntp.example.com"},
+		"enabled": true,
+	}, merged["ntp"])
+	assert.Equal(t, map[string]any{
+		"trusted": []any{"provider-ca", string(caBundle)},
+	}, merged["ca_certs"])
+	assert.Equal(t, []any{"ssh-ed25519 AAAA1 first"}, merged["ssh_authorized_keys"])
+	assert.Contains(t, merged, "apt")
+
+	// Vendor data alone is set, even without SSH keys or CA bundle.
+	ret, err = getLinuxAccessConfig(server, commonParams.BootstrapInstance{}, poolVendorData)
+	require.NoError(t, err)
+	assert.Contains(t, ret[vendorDataKeyName], "mirror.example.com")
+
+	_, err = getLinuxAccessConfig(server, commonParams.BootstrapInstance{}, "#!/bin/sh\necho hello\n")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "vendor data must start with #cloud-config")
+}
+
+func TestGetWindowsBootstrapScript(t *testing.T) {
+	caBundle := generateTestCACert(t)
+	installScript := "Param(\n\t$Token=\"abc\"\n)\nWrite-Host \"install\""
+
+	ret, err := getWindowsBootstrapScript(commonParams.BootstrapInstance{}, installScript)
+	require.NoError(t, err)
+	assert.Equal(t, "#ps1_sysnative\n"+installScript, ret)
+
+	ret, err = getWindowsBootstrapScript(commonParams.BootstrapInstance{
+		SSHKeys:      []string{"ssh-ed25519 AAAA1 first"},
+		CACertBundle: caBundle,
+	}, installScript)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(ret, "#ps1_sysnative\n"))
+	assert.Contains(t, ret, base64.StdEncoding.EncodeToString(caBundle))
+	assert.Contains(t, ret, base64.StdEncoding.EncodeToString([]byte("ssh-ed25519 AAAA1 first")))
+	assert.Contains(t, ret, windowsAdminKeysPath)
+	assert.Contains(t, ret, base64.StdEncoding.EncodeToString([]byte(installScript)))
+	assert.NotContains(t, ret, "Param(")
+
+	_, err = getWindowsBootstrapScript(commonParams.BootstrapInstance{
+		CACertBundle: []byte("not a certificate"),
+	}, installScript)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "validating CA bundle")
+}
+
+func TestGetCreateInstanceArgsAccess(t *testing.T) {
+	ctx := context.Background()
+	caBundle := generateTestCACert(t)
+	sshKeys := []string{"ssh-ed25519 AAAA1 first"}
+
+	tools := []commonParams.RunnerApplicationDownload{
+		{
+			OS:           ptr("linux"),
+			Architecture: ptr("x64"),
+			DownloadURL:  ptr("https://example.com"),
+			Filename:     ptr("test-app"),
+		},
+	}
+	DefaultToolFetch = func(_ commonParams.OSType, _ commonParams.OSArch, tools []commonParams.RunnerApplicationDownload) (commonParams.RunnerApplicationDownload, error) {
+		return tools[0], nil
+	}
+	// The custom template drops the SSH keys and the CA bundle. The provider
+	// must inject them regardless.
+	DefaultGetCloudconfig = func(_ commonParams.BootstrapInstance, _ commonParams.RunnerApplicationDownload, _ string) (string, error) {
+		return "#cloud-config\nruncmd: []", nil
+	}
+
+	tests := []struct {
+		name         string
+		instanceType config.LXDImageType
+		osType       commonParams.OSType
+		hasExtension bool
+		check        func(t *testing.T, cfg map[string]string)
+	}{
+		{
+			name:         "linux container",
+			instanceType: config.LXDImageContainer,
+			osType:       commonParams.Linux,
+			hasExtension: true,
+			check: func(t *testing.T, cfg map[string]string) {
+				assert.Equal(t, "#cloud-config\nruncmd: []", cfg[userDataKeyName])
+				assert.NotContains(t, cfg, legacyUserDataKeyName)
+				assert.Equal(t, "runner:ssh-ed25519 AAAA1 first", cfg["cloud-init.ssh-keys.garm-0"])
+				assert.Contains(t, cfg[vendorDataKeyName], "ca_certs:")
+				assert.NotContains(t, cfg[vendorDataKeyName], "ssh_authorized_keys")
+			},
+		},
+		{
+			name:         "linux vm",
+			instanceType: config.LXDImageVirtualMachine,
+			osType:       commonParams.Linux,
+			hasExtension: false,
+			check: func(t *testing.T, cfg map[string]string) {
+				assert.Equal(t, "#cloud-config\nruncmd: []", cfg[legacyUserDataKeyName])
+				assert.NotContains(t, cfg, userDataKeyName)
+				assert.NotContains(t, cfg, "cloud-init.ssh-keys.garm-0")
+				assert.Contains(t, cfg[legacyVendorDataKeyName], "ca_certs:")
+				assert.Contains(t, cfg[legacyVendorDataKeyName], "ssh-ed25519 AAAA1 first")
+				assert.Equal(t, "uefi-nosecureboot", cfg["boot.mode"])
+			},
+		},
+		{
+			name:         "windows vm",
+			instanceType: config.LXDImageVirtualMachine,
+			osType:       commonParams.Windows,
+			hasExtension: true,
+			check: func(t *testing.T, cfg map[string]string) {
+				userData := cfg[userDataKeyName]
+				assert.True(t, strings.HasPrefix(userData, "#ps1_sysnative\n"))
+				assert.NotContains(t, cfg, legacyUserDataKeyName)
+				assert.Equal(t, "uefi-nosecureboot", cfg["boot.mode"])
+				assert.Contains(t, userData, base64.StdEncoding.EncodeToString(caBundle))
+				assert.Contains(t, userData, base64.StdEncoding.EncodeToString([]byte(sshKeys[0])))
+				assert.NotContains(t, cfg, vendorDataKeyName)
+				assert.NotContains(t, cfg, "cloud-init.ssh-keys.garm-0")
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cli := new(MockLXDServer)
+			l := &LXD{
+				cfg: &config.LXD{
+					UnixSocket:   "/var/snap/lxd/common/lxd/unix.socket",
+					InstanceType: tt.instanceType,
+				},
+				cli:          cli,
+				imageManager: &image{},
+				controllerID: "controller",
+			}
+			aliases := map[string]*api.ImageAliasesEntry{
+				"x86_64": {
+					Name: "runner-image",
+					Type: tt.instanceType.String(),
+				},
+			}
+			cli.On("GetImageAliasArchitectures", tt.instanceType.String(), "runner-image").Return(aliases, nil)
+			cli.On("GetImage", aliases["x86_64"].Target).Return(&api.Image{Fingerprint: "123abc"}, "", nil)
+			server := &api.Server{
+				Environment: api.ServerEnvironment{Architectures: []string{"x86_64", "i686"}},
+			}
+			if tt.hasExtension {
+				server.APIExtensions = []string{sshKeysExtension, cloudInitConfigExtension}
+			}
+			cli.On("GetServer").Return(server, "", nil)
+			cli.On("GetProfileNames").Return([]string{"default"}, nil)
+
+			ret, err := l.getCreateInstanceArgs(ctx, commonParams.BootstrapInstance{
+				Name:         "test-instance",
+				Tools:        tools,
+				Image:        "runner-image",
+				Flavor:       "default",
+				OSArch:       commonParams.Amd64,
+				OSType:       tt.osType,
+				SSHKeys:      sshKeys,
+				CACertBundle: caBundle,
+			}, extraSpecs{})
+			require.NoError(t, err)
+			tt.check(t, ret.Config)
+		})
+	}
+}
+
+func TestCreateInstanceRemovesUserData(t *testing.T) {
+	ctx := context.Background()
+	cli := new(MockLXDServer)
+	l := &LXD{
+		cfg: &config.LXD{
+			UnixSocket:   "/var/snap/lxd/common/lxd/unix.socket",
+			InstanceType: config.LXDImageVirtualMachine,
+			Readiness:    config.Readiness{Condition: config.ReadinessAgent},
+		},
+		cli:          cli,
+		imageManager: &image{},
+		controllerID: "controller",
+	}
+
+	const token = "secret-instance-token"
+	const callbackURL = "https://garm.example.com/api/v1/callbacks"
+	DefaultToolFetch = func(_ commonParams.OSType, _ commonParams.OSArch, tools []commonParams.RunnerApplicationDownload) (commonParams.RunnerApplicationDownload, error) {
+		return tools[0], nil
+	}
+	DefaultGetCloudconfig = func(bootstrapParams commonParams.BootstrapInstance, _ commonParams.RunnerApplicationDownload, _ string) (string, error) {
+		return fmt.Sprintf("#cloud-config\nruncmd:\n  - register --token %s --url %s\n", bootstrapParams.InstanceToken, bootstrapParams.CallbackURL), nil
+	}
+
+	aliases := map[string]*api.ImageAliasesEntry{
+		"x86_64": {
+			Name: "runner-image",
+			Type: config.LXDImageVirtualMachine.String(),
+		},
+	}
+	cli.On("GetProfileNames").Return([]string{"default"}, nil)
+	cli.On("GetImageAliasArchitectures", config.LXDImageVirtualMachine.String(), "runner-image").Return(aliases, nil)
+	cli.On("GetImage", aliases["x86_64"].Target).Return(&api.Image{Fingerprint: "123abc"}, "", nil)
+	cli.On("GetServer").Return(&api.Server{
+		ServerUntrusted: api.ServerUntrusted{APIExtensions: []string{cloudInitConfigExtension}},
+		Environment:     api.ServerEnvironment{Architectures: []string{"x86_64"}},
+	}, "", nil)
+	cli.On("IsClustered").Return(false)
+	cli.On("GetEvents").Return((*lxd.EventListener)(nil), fmt.Errorf("events not available"))
+
+	// The instance config, as LXD stores it.
+	instance := &api.Instance{Name: "runner"}
+	var createdConfig map[string]string
+	mockOp := new(MockOperation)
+	mockOp.On("Wait").Return(nil)
+	mockOp.On("WaitContext", mock.Anything).Return(nil)
+	cli.On("CreateInstance", mock.Anything).Return(mockOp, nil).Run(func(args mock.Arguments) {
+		createdConfig = args.Get(0).(api.InstancesPost).Config
+		instance.Config = maps.Clone(createdConfig)
+	})
+	cli.On("UpdateInstanceState", "runner", "", api.InstanceStatePut{
+		Action:  "start",
+		Timeout: -1,
+	}).Return(mockOp, nil)
+	cli.On("GetInstanceFull", "runner").Return(&api.InstanceFull{
+		Instance: api.Instance{
+			Name:           "runner",
+			Architecture:   "x86_64",
+			Type:           string(api.InstanceTypeVM),
+			ExpandedConfig: map[string]string{"image.os": "ubuntu"},
+		},
+		State: &api.InstanceState{Status: "Running", Processes: 10},
+	}, "", nil)
+	mockExec(cli, "runner", []string{"cat", cloudInitInstanceIDPath}, "runner\n", 0)
+	cli.On("GetInstance", "runner").Return(instance, "etag", nil)
+	cli.On("UpdateInstance", "runner", mock.Anything, "etag").Return(mockOp, nil).Run(func(args mock.Arguments) {
+		instance.Config = args.Get(1).(api.InstancePut).Config
+	})
+
+	_, err := l.CreateInstance(ctx, commonParams.BootstrapInstance{
+		Name:          "runner",
+		Image:         "runner-image",
+		Flavor:        "default",
+		OSArch:        commonParams.Amd64,
+		OSType:        commonParams.Linux,
+		InstanceToken: token,
+		CallbackURL:   callbackURL,
+		Tools: []commonParams.RunnerApplicationDownload{
+			{
+				OS:           ptr("linux"),
+				Architecture: ptr("x64"),
+				DownloadURL:  ptr("https://example.com"),
+				Filename:     ptr("test-app"),
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	// The runner was created with its credentials, but they are gone once it's ready.
+	assert.Contains(t, createdConfig[userDataKeyName], token)
+	assert.Equal(t, userDataStub, instance.Config[userDataKeyName])
+	for key, value := range instance.Config {
+		assert.NotContains(t, value, token, "token found in %s", key)
+		assert.NotContains(t, value, callbackURL, "callback URL found in %s", key)
+	}
+}
+
+func TestRemoveUserDataClaimedWarmInstance(t *testing.T) {
+	ctx := context.Background()
+	cli := new(MockLXDServer)
+	l := &LXD{
+		cfg:          &config.LXD{},
+		cli:          cli,
+		imageManager: &image{},
+		controllerID: "controller",
+	}
+
+	// The warm instance booted once with its own instance ID. Claiming it set the
+	// user-data of the runner, and LXD gave it a new instance ID.
+	instance := &api.Instance{
+		Name: "runner",
+		Config: map[string]string{
+			userDataKeyName:            "#cloud-config\nruncmd: [register]",
+			cloudInitInstanceIDKeyName: "runner-id",
+		},
+	}
+	cli.On("GetInstance", "runner").Return(instance, "etag", nil)
+
+	// Cloud-init first reports the instance ID of the warm boot, then the current one.
+	instanceIDs := []string{"warm-id\n", "runner-id\n"}
+	var reads int
+	op := new(MockOperation)
+	op.On("WaitContext", mock.Anything).Return(nil)
+	op.On("Get").Return(api.Operation{Metadata: map[string]any{"return": float64(0)}})
+	cli.On("ExecInstance", "runner", api.InstanceExecPost{Command: []string{"cat", cloudInitInstanceIDPath}, WaitForWS: true}, mock.Anything).Return(op, nil).Run(func(args mock.Arguments) {
+		execArgs := args.Get(2).(*lxd.InstanceExecArgs)
+		_, _ = execArgs.Stdout.Write([]byte(instanceIDs[min(reads, len(instanceIDs)-1)]))
+		reads++
+		close(execArgs.DataDone)
+	})
+
+	var readsBeforeUpdate int
+	updateOp := new(MockOperation)
+	updateOp.On("Wait").Return(nil)
+	cli.On("UpdateInstance", "runner", mock.Anything, "etag").Return(updateOp, nil).Run(func(args mock.Arguments) {
+		readsBeforeUpdate = reads
+		instance.Config = args.Get(1).(api.InstancePut).Config
+	})
+
+	err := l.removeUserData(ctx, "runner", commonParams.Linux, config.Readiness{Condition: config.ReadinessAgent, Timeout: 30})
+	require.NoError(t, err)
+	assert.Equal(t, 2, readsBeforeUpdate)
+	assert.Equal(t, userDataStub, instance.Config[userDataKeyName])
+}
+
+func TestRemoveUserDataWindows(t *testing.T) {
+	ctx := context.Background()
+	cli := new(MockLXDServer)
+	l := &LXD{
+		cfg:          &config.LXD{},
+		cli:          cli,
+		imageManager: &image{},
+		controllerID: "controller",
+	}
+
+	instance := &api.Instance{
+		Name: "runner",
+		Config: map[string]string{
+			userDataKeyName:            "#ps1_sysnative\nregister",
+			cloudInitInstanceIDKeyName: "runner-id",
+		},
+	}
+	cli.On("GetInstance", "runner").Return(instance, "etag", nil)
+
+	// Cloudbase-init may reboot the runner before it runs the user-data. Replacing the
+	// user-data changes the config drive on the next boot, so we wait until the user-data
+	// plugin ran for the instance ID of the runner.
+	var reads int
+	command := []string{"powershell.exe", "-NoProfile", "-NonInteractive", "-Command", fmt.Sprintf(cloudbaseInitUserDataStatusCommand, "runner-id")}
+	for _, status := range []struct {
+		stdout   string
+		exitCode int
+	}{
+		{stdout: "", exitCode: 1},
+		{stdout: "1\r\n", exitCode: 0},
+	} {
+		op := new(MockOperation)
+		op.On("WaitContext", mock.Anything).Return(nil)
+		op.On("Get").Return(api.Operation{Metadata: map[string]any{"return": float64(status.exitCode)}})
+		cli.On("ExecInstance", "runner", api.InstanceExecPost{Command: command, WaitForWS: true}, mock.Anything).Return(op, nil).Run(func(args mock.Arguments) {
+			execArgs := args.Get(2).(*lxd.InstanceExecArgs)
+			_, _ = execArgs.Stdout.Write([]byte(status.stdout))
+			reads++
+			close(execArgs.DataDone)
+		}).Once()
+	}
+
+	var readsBeforeUpdate int
+	updateOp := new(MockOperation)
+	updateOp.On("Wait").Return(nil)
+	cli.On("UpdateInstance", "runner", mock.Anything, "etag").Return(updateOp, nil).Run(func(args mock.Arguments) {
+		readsBeforeUpdate = reads
+		instance.Config = args.Get(1).(api.InstancePut).Config
+	})
+
+	err := l.removeUserData(ctx, "runner", commonParams.Windows, config.Readiness{Condition: config.ReadinessAgent, Timeout: 30})
+	require.NoError(t, err)
+	assert.Equal(t, 2, readsBeforeUpdate)
+	assert.Equal(t, userDataStub, instance.Config[userDataKeyName])
+}
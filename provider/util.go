@@ -6,15 +6,18 @@
 package provider
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"fmt"
-	"net"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
-	"time"
 
+	runnerErrors "github.com/cloudbase/garm-provider-common/errors"
 	commonParams "github.com/cloudbase/garm-provider-common/params"
 
 	"github.com/cloudbase/garm-provider-common/util"
@@ -22,9 +25,8 @@ import (
 
 	lxd "github.com/canonical/lxd/client"
 	"github.com/canonical/lxd/shared/api"
+	"github.com/canonical/lxd/shared/osarch"
 	"github.com/invopop/jsonschema"
-	"github.com/juju/clock"
-	"github.com/juju/retry"
 	"github.com/pkg/errors"
 )
 
@@ -55,13 +57,23 @@ func isNotFoundError(err error) bool {
 func lxdInstanceToAPIInstance(instance *api.InstanceFull) commonParams.ProviderInstance {
 	lxdOS := instance.ExpandedConfig["image.os"]
 
-	osType, _ := util.OSToOSType(lxdOS)
-
-	if osType == "" {
-		osTypeFromTag := instance.ExpandedConfig[osTypeKeyName]
-		osType = commonParams.OSType(osTypeFromTag)
+	osType, err := util.OSToOSType(lxdOS)
+	if err != nil {
+		if osTypeFromTag := instance.ExpandedConfig[osTypeKeyName]; osTypeFromTag != "" {
+			osType = commonParams.OSType(osTypeFromTag)
+		}
+	}
+	if lxdOS == "" {
+		lxdOS = instance.ExpandedConfig[guestOSNameKey]
 	}
 	osRelease := instance.ExpandedConfig["image.release"]
+	if osRelease == "" {
+		osRelease = instance.ExpandedConfig[guestOSVersionKey]
+	}
+	if fingerprint := instance.ExpandedConfig[imageFingerprintKey]; fingerprint != "" && osRelease != "" {
+		// Report the image the runner was created from, so pools can be pinned to it.
+		osRelease = fmt.Sprintf("%s (%s)", osRelease, shortFingerprint(fingerprint))
+	}
 
 	state := instance.State
 	addresses := []commonParams.Address{}
@@ -78,7 +90,7 @@ func lxdInstanceToAPIInstance(instance *api.InstanceFull) commonParams.ProviderI
 			}
 		}
 	}
-	instanceArch := lxdToConfigArch[instance.Architecture]
+	instanceArch := lxdArchToOSArch(instance.Architecture)
 
 	return commonParams.ProviderInstance{
 		OSArch:     instanceArch,
@@ -98,6 +110,8 @@ func lxdStatusToProviderStatus(status string) commonParams.InstanceStatus {
 		return commonParams.InstanceRunning
 	case "Stopped":
 		return commonParams.InstanceStopped
+	case "Error":
+		return commonParams.InstanceError
 	default:
 		return commonParams.InstanceStatusUnknown
 	}
@@ -169,51 +183,134 @@ func projectName(cfg *config.LXD) string {
 	return DefaultProjectName
 }
 
+// resolveArchitecture returns the LXD name of an architecture. Besides the GARM
+// architectures, any LXD architecture name or alias is accepted. The GARM names are
+// looked up first, as LXD considers "arm" an alias of armv6l, while GARM uses it for
+// armv7l.
 func resolveArchitecture(osArch commonParams.OSArch) (string, error) {
 	if string(osArch) == "" {
 		return configToLXDArchMap[commonParams.Amd64], nil
 	}
-	arch, ok := configToLXDArchMap[osArch]
-	if !ok {
+	if arch, ok := configToLXDArchMap[osArch]; ok {
+		return arch, nil
+	}
+	id, err := osarch.ArchitectureId(string(osArch))
+	if err != nil {
 		return "", fmt.Errorf("architecture %s is not supported", osArch)
 	}
-	return arch, nil
+	return osarch.ArchitectureName(id)
 }
 
-// waitDeviceActive is a function capable of figuring out when a Equinix Metal
-// device is active
-func (l *LXD) waitInstanceHasIP(ctx context.Context, instanceName string) (commonParams.ProviderInstance, error) {
-	var p commonParams.ProviderInstance
-	var errIPNotFound error = fmt.Errorf("ip not found")
-	err := retry.Call(retry.CallArgs{
-		Func: func() error {
-			var err error
-			p, err = l.GetInstance(ctx, instanceName)
-			if err != nil {
-				return errors.Wrap(err, "fetching instance")
-			}
-			for _, addr := range p.Addresses {
-				ip := net.ParseIP(addr.Address)
-				if ip == nil {
-					continue
-				}
-				if ip.To4() == nil {
-					continue
-				}
-				return nil
-			}
-			return errIPNotFound
-		},
-		Attempts: 20,
-		Delay:    5 * time.Second,
-		Clock:    clock.WallClock,
-	})
+// lxdArchToOSArch returns the architecture we report to GARM for an LXD
+// architecture. Architectures GARM has no name for are reported by their LXD name,
+// and the ones LXD doesn't know either as unknownArchitecture.
+func lxdArchToOSArch(arch string) commonParams.OSArch {
+	if osArch, ok := lxdToConfigArch[arch]; ok {
+		return osArch
+	}
+	id, err := osarch.ArchitectureId(arch)
+	if err != nil {
+		return unknownArchitecture
+	}
+	name, err := osarch.ArchitectureName(id)
+	if err != nil {
+		return unknownArchitecture
+	}
+	if osArch, ok := lxdToConfigArch[name]; ok {
+		return osArch
+	}
+	return commonParams.OSArch(name)
+}
+
+// hasServerExtension returns true if the LXD server supports the API extension. Clients
+// are created without fetching the server info, and until it is fetched, their
+// HasExtension method assumes every extension is supported. So we check the extensions
+// the server reports ourselves.
+func hasServerExtension(server *api.Server, extension string) bool {
+	return slices.Contains(server.APIExtensions, extension)
+}
+
+// serverArchitectures returns the architectures the LXD server can run instances of
+// the given type. Containers can use any architecture the kernel of the server has a
+// personality for (i686 on x86_64, armv7l on aarch64, etc). Virtual machines are run
+// with hardware virtualization, and LXD doesn't emulate other architectures, so they
+// are limited to the native architecture of the server.
+func serverArchitectures(server *api.Server, instanceType config.LXDImageType) []string {
+	architectures := server.Environment.Architectures
+	if instanceType == config.LXDImageVirtualMachine && len(architectures) > 0 {
+		architectures = architectures[:1]
+	}
+	return architectures
+}
 
-	if err != nil && err != errIPNotFound {
-		return commonParams.ProviderInstance{}, err
+// validateServerArchitecture returns an error if the LXD server can't run instances
+// of the given type and architecture.
+func validateServerArchitecture(server *api.Server, instanceType config.LXDImageType, arch string) error {
+	supported := serverArchitectures(server, instanceType)
+	if !slices.Contains(supported, arch) {
+		if instanceType == config.LXDImageVirtualMachine {
+			return runnerErrors.NewBadRequestError("architecture %s is not supported by the LXD server for virtual machines (supported: %s)", arch, strings.Join(supported, ", "))
+		}
+		return runnerErrors.NewBadRequestError("architecture %s is not supported by the LXD server (supported: %s)", arch, strings.Join(supported, ", "))
+	}
+	return nil
+}
+
+type execResult struct {
+	stdout   string
+	stderr   string
+	exitCode int
+}
+
+// execInstance runs a command inside an instance and waits for it to finish.
+func execInstance(ctx context.Context, cli InstanceServerInterface, instanceName string, command []string) (execResult, error) {
+	var stdout, stderr bytes.Buffer
+	dataDone := make(chan bool)
+
+	req := api.InstanceExecPost{
+		Command:   command,
+		WaitForWS: true,
+	}
+	args := &lxd.InstanceExecArgs{
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+		DataDone: dataDone,
+	}
+
+	op, err := cli.ExecInstance(instanceName, req, args)
+	if err != nil {
+		return execResult{}, errors.Wrapf(err, "executing %q", command)
+	}
+
+	if err := op.WaitContext(ctx); err != nil {
+		return execResult{}, errors.Wrapf(err, "waiting for %q", command)
 	}
 
-	return p, nil
+	// Wait for all the output to be copied.
+	select {
+	case <-dataDone:
+	case <-ctx.Done():
+		return execResult{}, errors.Wrapf(ctx.Err(), "waiting for output of %q", command)
+	}
+
+	result := execResult{
+		stdout:   stdout.String(),
+		stderr:   stderr.String(),
+		exitCode: -1,
+	}
+	if exitCode, ok := op.Get().Metadata["return"].(float64); ok {
+		result.exitCode = int(exitCode)
+	}
+	return result, nil
+}
+
+// randomInstanceName returns a name for an instance the provider creates for itself.
+func randomInstanceName(prefix string) (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", errors.Wrap(err, "generating instance name")
+	}
+	return prefix + hex.EncodeToString(suffix), nil
 }
 
 func ptr[T any](v T) *T {
@@ -229,3 +326,16 @@ func generateJSONSchema() *jsonschema.Schema {
 
 	return schema
 }
+
+func generateConfigJSONSchema() *jsonschema.Schema {
+	reflector := jsonschema.Reflector{
+		AllowAdditionalProperties:  false,
+		RequiredFromJSONSchemaTags: true,
+		// The provider config is a TOML file, so we use the toml tags
+		// to name the properties.
+		FieldNameTag: "toml",
+	}
+	schema := reflector.Reflect(config.LXD{})
+
+	return schema
+}
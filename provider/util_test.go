@@ -11,6 +11,7 @@ import (
 	"testing"
 
 	"github.com/canonical/lxd/shared/api"
+	runnerErrors "github.com/cloudbase/garm-provider-common/errors"
 	commonParams "github.com/cloudbase/garm-provider-common/params"
 	"github.com/cloudbase/garm-provider-lxd/config"
 	"github.com/stretchr/testify/assert"
@@ -102,7 +103,7 @@ func TestLxdInstanceToAPIInstace(t *testing.T) {
 			expectedOutput: commonParams.ProviderInstance{
 				ProviderID: "test-instance",
 				Name:       "test-instance",
-				OSType:     commonParams.Unknown,
+				OSType:     commonParams.Linux,
 				OSArch:     "amd64",
 				OSVersion:  "20.04",
 				OSName:     "",
@@ -110,6 +111,67 @@ func TestLxdInstanceToAPIInstace(t *testing.T) {
 				Status:     "running",
 			},
 		},
+		{
+			name: "with image fingerprint",
+			instance: &api.InstanceFull{
+				Instance: api.Instance{
+					ExpandedConfig: map[string]string{
+						"image.os":               "ubuntu",
+						"image.release":          "24.04",
+						"user.image-fingerprint": "4d0b9e8a3c2f1e6d7b5a4c3d2e1f0a9b8c7d6e5f4a3b2c1d0e9f8a7b6c5d4e3f",
+					},
+					Name:         "test-instance",
+					Architecture: "x86_64",
+					Status:       "Running",
+					Type:         "container",
+					Project:      "default",
+				},
+				State: &api.InstanceState{
+					Status:  "Running",
+					Network: nil,
+				},
+			},
+			expectedOutput: commonParams.ProviderInstance{
+				ProviderID: "test-instance",
+				Name:       "test-instance",
+				OSType:     commonParams.Linux,
+				OSArch:     "amd64",
+				OSVersion:  "24.04 (4d0b9e8a3c2f)",
+				OSName:     "ubuntu",
+				Addresses:  []commonParams.Address{},
+				Status:     "running",
+			},
+		},
+		{
+			name: "with image fingerprint and no release",
+			instance: &api.InstanceFull{
+				Instance: api.Instance{
+					ExpandedConfig: map[string]string{
+						"image.os":               "ubuntu",
+						"user.image-fingerprint": "4d0b9e8a3c2f1e6d7b5a4c3d2e1f0a9b8c7d6e5f4a3b2c1d0e9f8a7b6c5d4e3f",
+					},
+					Name:         "test-instance",
+					Architecture: "x86_64",
+					Status:       "Running",
+					Type:         "container",
+					Project:      "default",
+				},
+				State: &api.InstanceState{
+					Status:  "Running",
+					Network: nil,
+				},
+			},
+			expectedOutput: commonParams.ProviderInstance{
+				ProviderID: "test-instance",
+				Name:       "test-instance",
+				OSType:     commonParams.Linux,
+				OSArch:     "amd64",
+				OSVersion:  "",
+				OSName:     "ubuntu",
+				Addresses:  []commonParams.Address{},
+				Status:     "running",
+			},
+		},
 		{
 			name: "with addresses",
 			instance: &api.InstanceFull{
@@ -172,6 +234,97 @@ func TestLxdInstanceToAPIInstace(t *testing.T) {
 	}
 }
 
+func TestResolveArchitecture(t *testing.T) {
+	tests := []struct {
+		osArch    commonParams.OSArch
+		expected  string
+		errString string
+	}{
+		{osArch: "", expected: "x86_64"},
+		{osArch: commonParams.Amd64, expected: "x86_64"},
+		{osArch: commonParams.I386, expected: "i686"},
+		{osArch: commonParams.Arm64, expected: "aarch64"},
+		{osArch: commonParams.Arm, expected: "armv7l"},
+		{osArch: "ppc64le", expected: "ppc64le"},
+		{osArch: "ppc64el", expected: "ppc64le"},
+		{osArch: "s390x", expected: "s390x"},
+		{osArch: "riscv64", expected: "riscv64"},
+		{osArch: "x86_64", expected: "x86_64"},
+		{osArch: "bad-arch", errString: "architecture bad-arch is not supported"},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.osArch), func(t *testing.T) {
+			arch, err := resolveArchitecture(tt.osArch)
+			if tt.errString != "" {
+				assert.EqualError(t, err, tt.errString)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, arch)
+		})
+	}
+}
+
+func TestLXDArchToOSArch(t *testing.T) {
+	assert.Equal(t, commonParams.Amd64, lxdArchToOSArch("x86_64"))
+	assert.Equal(t, commonParams.Amd64, lxdArchToOSArch("amd64"))
+	assert.Equal(t, commonParams.I386, lxdArchToOSArch("i686"))
+	assert.Equal(t, commonParams.Arm64, lxdArchToOSArch("arm64"))
+	assert.Equal(t, commonParams.Arm, lxdArchToOSArch("armv7l"))
+	assert.Equal(t, commonParams.OSArch("ppc64le"), lxdArchToOSArch("ppc64le"))
+	assert.Equal(t, commonParams.OSArch("riscv64"), lxdArchToOSArch("riscv64"))
+	assert.Equal(t, unknownArchitecture, lxdArchToOSArch("bogus"))
+	assert.Equal(t, unknownArchitecture, lxdArchToOSArch(""))
+}
+
+func TestValidateServerArchitecture(t *testing.T) {
+	server := &api.Server{
+		Environment: api.ServerEnvironment{Architectures: []string{"x86_64", "i686"}},
+	}
+
+	tests := []struct {
+		name         string
+		instanceType config.LXDImageType
+		arch         string
+		errString    string
+	}{
+		{name: "native container", instanceType: config.LXDImageContainer, arch: "x86_64"},
+		{name: "native virtual machine", instanceType: config.LXDImageVirtualMachine, arch: "x86_64"},
+		{name: "personality container", instanceType: config.LXDImageContainer, arch: "i686"},
+		{
+			name:         "personality virtual machine",
+			instanceType: config.LXDImageVirtualMachine,
+			arch:         "i686",
+			errString:    "architecture i686 is not supported by the LXD server for virtual machines (supported: x86_64)",
+		},
+		{
+			name:         "foreign container",
+			instanceType: config.LXDImageContainer,
+			arch:         "aarch64",
+			errString:    "architecture aarch64 is not supported by the LXD server (supported: x86_64, i686)",
+		},
+		{
+			name:         "foreign virtual machine",
+			instanceType: config.LXDImageVirtualMachine,
+			arch:         "aarch64",
+			errString:    "architecture aarch64 is not supported by the LXD server for virtual machines (supported: x86_64)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateServerArchitecture(server, tt.instanceType, tt.arch)
+			if tt.errString != "" {
+				assert.ErrorIs(t, err, runnerErrors.ErrBadRequest)
+				assert.EqualError(t, err, tt.errString)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
 func TestGetClientFromConfig(t *testing.T) {
 	ctx := context.Background()
 	tests := []struct {
@@ -247,3 +400,12 @@ func TestGetClientFromConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestHasServerExtension(t *testing.T) {
+	server := &api.Server{
+		ServerUntrusted: api.ServerUntrusted{APIExtensions: []string{sshKeysExtension}},
+	}
+
+	assert.True(t, hasServerExtension(server, sshKeysExtension))
+	assert.False(t, hasServerExtension(server, cloudInitConfigExtension))
+}
@@ -0,0 +1,365 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+// Copyright 2023 Cloudbase Solutions SRL
+//
+// Licensed under the AGPLv3, see LICENCE file for details
+
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/canonical/lxd/shared/api"
+	commonParams "github.com/cloudbase/garm-provider-common/params"
+	"github.com/pkg/errors"
+)
+
+const (
+	// warmPoolKey is the key we use in the instance config to mark warm instances. The
+	// value is the ID of the pool the instance is kept for.
+	warmPoolKey = "user.garm-warm"
+	// warmTemplateKey is the key we use in the instance config to record the pool
+	// settings an instance was created with. It is set on the runners and warm
+	// instances of pools that have warm instances.
+	warmTemplateKey = "user.garm-warm-template"
+
+	warmInstancePrefix = "garm-warm-"
+)
+
+// warmTemplate holds the pool settings warm instances are created with. GARM only
+// sends these settings when it creates a runner, so they are recorded on the runners
+// of the pool, and warm instances are created from the most recent ones.
+type warmTemplate struct {
+	Image      string              `json:"image"`
+	Flavor     string              `json:"flavor"`
+	OSType     commonParams.OSType `json:"os_type"`
+	OSArch     commonParams.OSArch `json:"os_arch"`
+	ExtraSpecs json.RawMessage     `json:"extra_specs,omitempty"`
+}
+
+// newWarmTemplate returns the template of the pool a runner is created for, encoded
+// so that the templates of runners of the same pool settings are equal.
+func newWarmTemplate(bootstrapParams commonParams.BootstrapInstance) (string, error) {
+	template := warmTemplate{
+		Image:  bootstrapParams.Image,
+		Flavor: bootstrapParams.Flavor,
+		OSType: bootstrapParams.OSType,
+		OSArch: bootstrapParams.OSArch,
+	}
+	if len(bootstrapParams.ExtraSpecs) > 0 {
+		extraSpecs := &bytes.Buffer{}
+		if err := json.Compact(extraSpecs, bootstrapParams.ExtraSpecs); err != nil {
+			return "", errors.Wrap(err, "compacting extra specs")
+		}
+		template.ExtraSpecs = extraSpecs.Bytes()
+	}
+
+	asJSON, err := json.Marshal(template)
+	if err != nil {
+		return "", errors.Wrap(err, "marshaling template")
+	}
+	return string(asJSON), nil
+}
+
+func isWarmInstance(instance *api.InstanceFull) bool {
+	return instance.ExpandedConfig[warmPoolKey] != ""
+}
+
+// claimWarmInstance starts the runner from a warm instance of its pool, if one with
+// the same pool settings is available. The warm instance is renamed after the runner,
+// and gets the user-data of the runner before it is started for the first time. It
+// returns false if no warm instance could be claimed, and the runner needs to be
+// created from scratch.
+func (l *LXD) claimWarmInstance(ctx context.Context, bootstrapParams commonParams.BootstrapInstance, specs extraSpecs) (bool, error) {
+	if l.cfg.WarmPools[bootstrapParams.PoolID] == 0 || bootstrapParams.Name == "" {
+		return false, nil
+	}
+
+	template, err := newWarmTemplate(bootstrapParams)
+	if err != nil {
+		return false, err
+	}
+
+	cli, err := l.getProjectCLI(ctx, specs.Project)
+	if err != nil {
+		return false, errors.Wrap(err, "fetching client")
+	}
+	instances, err := listProjectInstances(cli)
+	if err != nil {
+		return false, errors.Wrap(err, "listing warm instances")
+	}
+
+	candidates := []api.InstanceFull{}
+	for _, instance := range instances {
+		if instance.ExpandedConfig[warmPoolKey] != bootstrapParams.PoolID ||
+			instance.ExpandedConfig[controllerIDKeyName] != l.controllerID ||
+			instance.ExpandedConfig[warmTemplateKey] != template ||
+			instance.StatusCode != api.Stopped {
+			continue
+		}
+		candidates = append(candidates, instance)
+	}
+	slices.SortFunc(candidates, func(a, b api.InstanceFull) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+
+	for _, candidate := range candidates {
+		// Renaming is atomic, so if several runners race for the same warm instance,
+		// only one of them gets it. The others move on to the next one.
+		op, err := cli.RenameInstance(candidate.Name, api.InstancePost{Name: bootstrapParams.Name})
+		if err == nil {
+			err = op.Wait()
+		}
+		if err != nil {
+			slog.WarnContext(ctx, "failed to claim warm instance", "instance", candidate.Name, "runner", bootstrapParams.Name, "error", err)
+			continue
+		}
+
+		if err := l.startWarmInstance(cli, bootstrapParams, specs); err != nil {
+			return true, l.rollbackInstance(bootstrapParams.Name, err)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// startWarmInstance turns a claimed warm instance into a runner, and starts it.
+func (l *LXD) startWarmInstance(cli InstanceServerInterface, bootstrapParams commonParams.BootstrapInstance, specs extraSpecs) error {
+	instance, etag, err := cli.GetInstance(bootstrapParams.Name)
+	if err != nil {
+		return errors.Wrap(err, "fetching instance")
+	}
+
+	var template warmTemplate
+	if err := json.Unmarshal([]byte(instance.ExpandedConfig[warmTemplateKey]), &template); err != nil {
+		return errors.Wrap(err, "parsing warm pool template")
+	}
+	bootstrapConfig, err := l.getBootstrapConfig(cli, bootstrapParams, specs, isCopySource(template.Image))
+	if err != nil {
+		return err
+	}
+
+	instancePut := instance.Writable()
+	instancePut.Config = maps.Clone(instance.Config)
+	delete(instancePut.Config, warmPoolKey)
+	maps.Copy(instancePut.Config, bootstrapConfig)
+
+	op, err := cli.UpdateInstance(bootstrapParams.Name, instancePut, etag)
+	if err != nil {
+		return errors.Wrap(err, "updating instance config")
+	}
+	if err := op.Wait(); err != nil {
+		return errors.Wrap(err, "waiting for instance config update")
+	}
+
+	reqState := api.InstanceStatePut{
+		Action:  "start",
+		Timeout: -1,
+	}
+	op, err = cli.UpdateInstanceState(bootstrapParams.Name, reqState, "")
+	if err != nil {
+		return errors.Wrap(err, "starting instance")
+	}
+	if err := op.Wait(); err != nil {
+		return errors.Wrap(err, "waiting for instance to start")
+	}
+	return nil
+}
+
+// warmPoolState holds the instances of a pool that are relevant for its warm pool.
+type warmPoolState struct {
+	// template is the template of the most recent runner or warm instance of the pool.
+	template     string
+	controllerID string
+	createdAt    time.Time
+	warm         []api.InstanceFull
+}
+
+// getWarmPoolStates returns the state of the warm pools, indexed by pool ID. Pools
+// that are no longer configured are included, so their warm instances get removed.
+func (l *LXD) getWarmPoolStates(ctx context.Context) (map[string]*warmPoolState, error) {
+	states := map[string]*warmPoolState{}
+	for poolID := range l.cfg.WarmPools {
+		states[poolID] = &warmPoolState{}
+	}
+
+	for _, project := range managedProjects(l.cfg) {
+		cli, err := l.getProjectCLI(ctx, project)
+		if err != nil {
+			return nil, errors.Wrapf(err, "fetching client for project %s", project)
+		}
+		instances, err := listProjectInstances(cli)
+		if err != nil {
+			return nil, errors.Wrapf(err, "listing instances in project %s", project)
+		}
+
+		for _, instance := range instances {
+			poolID := instance.ExpandedConfig[poolIDKey]
+			if instance.ExpandedConfig[warmTemplateKey] == "" || poolID == "" {
+				continue
+			}
+			state, ok := states[poolID]
+			if !ok {
+				state = &warmPoolState{}
+				states[poolID] = state
+			}
+			if isWarmInstance(&instance) {
+				state.warm = append(state.warm, instance)
+			}
+			if state.template == "" || instance.CreatedAt.After(state.createdAt) {
+				state.createdAt = instance.CreatedAt
+				state.template = instance.ExpandedConfig[warmTemplateKey]
+				// The maintenance commands don't know the controller ID, so we use the
+				// one of the runners of the pool.
+				state.controllerID = instance.ExpandedConfig[controllerIDKeyName]
+			}
+		}
+	}
+	return states, nil
+}
+
+// replenishWarmPools creates the missing warm instances of every pool in the
+// warm_pools section of the config. Warm instances that are not stopped, or that were
+// created with outdated pool settings, are removed, as are the warm instances of pools
+// that are no longer configured. A line is written to w for every pool.
+func (l *LXD) replenishWarmPools(ctx context.Context, w io.Writer) error {
+	states, err := l.getWarmPoolStates(ctx)
+	if err != nil {
+		return err
+	}
+
+	poolIDs := slices.Sorted(maps.Keys(states))
+	var failed bool
+	for _, poolID := range poolIDs {
+		state := states[poolID]
+		size := int(l.cfg.WarmPools[poolID])
+		if size == 0 && len(state.warm) == 0 {
+			continue
+		}
+		if size > 0 && state.template == "" {
+			fmt.Fprintf(w, "pool %s: skipped, no runners were created yet\n", poolID)
+			continue
+		}
+
+		slices.SortFunc(state.warm, func(a, b api.InstanceFull) int {
+			return a.CreatedAt.Compare(b.CreatedAt)
+		})
+		remove := []string{}
+		ready := 0
+		for _, instance := range state.warm {
+			if ready < size && instance.StatusCode == api.Stopped && instance.ExpandedConfig[warmTemplateKey] == state.template {
+				ready++
+				continue
+			}
+			remove = append(remove, instance.Name)
+		}
+
+		var created, removed int
+		errs := []string{}
+		for _, name := range remove {
+			if err := l.DeleteInstance(ctx, name); err != nil {
+				errs = append(errs, fmt.Sprintf("removing %s: %s", name, err))
+				continue
+			}
+			removed++
+		}
+		for ready+created < size {
+			if err := l.createWarmInstance(ctx, poolID, state.controllerID, state.template); err != nil {
+				errs = append(errs, fmt.Sprintf("creating warm instance: %s", err))
+				break
+			}
+			created++
+		}
+
+		fmt.Fprintf(w, "pool %s: %d warm instances (created %d, removed %d)\n", poolID, ready+created, created, removed)
+		for _, msg := range errs {
+			failed = true
+			fmt.Fprintf(w, "  failed %s\n", msg)
+		}
+	}
+
+	if failed {
+		return fmt.Errorf("failed to replenish some warm pools")
+	}
+	return nil
+}
+
+// createWarmInstance creates a stopped instance for the pool, using the settings in
+// the template. The instance has no user-data, as it is only known once a runner is
+// created from it. It is booted once before being stopped, so the first boot of the
+// image is done by the time the instance is claimed. Claiming renames the instance,
+// which gives it a new cloud-init instance ID, so cloud-init runs again on the next
+// boot and applies the user-data of the runner.
+func (l *LXD) createWarmInstance(ctx context.Context, poolID, controllerID, template string) error {
+	var settings warmTemplate
+	if err := json.Unmarshal([]byte(template), &settings); err != nil {
+		return errors.Wrap(err, "parsing template")
+	}
+
+	name, err := randomInstanceName(warmInstancePrefix)
+	if err != nil {
+		return err
+	}
+
+	bootstrapParams := commonParams.BootstrapInstance{
+		Name:       name,
+		PoolID:     poolID,
+		Image:      settings.Image,
+		Flavor:     settings.Flavor,
+		OSType:     settings.OSType,
+		OSArch:     settings.OSArch,
+		ExtraSpecs: settings.ExtraSpecs,
+	}
+	specs, err := parseExtraSpecsFromBootstrapParams(bootstrapParams)
+	if err != nil {
+		return errors.Wrap(err, "parsing extra specs")
+	}
+
+	args, err := l.getInstanceArgs(ctx, bootstrapParams, specs)
+	if err != nil {
+		return errors.Wrap(err, "fetching create args")
+	}
+	args.Config[controllerIDKeyName] = controllerID
+	args.Config[warmPoolKey] = poolID
+	args.Config[warmTemplateKey] = template
+
+	cli, err := l.getProjectCLI(ctx, specs.Project)
+	if err != nil {
+		return errors.Wrap(err, "fetching client")
+	}
+	target, err := l.selectClusterMember(ctx, cli, specs.Target, poolID)
+	if err != nil {
+		return errors.Wrap(err, "selecting cluster member")
+	}
+
+	createCLI := cli
+	if target != "" {
+		createCLI = cli.UseTarget(target)
+	}
+	op, err := createCLI.CreateInstance(args)
+	if err != nil {
+		return errors.Wrap(err, "creating instance")
+	}
+	if err := op.Wait(); err != nil {
+		return l.rollbackInstance(args.Name, errors.Wrap(err, "waiting for instance creation"))
+	}
+
+	if err := l.setState(ctx, cli, args.Name, "start", false); err != nil {
+		return l.rollbackInstance(args.Name, errors.Wrap(err, "starting instance"))
+	}
+	readiness := getRunnerReadiness(l.cfg, specs, settings.OSType)
+	if _, err := l.waitInstanceReady(ctx, args.Name, readiness); err != nil {
+		return l.rollbackInstance(args.Name, errors.Wrap(err, "waiting for first boot"))
+	}
+	if err := l.Stop(ctx, args.Name, false); err != nil {
+		return l.rollbackInstance(args.Name, errors.Wrap(err, "stopping instance"))
+	}
+	return nil
+}
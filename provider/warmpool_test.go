@@ -0,0 +1,290 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+// Copyright 2023 Cloudbase Solutions SRL
+//
+// Licensed under the AGPLv3, see LICENCE file for details
+
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	lxd "github.com/canonical/lxd/client"
+	"github.com/canonical/lxd/shared/api"
+	commonParams "github.com/cloudbase/garm-provider-common/params"
+	"github.com/cloudbase/garm-provider-lxd/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func newWarmPoolTestLXD() (*LXD, *MockLXDServer) {
+	cli := new(MockLXDServer)
+	l := &LXD{
+		cfg: &config.LXD{
+			InstanceType: config.LXDImageContainer,
+			WarmPools:    map[string]uint{"pool": 1},
+		},
+		cli:          cli,
+		imageManager: &image{},
+		controllerID: "controller",
+	}
+	return l, cli
+}
+
+func warmBootstrapParams() commonParams.BootstrapInstance {
+	return commonParams.BootstrapInstance{
+		Name:   "runner",
+		PoolID: "pool",
+		Image:  "golden",
+		Flavor: "default",
+		OSType: commonParams.Linux,
+		OSArch: commonParams.Amd64,
+		Tools: []commonParams.RunnerApplicationDownload{
+			{
+				OS:           ptr("linux"),
+				Architecture: ptr("x64"),
+			},
+		},
+		ExtraSpecs: json.RawMessage(`{"cpu": 2}`),
+	}
+}
+
+func TestNewWarmTemplate(t *testing.T) {
+	params := warmBootstrapParams()
+	template, err := newWarmTemplate(params)
+	require.NoError(t, err)
+	assert.Equal(t, `{"image":"golden","flavor":"default","os_type":"linux","os_arch":"amd64","extra_specs":{"cpu":2}}`, template)
+
+	params.ExtraSpecs = json.RawMessage("{\n  \"cpu\":   2\n}")
+	reformatted, err := newWarmTemplate(params)
+	require.NoError(t, err)
+	assert.Equal(t, template, reformatted)
+}
+
+func TestClaimWarmInstance(t *testing.T) {
+	l, cli := newWarmPoolTestLXD()
+	params := warmBootstrapParams()
+	template, err := newWarmTemplate(params)
+	require.NoError(t, err)
+
+	DefaultToolFetch = func(_ commonParams.OSType, _ commonParams.OSArch, tools []commonParams.RunnerApplicationDownload) (commonParams.RunnerApplicationDownload, error) {
+		return tools[0], nil
+	}
+	DefaultGetCloudconfig = func(_ commonParams.BootstrapInstance, _ commonParams.RunnerApplicationDownload, _ string) (string, error) {
+		return "#cloud-config", nil
+	}
+
+	now := time.Now()
+	warmConfig := func(template string) map[string]string {
+		return map[string]string{
+			controllerIDKeyName: "controller",
+			poolIDKey:           "pool",
+			warmPoolKey:         "pool",
+			warmTemplateKey:     template,
+		}
+	}
+	cli.On("GetInstancesFull", lxd.GetInstancesFullArgs{InstanceType: api.InstanceTypeAny}).Return([]api.InstanceFull{
+		{Instance: api.Instance{Name: "garm-warm-outdated", StatusCode: api.Stopped, CreatedAt: now.Add(-3 * time.Hour), ExpandedConfig: warmConfig(`{"image":"old"}`)}},
+		{Instance: api.Instance{Name: "garm-warm-taken", StatusCode: api.Stopped, CreatedAt: now.Add(-2 * time.Hour), ExpandedConfig: warmConfig(template)}},
+		{Instance: api.Instance{Name: "garm-warm-free", StatusCode: api.Stopped, CreatedAt: now.Add(-time.Hour), ExpandedConfig: warmConfig(template)}},
+		{Instance: api.Instance{Name: "garm-warm-booting", StatusCode: api.Running, CreatedAt: now, ExpandedConfig: warmConfig(template)}},
+	}, nil)
+
+	mockOp := new(MockOperation)
+	mockOp.On("Wait").Return(nil)
+	failedOp := new(MockOperation)
+	failedOp.On("Wait").Return(fmt.Errorf("not found"))
+	cli.On("RenameInstance", "garm-warm-taken", api.InstancePost{Name: "runner"}).Return(failedOp, nil)
+	cli.On("RenameInstance", "garm-warm-free", api.InstancePost{Name: "runner"}).Return(mockOp, nil)
+
+	cli.On("GetInstance", "runner").Return(&api.Instance{
+		Name:           "runner",
+		Config:         warmConfig(template),
+		ExpandedConfig: warmConfig(template),
+	}, "etag", nil)
+	// The warm path doesn't look at the architectures of the server, so this is the
+	// only server info the extension check can rely on. Servers without the extension
+	// get the user-data in the legacy key.
+	cli.On("GetServer").Return(&api.Server{}, "", nil)
+	cli.On("UpdateInstance", "runner", api.InstancePut{
+		Config: map[string]string{
+			controllerIDKeyName:   "controller",
+			poolIDKey:             "pool",
+			warmTemplateKey:       template,
+			legacyUserDataKeyName: "#cloud-config",
+		},
+	}, "etag").Return(mockOp, nil)
+	cli.On("UpdateInstanceState", "runner", "", api.InstanceStatePut{
+		Action:  "start",
+		Timeout: -1,
+	}).Return(mockOp, nil)
+
+	claimed, err := l.claimWarmInstance(context.Background(), params, extraSpecs{CPU: 2})
+	require.NoError(t, err)
+	assert.True(t, claimed)
+	cli.AssertExpectations(t)
+	cli.AssertNotCalled(t, "RenameInstance", "garm-warm-outdated", mock.Anything)
+	cli.AssertNotCalled(t, "RenameInstance", "garm-warm-booting", mock.Anything)
+}
+
+func TestClaimWarmInstanceNoneAvailable(t *testing.T) {
+	l, cli := newWarmPoolTestLXD()
+	cli.On("GetInstancesFull", lxd.GetInstancesFullArgs{InstanceType: api.InstanceTypeAny}).Return([]api.InstanceFull{}, nil)
+
+	claimed, err := l.claimWarmInstance(context.Background(), warmBootstrapParams(), extraSpecs{})
+	require.NoError(t, err)
+	assert.False(t, claimed)
+
+	params := warmBootstrapParams()
+	params.PoolID = "other-pool"
+	claimed, err = l.claimWarmInstance(context.Background(), params, extraSpecs{})
+	require.NoError(t, err)
+	assert.False(t, claimed)
+	cli.AssertNumberOfCalls(t, "GetInstancesFull", 1)
+}
+
+func TestClaimWarmInstanceListFails(t *testing.T) {
+	cli := new(MockLXDServer)
+	l := &LXD{
+		cfg: &config.LXD{
+			InstanceType: config.LXDImageContainer,
+			WarmPools:    map[string]uint{"pool": 1},
+		},
+		cli:          cli,
+		imageManager: &image{},
+		controllerID: "controller",
+	}
+	cli.On("GetInstancesFull", lxd.GetInstancesFullArgs{InstanceType: api.InstanceTypeAny}).Return(([]api.InstanceFull)(nil), fmt.Errorf("connection refused"))
+
+	claimed, err := l.claimWarmInstance(context.Background(), warmBootstrapParams(), extraSpecs{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "connection refused")
+	assert.False(t, claimed)
+}
+
+func TestListInstancesHidesWarmInstances(t *testing.T) {
+	l, cli := newWarmPoolTestLXD()
+	cli.On("GetInstancesFull", lxd.GetInstancesFullArgs{InstanceType: api.InstanceTypeAny}).Return([]api.InstanceFull{
+		{
+			Instance: api.Instance{
+				Name:           "runner",
+				ExpandedConfig: map[string]string{controllerIDKeyName: "controller", poolIDKey: "pool"},
+			},
+			State: &api.InstanceState{Status: "Running"},
+		},
+		{
+			Instance: api.Instance{
+				Name:           "garm-warm-0a1b2c3d",
+				ExpandedConfig: map[string]string{controllerIDKeyName: "controller", poolIDKey: "pool", warmPoolKey: "pool"},
+			},
+			State: &api.InstanceState{Status: "Stopped"},
+		},
+	}, nil)
+
+	instances, err := l.ListInstances(context.Background(), "pool")
+	require.NoError(t, err)
+	require.Len(t, instances, 1)
+	assert.Equal(t, "runner", instances[0].Name)
+}
+
+func TestReplenishWarmPools(t *testing.T) {
+	l, cli := newWarmPoolTestLXD()
+	l.controllerID = ""
+	params := warmBootstrapParams()
+	template, err := newWarmTemplate(params)
+	require.NoError(t, err)
+
+	now := time.Now()
+	cli.On("GetInstancesFull", lxd.GetInstancesFullArgs{InstanceType: api.InstanceTypeAny}).Return([]api.InstanceFull{
+		{
+			Instance: api.Instance{
+				Name:       "runner",
+				StatusCode: api.Running,
+				CreatedAt:  now,
+				ExpandedConfig: map[string]string{
+					controllerIDKeyName: "controller",
+					poolIDKey:           "pool",
+					warmTemplateKey:     template,
+				},
+			},
+		},
+		{
+			Instance: api.Instance{
+				Name:       "garm-warm-outdated",
+				StatusCode: api.Stopped,
+				CreatedAt:  now.Add(-time.Hour),
+				ExpandedConfig: map[string]string{
+					controllerIDKeyName: "controller",
+					poolIDKey:           "pool",
+					warmPoolKey:         "pool",
+					warmTemplateKey:     `{"image":"old"}`,
+				},
+			},
+		},
+	}, nil)
+
+	mockOp := new(MockOperation)
+	mockOp.On("Wait").Return(nil)
+	mockOp.On("WaitContext", mock.Anything).Return(nil)
+	cli.On("UpdateInstanceState", "garm-warm-outdated", "", api.InstanceStatePut{
+		Action:  "stop",
+		Timeout: -1,
+		Force:   true,
+	}).Return(mockOp, nil)
+	cli.On("DeleteInstance", "garm-warm-outdated", false).Return(mockOp, nil)
+	cli.On("GetInstance", "garm-warm-outdated").Return(&api.Instance{Name: "garm-warm-outdated"}, "", nil)
+
+	aliases := map[string]*api.ImageAliasesEntry{
+		"x86_64": {Name: "golden", Target: "123abc"},
+	}
+	cli.On("GetProfileNames").Return([]string{"default"}, nil)
+	cli.On("GetImageAliasArchitectures", "container", "golden").Return(aliases, nil)
+	cli.On("GetImage", "123abc").Return(&api.Image{Fingerprint: "123abc"}, "", nil)
+	cli.On("GetServer").Return(&api.Server{
+		Environment: api.ServerEnvironment{Architectures: []string{"x86_64", "i686"}},
+	}, "", nil)
+	cli.On("IsClustered").Return(false)
+	cli.On("CreateInstance", mock.MatchedBy(func(args api.InstancesPost) bool {
+		return args.Config[warmPoolKey] == "pool" &&
+			args.Config[controllerIDKeyName] == "controller" &&
+			args.Config[warmTemplateKey] == template &&
+			args.Config["limits.cpu"] == "2" &&
+			args.Config["user.user-data"] == "" &&
+			args.Source.Fingerprint == "123abc"
+	})).Return(mockOp, nil)
+
+	// The new warm instance is booted once, and stopped.
+	isNewWarm := func(name string) bool {
+		return strings.HasPrefix(name, warmInstancePrefix) && name != "garm-warm-outdated"
+	}
+	for _, state := range []api.InstanceStatePut{
+		{Action: "start", Timeout: -1},
+		{Action: "stop", Timeout: -1},
+	} {
+		cli.On("UpdateInstanceState", mock.MatchedBy(isNewWarm), "", state).Return(mockOp, nil).Once()
+	}
+	cli.On("GetEvents").Return((*lxd.EventListener)(nil), fmt.Errorf("events not available"))
+	cli.On("GetInstanceFull", mock.MatchedBy(isNewWarm)).Return(instanceWithAddress("10.10.0.1"), "", nil)
+	cli.On("GetInstance", mock.MatchedBy(isNewWarm)).Return(&api.Instance{}, "", nil)
+
+	out := &bytes.Buffer{}
+	require.NoError(t, l.replenishWarmPools(context.Background(), out))
+	assert.Equal(t, "pool pool: 1 warm instances (created 1, removed 1)\n", out.String())
+	cli.AssertExpectations(t)
+}
+
+func TestReplenishWarmPoolsWithoutRunners(t *testing.T) {
+	l, cli := newWarmPoolTestLXD()
+	cli.On("GetInstancesFull", lxd.GetInstancesFullArgs{InstanceType: api.InstanceTypeAny}).Return([]api.InstanceFull{}, nil)
+
+	out := &bytes.Buffer{}
+	require.NoError(t, l.replenishWarmPools(context.Background(), out))
+	assert.Equal(t, "pool pool: skipped, no runners were created yet\n", out.String())
+	cli.AssertNotCalled(t, "CreateInstance", mock.Anything)
+}
@@ -0,0 +1,141 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+// Copyright 2023 Cloudbase Solutions SRL
+//
+// Licensed under the AGPLv3, see LICENCE file for details
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"strings"
+	"time"
+
+	"github.com/canonical/lxd/shared/api"
+	runnerErrors "github.com/cloudbase/garm-provider-common/errors"
+	commonParams "github.com/cloudbase/garm-provider-common/params"
+	"github.com/cloudbase/garm-provider-lxd/config"
+	"github.com/pkg/errors"
+)
+
+const (
+	// guestOSNameKey and guestOSVersionKey are the keys we use in the instance config
+	// to record the OS reported by the guest, for images that don't set image.os and
+	// image.release.
+	guestOSNameKey    = "user.guest-os-name"
+	guestOSVersionKey = "user.guest-os-version"
+
+	// windowsShutdownTimeout is the time we give Windows runners to shut down cleanly,
+	// before they are forcefully stopped.
+	windowsShutdownTimeout = 2 * time.Minute
+
+	// guestOSInfoCommand prints the name and version of Windows, on separate lines.
+	guestOSInfoCommand = "$os = Get-CimInstance Win32_OperatingSystem; Write-Output $os.Caption; Write-Output $os.Version"
+)
+
+// getRunnerInstanceType returns the instance type of a runner. Windows runners always
+// run in virtual machines.
+func getRunnerInstanceType(cfg *config.LXD, specs extraSpecs, osType commonParams.OSType) (config.LXDImageType, error) {
+	if osType != commonParams.Windows {
+		return getInstanceType(cfg, specs), nil
+	}
+	if specs.InstanceType == config.LXDImageContainer {
+		return "", runnerErrors.NewBadRequestError("windows runners can only run in virtual machines")
+	}
+	return config.LXDImageVirtualMachine, nil
+}
+
+// getWindowsDevices returns the devices Windows runners need: a config drive, which
+// is how cloudbase-init gets the user-data, and a virtual TPM, unless the pool
+// disables it.
+func getWindowsDevices(specs extraSpecs) map[string]map[string]string {
+	devices := map[string]map[string]string{
+		"cloud-init": {
+			"type":   "disk",
+			"source": "cloud-init:config",
+		},
+	}
+	if specs.TPM == nil || *specs.TPM {
+		devices["vtpm"] = map[string]string{
+			"type": "tpm",
+		}
+	}
+	return devices
+}
+
+func isWindowsInstance(instance *api.Instance) bool {
+	if strings.EqualFold(instance.ExpandedConfig["image.os"], "windows") {
+		return true
+	}
+	return commonParams.OSType(instance.ExpandedConfig[osTypeKeyName]) == commonParams.Windows
+}
+
+// recordGuestOS asks the guest for the name and version of Windows through the LXD
+// agent, and records them in the instance config, so they can be reported for images
+// that don't set image.os and image.release.
+func (l *LXD) recordGuestOS(ctx context.Context, instanceName string) (string, string, error) {
+	cli, err := l.getInstanceCLI(ctx, instanceName)
+	if err != nil {
+		return "", "", errors.Wrap(err, "fetching client")
+	}
+
+	result, err := execInstance(ctx, cli, instanceName, []string{"powershell.exe", "-NoProfile", "-NonInteractive", "-Command", guestOSInfoCommand})
+	if err != nil {
+		return "", "", errors.Wrap(err, "querying guest OS")
+	}
+	lines := strings.Split(strings.TrimSpace(result.stdout), "\n")
+	if result.exitCode != 0 || len(lines) != 2 {
+		return "", "", fmt.Errorf("unexpected guest OS output (exit code %d): %s", result.exitCode, strings.TrimSpace(result.stdout+result.stderr))
+	}
+	osName := strings.TrimSpace(lines[0])
+	osVersion := strings.TrimSpace(lines[1])
+
+	instance, etag, err := cli.GetInstance(instanceName)
+	if err != nil {
+		return "", "", errors.Wrap(err, "fetching instance")
+	}
+	instancePut := instance.Writable()
+	instancePut.Config = maps.Clone(instance.Config)
+	if instancePut.Config == nil {
+		instancePut.Config = map[string]string{}
+	}
+	instancePut.Config[guestOSNameKey] = osName
+	instancePut.Config[guestOSVersionKey] = osVersion
+	op, err := cli.UpdateInstance(instanceName, instancePut, etag)
+	if err != nil {
+		return "", "", errors.Wrap(err, "updating instance config")
+	}
+	if err := op.Wait(); err != nil {
+		return "", "", errors.Wrap(err, "waiting for instance config update")
+	}
+	return osName, osVersion, nil
+}
+
+// shutdownWindowsInstance asks a running Windows instance to shut down, and waits for
+// it to stop. It returns false if the instance is not a running Windows instance, in
+// which case nothing is done.
+func (l *LXD) shutdownWindowsInstance(ctx context.Context, cli InstanceServerInterface, instanceName string) (bool, error) {
+	instance, _, err := cli.GetInstance(instanceName)
+	if err != nil {
+		return false, errors.Wrap(err, "fetching instance")
+	}
+	if !isWindowsInstance(instance) || instance.StatusCode != api.Running {
+		return false, nil
+	}
+
+	reqState := api.InstanceStatePut{
+		Action:  "stop",
+		Timeout: int(windowsShutdownTimeout / time.Second),
+	}
+	op, err := cli.UpdateInstanceState(instanceName, reqState, "")
+	if err != nil {
+		return true, errors.Wrap(err, "shutting down instance")
+	}
+	ctxTimeout, cancel := context.WithTimeout(ctx, windowsShutdownTimeout+30*time.Second)
+	defer cancel()
+	if err := op.WaitContext(ctxTimeout); err != nil {
+		return true, errors.Wrap(err, "waiting for instance to shut down")
+	}
+	return true, nil
+}
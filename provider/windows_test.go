@@ -0,0 +1,179 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+// Copyright 2023 Cloudbase Solutions SRL
+//
+// Licensed under the AGPLv3, see LICENCE file for details
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/canonical/lxd/shared/api"
+	runnerErrors "github.com/cloudbase/garm-provider-common/errors"
+	commonParams "github.com/cloudbase/garm-provider-common/params"
+	"github.com/cloudbase/garm-provider-lxd/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetRunnerInstanceType(t *testing.T) {
+	cfg := &config.LXD{InstanceType: config.LXDImageContainer}
+
+	instanceType, err := getRunnerInstanceType(cfg, extraSpecs{}, commonParams.Linux)
+	require.NoError(t, err)
+	assert.Equal(t, config.LXDImageContainer, instanceType)
+
+	instanceType, err = getRunnerInstanceType(cfg, extraSpecs{}, commonParams.Windows)
+	require.NoError(t, err)
+	assert.Equal(t, config.LXDImageVirtualMachine, instanceType)
+
+	_, err = getRunnerInstanceType(cfg, extraSpecs{InstanceType: config.LXDImageContainer}, commonParams.Windows)
+	require.ErrorIs(t, err, runnerErrors.ErrBadRequest)
+}
+
+func TestGetWindowsDevices(t *testing.T) {
+	devices := getWindowsDevices(extraSpecs{})
+	assert.Equal(t, map[string]map[string]string{
+		"cloud-init": {"type": "disk", "source": "cloud-init:config"},
+		"vtpm":       {"type": "tpm"},
+	}, devices)
+
+	devices = getWindowsDevices(extraSpecs{TPM: ptr(false)})
+	assert.NotContains(t, devices, "vtpm")
+}
+
+func TestRecordGuestOS(t *testing.T) {
+	cli := new(MockLXDServer)
+	l := &LXD{
+		cfg:          &config.LXD{},
+		cli:          cli,
+		imageManager: &image{},
+		controllerID: "controller",
+	}
+
+	command := []string{"powershell.exe", "-NoProfile", "-NonInteractive", "-Command", guestOSInfoCommand}
+	mockExec(cli, "runner", command, "Microsoft Windows Server 2022 Datacenter\r\n10.0.20348\r\n", 0)
+	cli.On("GetInstance", "runner").Return(&api.Instance{
+		Name:   "runner",
+		Config: map[string]string{osTypeKeyName: "windows"},
+	}, "etag", nil)
+	mockOp := new(MockOperation)
+	mockOp.On("Wait").Return(nil)
+	cli.On("UpdateInstance", "runner", api.InstancePut{
+		Config: map[string]string{
+			osTypeKeyName:     "windows",
+			guestOSNameKey:    "Microsoft Windows Server 2022 Datacenter",
+			guestOSVersionKey: "10.0.20348",
+		},
+	}, "etag").Return(mockOp, nil)
+
+	osName, osVersion, err := l.recordGuestOS(context.Background(), "runner")
+	require.NoError(t, err)
+	assert.Equal(t, "Microsoft Windows Server 2022 Datacenter", osName)
+	assert.Equal(t, "10.0.20348", osVersion)
+	cli.AssertExpectations(t)
+
+	instance := lxdInstanceToAPIInstance(&api.InstanceFull{
+		Instance: api.Instance{
+			Name:         "runner",
+			Architecture: "x86_64",
+			ExpandedConfig: map[string]string{
+				osTypeKeyName:     "windows",
+				guestOSNameKey:    "Microsoft Windows Server 2022 Datacenter",
+				guestOSVersionKey: "10.0.20348",
+			},
+		},
+		State: &api.InstanceState{Status: "Running"},
+	})
+	assert.Equal(t, commonParams.Windows, instance.OSType)
+	assert.Equal(t, "microsoft windows server 2022 datacenter", instance.OSName)
+	assert.Equal(t, "10.0.20348", instance.OSVersion)
+}
+
+func TestStopWindowsInstance(t *testing.T) {
+	shutdown := api.InstanceStatePut{
+		Action:  "stop",
+		Timeout: int(windowsShutdownTimeout.Seconds()),
+	}
+	forceStop := api.InstanceStatePut{
+		Action:  "stop",
+		Timeout: -1,
+		Force:   true,
+	}
+	windows := &api.Instance{
+		Name:           "runner",
+		StatusCode:     api.Running,
+		ExpandedConfig: map[string]string{osTypeKeyName: "windows"},
+	}
+
+	t.Run("clean shutdown", func(t *testing.T) {
+		cli := new(MockLXDServer)
+		l := &LXD{cfg: &config.LXD{}, cli: cli, imageManager: &image{}}
+		mockOp := new(MockOperation)
+		mockOp.On("WaitContext", mock.Anything).Return(nil)
+		cli.On("GetInstance", "runner").Return(windows, "", nil)
+		cli.On("UpdateInstanceState", "runner", "", shutdown).Return(mockOp, nil)
+
+		require.NoError(t, l.Stop(context.Background(), "runner", false))
+		cli.AssertNotCalled(t, "UpdateInstanceState", "runner", "", forceStop)
+	})
+
+	t.Run("shutdown times out", func(t *testing.T) {
+		cli := new(MockLXDServer)
+		l := &LXD{cfg: &config.LXD{}, cli: cli, imageManager: &image{}}
+		failedOp := new(MockOperation)
+		failedOp.On("WaitContext", mock.Anything).Return(fmt.Errorf("timed out"))
+		mockOp := new(MockOperation)
+		mockOp.On("WaitContext", mock.Anything).Return(nil)
+		cli.On("GetInstance", "runner").Return(windows, "", nil)
+		cli.On("UpdateInstanceState", "runner", "", shutdown).Return(failedOp, nil)
+		cli.On("UpdateInstanceState", "runner", "", forceStop).Return(mockOp, nil)
+
+		require.NoError(t, l.Stop(context.Background(), "runner", false))
+		cli.AssertExpectations(t)
+	})
+
+	t.Run("linux instance", func(t *testing.T) {
+		cli := new(MockLXDServer)
+		l := &LXD{cfg: &config.LXD{}, cli: cli, imageManager: &image{}}
+		mockOp := new(MockOperation)
+		mockOp.On("WaitContext", mock.Anything).Return(nil)
+		cli.On("GetInstance", "runner").Return(&api.Instance{
+			Name:           "runner",
+			StatusCode:     api.Running,
+			ExpandedConfig: map[string]string{osTypeKeyName: "linux"},
+		}, "", nil)
+		cli.On("UpdateInstanceState", "runner", "", api.InstanceStatePut{Action: "stop", Timeout: -1}).Return(mockOp, nil)
+
+		require.NoError(t, l.Stop(context.Background(), "runner", false))
+		cli.AssertNotCalled(t, "UpdateInstanceState", "runner", "", shutdown)
+	})
+}
+
+func TestDeleteWindowsInstance(t *testing.T) {
+	cli := new(MockLXDServer)
+	l := &LXD{cfg: &config.LXD{}, cli: cli, imageManager: &image{}}
+	mockOp := new(MockOperation)
+	mockOp.On("WaitContext", mock.Anything).Return(nil)
+	cli.On("GetInstance", "runner").Return(&api.Instance{
+		Name:           "runner",
+		StatusCode:     api.Running,
+		ExpandedConfig: map[string]string{"image.os": "Windows"},
+	}, "", nil)
+	cli.On("UpdateInstanceState", "runner", "", api.InstanceStatePut{
+		Action:  "stop",
+		Timeout: int(windowsShutdownTimeout.Seconds()),
+	}).Return(mockOp, nil)
+	cli.On("UpdateInstanceState", "runner", "", api.InstanceStatePut{
+		Action:  "stop",
+		Timeout: -1,
+		Force:   true,
+	}).Return((*MockOperation)(nil), api.StatusErrorf(400, "%s", errInstanceIsStopped.Error()))
+	cli.On("DeleteInstance", "runner", false).Return(mockOp, nil)
+
+	require.NoError(t, l.DeleteInstance(context.Background(), "runner"))
+	cli.AssertExpectations(t)
+}